@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// loadConfig sets flags of cmd from a config file. Each non-empty line
+// is "flag = value", named like the long flag without dashes; lines
+// starting with # are comments. Repeating a line adds another value to
+// list flags. Flags given on the command line take precedence.
+func loadConfig(cmd *cobra.Command, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("%s:%d: want flag = value", path, lineNo)
+		}
+
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, name)
+		}
+		if flag.Changed {
+			continue
+		}
+
+		if err := flag.Value.Set(strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %w", path, lineNo, name, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	return nil
+}
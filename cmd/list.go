@@ -11,12 +11,14 @@ var listCmd = &cobra.Command{
 	Use:   "list-interfaces",
 	Short: "List all available network interfaces",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := sniffer.ListInterfaces(); err != nil {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		if err := sniffer.ListInterfaces(asJSON); err != nil {
 			fmt.Println("error listing interfaces:", err)
 		}
 	},
 }
 
 func init() {
+	listCmd.Flags().Bool("json", false, "Print the interfaces as JSON")
 	rootCmd.AddCommand(listCmd)
 }
@@ -1,35 +1,182 @@
 package cmd
 
 import (
+	"log"
+	"time"
+
 	"github.com/spf13/cobra"
+	"github.com/zczqas/sniff-n-fetch/internal/server"
 	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
 )
 
-var interfaceName string
+var interfaceNames []string
+var interfaceInclude []string
+var interfaceExclude []string
 var filter string
+var snapLen int
+var promiscuous bool
+var readTimeout time.Duration
+var bufferSize int
+var immediateMode bool
+var timestampSource string
+var timestampPrecision string
 var useUI bool
 var saveFile string
+var saveFormat string
 var maxPackets int
+var rotateSize int
+var rotateInterval time.Duration
+var rotateFiles int
+var triggerDir string
+var triggerBefore time.Duration
+var triggerAfter time.Duration
+var triggerBuffer int
+var readFile string
+var realtime bool
+var showFlows bool
+var flowIdleTimeout time.Duration
+var flowActiveTimeout time.Duration
+var exportCollector string
+var exportFormat string
+var listenAddr string
+var detectors []string
+var detectorOpts []string
+var configFile string
+var output string
+var workers int
+var queueSize int
+var dropWarn float64
+var reverseDNS bool
+var dnsServer string
+var dnsTCP bool
+var dnsTimeout time.Duration
+var dnsRateLimit float64
 
 var sniffCmd = &cobra.Command{
 	Use:   "sniff",
 	Short: "Start sniffing packets on a network interface",
 	Run: func(cmd *cobra.Command, args []string) {
-		if useUI {
-			sniffer.StartUI(interfaceName, filter, saveFile, maxPackets)
-		} else {
-			sniffer.Start(interfaceName, filter, saveFile, maxPackets)
+		if configFile != "" {
+			if err := loadConfig(cmd, configFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		options, err := sniffer.ParseDetectorOptions(detectorOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Catch detector typos before opening the capture.
+		if _, err := sniffer.NewDetectors(detectors, options); err != nil {
+			log.Fatal(err)
+		}
+
+		cfg := sniffer.Config{
+			Interfaces:       interfaceNames,
+			InterfaceInclude: interfaceInclude,
+			InterfaceExclude: interfaceExclude,
+
+			Filter:     filter,
+			SaveFile:   saveFile,
+			SaveFormat: saveFormat,
+			MaxPackets: maxPackets,
+			ReadFile:   readFile,
+			Realtime:   realtime,
+
+			SnapLen:            snapLen,
+			Promiscuous:        promiscuous,
+			ReadTimeout:        readTimeout,
+			BufferSize:         bufferSize * 1024,
+			ImmediateMode:      immediateMode,
+			TimestampSource:    timestampSource,
+			TimestampPrecision: timestampPrecision,
+
+			RotateSize:     int64(rotateSize) * 1_000_000,
+			RotateInterval: rotateInterval,
+			RotateFiles:    rotateFiles,
+
+			TriggerDir:    triggerDir,
+			TriggerBefore: triggerBefore,
+			TriggerAfter:  triggerAfter,
+			TriggerBuffer: int64(triggerBuffer) * 1_000_000,
+
+			ShowFlows:         showFlows,
+			FlowIdleTimeout:   flowIdleTimeout,
+			FlowActiveTimeout: flowActiveTimeout,
+
+			ExportCollector: exportCollector,
+			ExportFormat:    exportFormat,
+
+			Detectors:       detectors,
+			DetectorOptions: options,
+
+			Workers:           workers,
+			QueueSize:         queueSize,
+			DropWarnThreshold: dropWarn,
+
+			ReverseDNS:   reverseDNS,
+			DNSServer:    dnsServer,
+			DNSTCP:       dnsTCP,
+			DNSTimeout:   dnsTimeout,
+			DNSRateLimit: dnsRateLimit,
+
+			Output: output,
+		}
+
+		switch {
+		case listenAddr != "":
+			if useUI {
+				log.Fatal("--listen cannot be combined with --ui")
+			}
+			serve(cfg)
+		case useUI:
+			if output != sniffer.OutputText {
+				log.Fatal("--output cannot be combined with --ui")
+			}
+			sniffer.StartUI(cfg)
+		default:
+			sniffer.Start(cfg)
 		}
 	},
 }
 
+// serve runs the capture headless and exposes it over the HTTP API.
+func serve(cfg sniffer.Config) {
+	if err := sniffer.InitGeoIP(); err != nil {
+		log.Printf("warning: GeoIP initialization failed: %v", err)
+	}
+	defer sniffer.CloseGeoIP()
+
+	cfg.Quiet = true
+	capture := sniffer.NewCapture(cfg)
+	if err := capture.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := server.New(capture).ListenAndServe(listenAddr); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func init() {
-	sniffCmd.Flags().StringVarP(
-		&interfaceName,
+	sniffCmd.Flags().StringSliceVarP(
+		&interfaceNames,
 		"interface",
 		"i",
-		"eth0",
-		"Interface to sniff on",
+		[]string{"eth0"},
+		"Interfaces to sniff on (repeatable, or any for every interface that is up)",
+	)
+	sniffCmd.Flags().StringSliceVar(
+		&interfaceInclude,
+		"include",
+		nil,
+		"With -i any, only capture on interfaces matching these patterns (e.g. 'eth*')",
+	)
+	sniffCmd.Flags().StringSliceVar(
+		&interfaceExclude,
+		"exclude",
+		nil,
+		"With -i any, skip interfaces matching these patterns (e.g. 'docker*,veth*')",
 	)
 	sniffCmd.Flags().StringVarP(
 		&filter,
@@ -38,17 +185,75 @@ func init() {
 		"",
 		"BPF filter (e.g. 'tcp and port 80')",
 	)
+	sniffCmd.Flags().IntVarP(
+		&snapLen,
+		"snaplen",
+		"s",
+		sniffer.DefaultSnapLen,
+		"Bytes to capture of each packet",
+	)
+	sniffCmd.Flags().BoolVar(
+		&promiscuous,
+		"promisc",
+		true,
+		"Put the interface in promiscuous mode",
+	)
+	sniffCmd.Flags().DurationVar(
+		&readTimeout,
+		"timeout",
+		0,
+		"How long the kernel may buffer packets before delivering them (0 to wait for a full buffer)",
+	)
+	sniffCmd.Flags().IntVarP(
+		&bufferSize,
+		"buffer-size",
+		"B",
+		0,
+		"Kernel capture buffer size in KiB (0 for the libpcap default)",
+	)
+	sniffCmd.Flags().BoolVar(
+		&immediateMode,
+		"immediate",
+		false,
+		"Deliver packets as soon as they arrive instead of buffering them",
+	)
+	sniffCmd.Flags().StringVarP(
+		&timestampSource,
+		"tstamp-type",
+		"j",
+		"",
+		"Timestamp source, such as host or adapter (default chosen by libpcap)",
+	)
+	sniffCmd.Flags().StringVar(
+		&timestampPrecision,
+		"tstamp-precision",
+		sniffer.TimestampMicro,
+		"Timestamp precision of saved pcap files (micro or nano)",
+	)
 	sniffCmd.Flags().BoolVar(
 		&useUI,
 		"ui",
 		false,
 		"Display live terminal UI",
 	)
+	sniffCmd.Flags().StringVarP(
+		&output,
+		"output",
+		"o",
+		sniffer.OutputText,
+		"Console output format (text or json for JSON Lines)",
+	)
 	sniffCmd.Flags().StringVar(
 		&saveFile,
 		"save",
 		"",
-		"Save captured packets to a pcap file",
+		"Save captured packets to a pcap file (may contain strftime directives such as %Y%m%d-%H%M%S)",
+	)
+	sniffCmd.Flags().StringVar(
+		&saveFormat,
+		"save-format",
+		"",
+		"Save file format (pcap or pcapng; default by file extension)",
 	)
 	sniffCmd.Flags().IntVar(
 		&maxPackets,
@@ -56,5 +261,165 @@ func init() {
 		0,
 		"Maximum number of packets to capture (0 for unlimited)",
 	)
+	sniffCmd.Flags().IntVarP(
+		&rotateSize,
+		"rotate-size",
+		"C",
+		0,
+		"Start a new save file when the current one reaches this many MB",
+	)
+	sniffCmd.Flags().DurationVarP(
+		&rotateInterval,
+		"rotate-interval",
+		"G",
+		0,
+		"Start a new save file after this long (e.g. 1h)",
+	)
+	sniffCmd.Flags().IntVarP(
+		&rotateFiles,
+		"rotate-files",
+		"W",
+		0,
+		"Keep only this many save files when rotating (0 for all)",
+	)
+	sniffCmd.Flags().StringVar(
+		&triggerDir,
+		"trigger-dir",
+		"",
+		"Save the packets around each alert to a file in this directory",
+	)
+	sniffCmd.Flags().DurationVar(
+		&triggerBefore,
+		"trigger-before",
+		sniffer.DefaultTriggerBefore,
+		"Packet history to include before an alert",
+	)
+	sniffCmd.Flags().DurationVar(
+		&triggerAfter,
+		"trigger-after",
+		sniffer.DefaultTriggerAfter,
+		"How long to keep saving after an alert",
+	)
+	sniffCmd.Flags().IntVar(
+		&triggerBuffer,
+		"trigger-buffer",
+		sniffer.DefaultTriggerBuffer/1_000_000,
+		"Maximum MB of packet history kept for alerts",
+	)
+	sniffCmd.Flags().StringVarP(
+		&readFile,
+		"read",
+		"r",
+		"",
+		"Read packets from a pcap or pcapng file (- for stdin) instead of an interface",
+	)
+	sniffCmd.Flags().BoolVar(
+		&realtime,
+		"realtime",
+		false,
+		"Replay packets from --read at their original timing",
+	)
+	sniffCmd.Flags().BoolVar(
+		&showFlows,
+		"flows",
+		false,
+		"Print the flow table with the periodic stats",
+	)
+	sniffCmd.Flags().DurationVar(
+		&flowIdleTimeout,
+		"flow-idle-timeout",
+		sniffer.DefaultFlowIdleTimeout,
+		"Expire flows with no packets for this long",
+	)
+	sniffCmd.Flags().DurationVar(
+		&flowActiveTimeout,
+		"flow-active-timeout",
+		sniffer.DefaultFlowActiveTimeout,
+		"Expire long-lived flows after this long",
+	)
+	sniffCmd.Flags().StringVar(
+		&exportCollector,
+		"export",
+		"",
+		"Export expired flows to a collector at host:port",
+	)
+	sniffCmd.Flags().StringVar(
+		&exportFormat,
+		"export-format",
+		sniffer.ExportIPFIX,
+		"Flow export format (ipfix or netflow9)",
+	)
+	sniffCmd.Flags().IntVar(
+		&workers,
+		"workers",
+		0,
+		"Number of packet processing workers (0 for one per CPU)",
+	)
+	sniffCmd.Flags().IntVar(
+		&queueSize,
+		"queue-size",
+		sniffer.DefaultQueueSize,
+		"Packets each worker can have waiting before live captures drop them",
+	)
+	sniffCmd.Flags().Float64Var(
+		&dropWarn,
+		"drop-warn",
+		sniffer.DefaultDropWarnThreshold,
+		"Warn when more than this percentage of packets is dropped (0 to disable)",
+	)
+	sniffCmd.Flags().BoolVar(
+		&reverseDNS,
+		"reverse-dns",
+		false,
+		"Look up PTR records for addresses not named by DNS traffic in the capture",
+	)
+	sniffCmd.Flags().StringVar(
+		&dnsServer,
+		"dns-server",
+		"",
+		"DNS server for reverse lookups as host[:port] (system resolver if empty)",
+	)
+	sniffCmd.Flags().BoolVar(
+		&dnsTCP,
+		"dns-tcp",
+		false,
+		"Send reverse lookups over TCP",
+	)
+	sniffCmd.Flags().DurationVar(
+		&dnsTimeout,
+		"dns-timeout",
+		sniffer.DefaultEnrichTimeout,
+		"Give up on a reverse lookup after this long",
+	)
+	sniffCmd.Flags().Float64Var(
+		&dnsRateLimit,
+		"dns-rate",
+		0,
+		"Maximum reverse lookups per second (0 for no limit)",
+	)
+	sniffCmd.Flags().StringVar(
+		&listenAddr,
+		"listen",
+		"",
+		"Run headless and serve the HTTP API on this address (e.g. :8080)",
+	)
+	sniffCmd.Flags().StringSliceVar(
+		&detectors,
+		"detectors",
+		sniffer.DetectorNames(),
+		"Anomaly detectors to run (none to disable all)",
+	)
+	sniffCmd.Flags().StringArrayVar(
+		&detectorOpts,
+		"detector-opt",
+		nil,
+		"Detector setting as detector.key=value (repeatable, e.g. flood.rate=500)",
+	)
+	sniffCmd.Flags().StringVar(
+		&configFile,
+		"config",
+		"",
+		"Read settings from a file of flag = value lines",
+	)
 	rootCmd.AddCommand(sniffCmd)
 }
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// Server exposes the state of a running capture as a JSON HTTP API.
+type Server struct {
+	capture *sniffer.Capture
+	mux     *http.ServeMux
+}
+
+func New(capture *sniffer.Capture) *Server {
+	s := &Server{
+		capture: capture,
+		mux:     http.NewServeMux(),
+	}
+	s.routes()
+	return s
+}
+
+func (s *Server) routes() {
+	s.mux.HandleFunc("GET /api/stats", s.handleStats)
+	s.mux.HandleFunc("GET /api/packets", s.handlePackets)
+	s.mux.HandleFunc("GET /api/alerts", s.handleAlerts)
+	s.mux.HandleFunc("GET /api/countries", s.handleCountries)
+	s.mux.HandleFunc("GET /api/domains", s.handleDomains)
+	s.mux.HandleFunc("GET /api/dns", s.handleDNS)
+	s.mux.HandleFunc("GET /api/dns/resolvers", s.handleDNSResolvers)
+	s.mux.HandleFunc("GET /api/flows", s.handleFlows)
+	s.mux.HandleFunc("GET /api/stream", s.handleStream)
+	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
+	s.mux.HandleFunc("GET /api/capture", s.handleCaptureStatus)
+	s.mux.HandleFunc("POST /api/capture/start", s.handleCaptureStart)
+	s.mux.HandleFunc("POST /api/capture/stop", s.handleCaptureStop)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("API listening on %s", addr)
+	return srv.ListenAndServe()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// Stream filters are boolean expressions over event fields, for example:
+//
+//	type == alert or (proto == tcp and port == 443)
+//	not host == 10.0.0.1 && len > 1000
+//
+// Supported fields are type, proto, src, dst, host (src or dst), sport,
+// dport, port (sport or dport), len, message, and name and rcode of DNS
+// transactions. Operators are ==, !=, <, <=, >, >= and ~ (substring
+// match).
+
+// eventFilter reports whether an event should be delivered.
+type eventFilter func(sniffer.Event) bool
+
+// parseFilter compiles a filter expression. An empty expression matches
+// every event.
+func parseFilter(expr string) (eventFilter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+var filterOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "~", "!", "(", ")"}
+
+func tokenizeFilter(expr string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		if unicode.IsSpace(c) {
+			i++
+			continue
+		}
+
+		matched := false
+		for _, op := range filterOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, op)
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			end := strings.IndexRune(expr[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i += end + 2
+			continue
+		}
+
+		start := i
+		for i < len(expr) && !unicode.IsSpace(rune(expr[i])) && !strings.ContainsRune("=!<>~()&|\"'", rune(expr[i])) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("unexpected %q in filter", expr[i])
+		}
+		tokens = append(tokens, expr[start:i])
+	}
+
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *filterParser) parseOr() (eventFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for tok := strings.ToLower(p.peek()); tok == "or" || tok == "||"; tok = strings.ToLower(p.peek()) {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(ev sniffer.Event) bool { return l(ev) || right(ev) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (eventFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for tok := strings.ToLower(p.peek()); tok == "and" || tok == "&&"; tok = strings.ToLower(p.peek()) {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(ev sniffer.Event) bool { return l(ev) && right(ev) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (eventFilter, error) {
+	switch tok := strings.ToLower(p.peek()); tok {
+	case "not", "!":
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ev sniffer.Event) bool { return !inner(ev) }, nil
+	case "(":
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return inner, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (eventFilter, error) {
+	field := strings.ToLower(p.next())
+	if _, ok := filterFields[field]; !ok {
+		return nil, fmt.Errorf("unknown filter field %q", field)
+	}
+
+	op := p.next()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "~":
+	default:
+		return nil, fmt.Errorf("expected an operator after %q, got %q", field, op)
+	}
+
+	value := p.next()
+	if value == "" {
+		return nil, fmt.Errorf("missing value after %s %s", field, op)
+	}
+	value = strings.Trim(value, `"'`)
+
+	numeric := filterFields[field].numeric
+	var num int
+	if numeric {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %q needs a number, got %q", field, value)
+		}
+		num = n
+	} else if op != "==" && op != "!=" && op != "~" {
+		return nil, fmt.Errorf("operator %s is not supported for field %q", op, field)
+	}
+
+	// A field with several values (host, port) is equal if any of them
+	// is, and differs only if none of them is.
+	negate := op == "!="
+	if negate {
+		op = "=="
+	}
+
+	match := func(v string) bool {
+		if numeric {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return false
+			}
+			return compareInts(n, op, num)
+		}
+		if op == "~" {
+			return strings.Contains(strings.ToLower(v), strings.ToLower(value))
+		}
+		return strings.EqualFold(v, value)
+	}
+
+	values := filterFields[field].values
+	return func(ev sniffer.Event) bool {
+		for _, v := range values(ev) {
+			if match(v) {
+				return !negate
+			}
+		}
+		return negate
+	}, nil
+}
+
+func compareInts(a int, op string, b int) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+type filterField struct {
+	numeric bool
+	values  func(sniffer.Event) []string
+}
+
+var filterFields = map[string]filterField{
+	"type": {values: func(ev sniffer.Event) []string {
+		return []string{ev.Type}
+	}},
+	"proto": {values: packetField(func(p *sniffer.PacketEntry) []string {
+		return []string{p.Protocol}
+	})},
+	"src": {values: func(ev sniffer.Event) []string {
+		switch {
+		case ev.Alert != nil:
+			return []string{ev.Alert.IP}
+		case ev.DNS != nil:
+			return []string{ev.DNS.Client}
+		}
+		return []string{ev.Packet.Src}
+	}},
+	"dst": {values: func(ev sniffer.Event) []string {
+		switch {
+		case ev.Alert != nil:
+			return nil
+		case ev.DNS != nil:
+			return []string{ev.DNS.Resolver}
+		}
+		return []string{ev.Packet.Dst}
+	}},
+	"host": {values: func(ev sniffer.Event) []string {
+		switch {
+		case ev.Alert != nil:
+			return []string{ev.Alert.IP}
+		case ev.DNS != nil:
+			return []string{ev.DNS.Client, ev.DNS.Resolver}
+		}
+		return []string{ev.Packet.Src, ev.Packet.Dst}
+	}},
+	"sport": {numeric: true, values: packetField(func(p *sniffer.PacketEntry) []string {
+		return []string{strconv.Itoa(p.SrcPort)}
+	})},
+	"dport": {numeric: true, values: packetField(func(p *sniffer.PacketEntry) []string {
+		return []string{strconv.Itoa(p.DstPort)}
+	})},
+	"port": {numeric: true, values: packetField(func(p *sniffer.PacketEntry) []string {
+		return []string{strconv.Itoa(p.SrcPort), strconv.Itoa(p.DstPort)}
+	})},
+	"len": {numeric: true, values: packetField(func(p *sniffer.PacketEntry) []string {
+		return []string{strconv.Itoa(p.Length)}
+	})},
+	"name": {values: func(ev sniffer.Event) []string {
+		if ev.DNS == nil {
+			return nil
+		}
+		return []string{ev.DNS.Name}
+	}},
+	"rcode": {values: func(ev sniffer.Event) []string {
+		if ev.DNS == nil {
+			return nil
+		}
+		return []string{ev.DNS.RCode}
+	}},
+	"message": {values: func(ev sniffer.Event) []string {
+		if ev.Alert == nil {
+			return nil
+		}
+		return []string{ev.Alert.Message}
+	}},
+}
+
+func init() {
+	filterFields["protocol"] = filterFields["proto"]
+	filterFields["length"] = filterFields["len"]
+}
+
+// packetField adapts a packet accessor so that it yields no values for
+// alert and DNS events.
+func packetField(get func(*sniffer.PacketEntry) []string) func(sniffer.Event) []string {
+	return func(ev sniffer.Event) []string {
+		if ev.Packet == nil {
+			return nil
+		}
+		return get(ev.Packet)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.CurrentStats())
+}
+
+func (s *Server) handlePackets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.RecentPackets())
+}
+
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.ActiveAlerts())
+}
+
+func (s *Server) handleCountries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.TopCountries(queryInt(r, "limit", 10)))
+}
+
+func (s *Server) handleDomains(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.ResolvedDomains())
+}
+
+func (s *Server) handleDNS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.DNSTransactions(queryInt(r, "limit", 100)))
+}
+
+func (s *Server) handleDNSResolvers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sniffer.DNSResolvers(queryInt(r, "top", 10)))
+}
+
+func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	flowList := sniffer.ActiveFlows()
+	if limit := queryInt(r, "limit", 0); limit > 0 && len(flowList) > limit {
+		flowList = flowList[:limit]
+	}
+	writeJSON(w, http.StatusOK, flowList)
+}
+
+func (s *Server) handleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.capture.Status())
+}
+
+func (s *Server) handleCaptureStart(w http.ResponseWriter, r *http.Request) {
+	if err := s.capture.Start(); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, sniffer.ErrCaptureRunning) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.capture.Status())
+}
+
+func (s *Server) handleCaptureStop(w http.ResponseWriter, r *http.Request) {
+	if err := s.capture.Stop(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.capture.Status())
+}
+
+// handleStream pushes packets and alerts to the client as Server-Sent
+// Events. The optional "filter" parameter is applied server-side and
+// "buffer" sets how many events may queue up before they are dropped.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	sub := sniffer.Subscribe(queryInt(r, "buffer", 256), filter)
+	defer sniffer.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastDropped uint64
+	idle := 0
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+			idle = 0
+
+		case <-ticker.C:
+			if dropped := sub.Dropped(); dropped != lastDropped {
+				lastDropped = dropped
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+				flusher.Flush()
+				continue
+			}
+
+			// Keep proxies from closing a quiet stream.
+			if idle++; idle >= 15 {
+				idle = 0
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// queryInt reads an integer query parameter, falling back to def when it
+// is missing or invalid.
+func queryInt(r *http.Request, name string, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// handleMetrics serves the sniffer counters in the Prometheus text
+// exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	status := s.capture.Status()
+	iface := labels("interface", status.Source)
+	st := sniffer.CurrentStats()
+
+	m := &metricWriter{w: w}
+
+	m.help("sniffer_capture_running", "gauge", "Whether the capture is running.")
+	m.value("sniffer_capture_running", iface, boolValue(status.Running))
+
+	m.help("sniffer_packets_total", "counter", "Packets processed, by protocol.")
+	for _, p := range []struct {
+		name  string
+		count int
+	}{
+		{"tcp", st.TCP},
+		{"udp", st.UDP},
+		{"icmp", st.ICMP},
+		{"other", st.Other},
+	} {
+		m.value("sniffer_packets_total", labels("interface", status.Source, "protocol", p.name), float64(p.count))
+	}
+
+	m.help("sniffer_bytes_total", "counter", "Bytes processed.")
+	m.value("sniffer_bytes_total", iface, float64(st.Bytes))
+
+	m.help("sniffer_interface_packets_total", "counter", "Packets processed, by capture interface.")
+	for _, i := range st.Interfaces {
+		m.value("sniffer_interface_packets_total", labels("interface", i.Name), float64(i.Packets))
+	}
+	m.help("sniffer_interface_bytes_total", "counter", "Bytes processed, by capture interface.")
+	for _, i := range st.Interfaces {
+		m.value("sniffer_interface_bytes_total", labels("interface", i.Name), float64(i.Bytes))
+	}
+
+	m.help("sniffer_queue_dropped_packets_total", "counter", "Packets dropped because a worker queue was full.")
+	if len(st.Interfaces) == 0 {
+		// Sources without interfaces, such as capture files.
+		m.value("sniffer_queue_dropped_packets_total", iface, float64(st.QueueDropped))
+	}
+	for _, i := range st.Interfaces {
+		m.value("sniffer_queue_dropped_packets_total", labels("interface", i.Name), float64(i.QueueDropped))
+	}
+
+	// The kernel counters are polled from the capture handle of each
+	// interface while a live capture runs.
+	if s.capture.CaptureStats() != nil {
+		m.help("sniffer_kernel_received_packets_total", "counter", "Packets received by the capture handle.")
+		for _, i := range st.Interfaces {
+			m.value("sniffer_kernel_received_packets_total", labels("interface", i.Name), float64(i.KernelReceived))
+		}
+		m.help("sniffer_kernel_dropped_packets_total", "counter", "Packets dropped by the kernel because the buffer was full.")
+		for _, i := range st.Interfaces {
+			m.value("sniffer_kernel_dropped_packets_total", labels("interface", i.Name), float64(i.KernelDropped))
+		}
+		m.help("sniffer_interface_dropped_packets_total", "counter", "Packets dropped by the network interface or driver.")
+		for _, i := range st.Interfaces {
+			m.value("sniffer_interface_dropped_packets_total", labels("interface", i.Name), float64(i.InterfaceDropped))
+		}
+	}
+
+	if saved, ok := sniffer.SavedPackets(); ok {
+		m.help("sniffer_saved_packets_total", "counter", "Packets written to the pcap file.")
+		m.value("sniffer_saved_packets_total", iface, float64(saved))
+	}
+
+	m.help("sniffer_active_flows", "gauge", "Flows currently tracked.")
+	m.value("sniffer_active_flows", iface, float64(len(sniffer.ActiveFlows())))
+
+	m.help("sniffer_alerts_total", "counter", "Security alerts raised, by type.")
+	counts := sniffer.AlertCounts()
+	types := make([]string, 0, len(counts))
+	for alertType := range counts {
+		types = append(types, alertType)
+	}
+	sort.Strings(types)
+	for _, alertType := range types {
+		m.value("sniffer_alerts_total", labels("type", alertType), float64(counts[alertType]))
+	}
+
+	for _, c := range []struct {
+		name  string
+		stats sniffer.CacheStats
+	}{
+		{"dns", sniffer.DNSCacheStats()},
+		{"geoip", sniffer.GeoIPCacheStats()},
+	} {
+		prefix := "sniffer_" + c.name + "_cache_"
+		m.help(prefix+"hits_total", "counter", "Lookups answered from the "+c.name+" cache.")
+		m.value(prefix+"hits_total", "", float64(c.stats.Hits))
+		m.help(prefix+"misses_total", "counter", "Lookups not found in the "+c.name+" cache.")
+		m.value(prefix+"misses_total", "", float64(c.stats.Misses))
+		m.help(prefix+"hit_ratio", "gauge", "Share of "+c.name+" lookups answered from the cache.")
+		m.value(prefix+"hit_ratio", "", c.stats.HitRate())
+	}
+
+	if rs, ok := sniffer.ReverseDNSStats(); ok {
+		m.help("sniffer_reverse_dns_cached_entries", "gauge", "Reverse DNS results cached, including addresses that did not resolve.")
+		m.value("sniffer_reverse_dns_cached_entries", "", float64(rs.Cached))
+		m.help("sniffer_reverse_dns_dropped_total", "counter", "Reverse DNS lookups dropped because the queue was full.")
+		m.value("sniffer_reverse_dns_dropped_total", "", float64(rs.Dropped))
+	}
+}
+
+type metricWriter struct {
+	w io.Writer
+}
+
+func (m *metricWriter) help(name, metricType, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (m *metricWriter) value(name, labels string, v float64) {
+	fmt.Fprintf(m.w, "%s%s %g\n", name, labels, v)
+}
+
+// labels formats name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escapeLabel(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -6,112 +6,205 @@ import (
 	"time"
 )
 
-type ipActivity struct {
-	PacketCount int
-	Ports       map[int]bool
-	LastSeen    time.Time
-}
-
+// AnomalyDetector runs a set of detectors over the packet and flow
+// events of a capture and records the alerts they raise.
 type AnomalyDetector struct {
-	mu       sync.Mutex
-	activity map[string]*ipActivity
+	detectors []Detector
+	// locks serialize the calls to each detector that does not lock its
+	// own state, and are nil for those that do.
+	locks []*sync.Mutex
 }
 
+const (
+	AlertFlood    = "flood"
+	AlertPortScan = "port_scan"
+	AlertSweep    = "host_sweep"
+)
+
+const (
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
 type AnomalyAlert struct {
-	Message     string
-	IP          string
-	CountryInfo CountryInfo
-	Timestamp   time.Time
+	Type        string            `json:"type"`
+	Detector    string            `json:"detector"`
+	Severity    string            `json:"severity"`
+	Message     string            `json:"message"`
+	IP          string            `json:"ip"`
+	CountryInfo CountryInfo       `json:"country"`
+	Details     map[string]string `json:"details,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
 }
 
-var detector = NewAnomalyDetector()
 var activeAlerts = []AnomalyAlert{}
+var alertCounts = map[string]int{}
 var alertsMutex sync.Mutex
 
-func NewAnomalyDetector() *AnomalyDetector {
-	d := &AnomalyDetector{
-		activity: make(map[string]*ipActivity),
+func NewAnomalyDetector(detectors ...Detector) *AnomalyDetector {
+	locks := make([]*sync.Mutex, len(detectors))
+	for i, det := range detectors {
+		if _, ok := det.(concurrentDetector); !ok {
+			locks[i] = new(sync.Mutex)
+		}
 	}
-	go d.cleanupLoop()
-	return d
+	return &AnomalyDetector{detectors: detectors, locks: locks}
 }
 
-func (d *AnomalyDetector) Track(srcIP string, dstPort int) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// newAnomalyDetector builds the detectors selected in cfg.
+func newAnomalyDetector(cfg Config) (*AnomalyDetector, error) {
+	detectors, err := NewDetectors(cfg.Detectors, cfg.DetectorOptions)
+	if err != nil {
+		return nil, err
+	}
+	return NewAnomalyDetector(detectors...), nil
+}
 
-	act, exists := d.activity[srcIP]
-	if !exists {
-		act = &ipActivity{
-			Ports: make(map[int]bool),
-		}
-		d.activity[srcIP] = act
+// Names returns the names of the enabled detectors.
+func (d *AnomalyDetector) Names() []string {
+	names := make([]string, len(d.detectors))
+	for i, det := range d.detectors {
+		names[i] = det.Name()
 	}
+	return names
+}
 
-	act.PacketCount++
-	act.Ports[dstPort] = true
-	act.LastSeen = time.Now()
+// HandlePacket passes a decoded packet to every detector and returns
+// the alerts it triggered. The pipeline starts their triggered captures
+// once the packet is saved, so that they hold it.
+func (d *AnomalyDetector) HandlePacket(info *PacketInfo) []AnomalyAlert {
+	var alerts []AnomalyAlert
+	for i := range d.detectors {
+		alerts = append(alerts, d.call(i, func(det Detector) []AnomalyAlert {
+			return det.HandlePacket(info)
+		})...)
+	}
 
-	country := LookupCountry(srcIP)
+	for i := range alerts {
+		alerts[i] = recordAlert(alerts[i])
+	}
+	return alerts
+}
 
-	if act.PacketCount > 100 && act.PacketCount%100 == 0 {
-		domain := LookupDomain(srcIP)
-		message := fmt.Sprintf("Flood detected from %s (packets: %d)", domain, act.PacketCount)
-		fmt.Printf("🚨 %s\n", message)
-		AddAlert(message, srcIP, country)
+// HandleFlows passes finished flows to every detector and returns the
+// alerts they triggered.
+func (d *AnomalyDetector) HandleFlows(flowList []Flow) []AnomalyAlert {
+	var alerts []AnomalyAlert
+	for j := range flowList {
+		for i := range d.detectors {
+			alerts = append(alerts, d.call(i, func(det Detector) []AnomalyAlert {
+				return det.HandleFlow(&flowList[j])
+			})...)
+		}
 	}
 
-	if len(act.Ports) > 50 && len(act.Ports)%10 == 0 {
-		domain := LookupDomain(srcIP)
-		message := fmt.Sprintf("Port scan detected from %s (ports: %d)", domain, len(act.Ports))
-		fmt.Printf("🕵️ %s\n", message)
-		AddAlert(message, srcIP, country)
+	recorder := current.Load().recorder
+	for i := range alerts {
+		alerts[i] = recordAlert(alerts[i])
+		recorder.Trigger(alerts[i])
 	}
+	return alerts
 }
 
-func (d *AnomalyDetector) cleanupLoop() {
-	ticker := time.NewTicker(10 * time.Second)
-	for range ticker.C {
-		d.mu.Lock()
+// call runs fn on detector i, holding its lock unless it locks its own
+// state, and tags the alerts it returns.
+func (d *AnomalyDetector) call(i int, fn func(det Detector) []AnomalyAlert) []AnomalyAlert {
+	det := d.detectors[i]
+	if mu := d.locks[i]; mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	return tagAlerts(det, fn(det))
+}
 
-		now := time.Now()
-		for ip, act := range d.activity {
-			if now.Sub(act.LastSeen) > 30*time.Second {
-				delete(d.activity, ip)
-			}
+func tagAlerts(det Detector, alerts []AnomalyAlert) []AnomalyAlert {
+	for i := range alerts {
+		if alerts[i].Detector == "" {
+			alerts[i].Detector = det.Name()
 		}
-		d.mu.Unlock()
 	}
+	return alerts
 }
 
 func GetActiveAlerts() []string {
+	result := []string{}
+	for _, alert := range ActiveAlerts() {
+		result = append(result, alert.Message)
+	}
+	return result
+}
+
+// ActiveAlerts returns the alerts raised in the last 30 seconds.
+func ActiveAlerts() []AnomalyAlert {
 	alertsMutex.Lock()
 	defer alertsMutex.Unlock()
 
-	result := []string{}
 	now := time.Now()
 	newAlerts := []AnomalyAlert{}
 
 	for _, alert := range activeAlerts {
 		if now.Sub(alert.Timestamp) < 30*time.Second {
-			result = append(result, alert.Message)
 			newAlerts = append(newAlerts, alert)
 		}
 	}
 
 	activeAlerts = newAlerts
 
+	result := make([]AnomalyAlert, len(newAlerts))
+	copy(result, newAlerts)
 	return result
 }
 
-func AddAlert(message string, ip string, country CountryInfo) {
-	alertsMutex.Lock()
-	defer alertsMutex.Unlock()
-
-	activeAlerts = append(activeAlerts, AnomalyAlert{
+func AddAlert(alertType, message, ip string, country CountryInfo) {
+	alert := recordAlert(AnomalyAlert{
+		Type:        alertType,
 		Message:     message,
 		IP:          ip,
 		CountryInfo: country,
-		Timestamp:   time.Now(),
 	})
+	current.Load().recorder.Trigger(alert)
+}
+
+// recordAlert fills in the missing alert fields, keeps the alert for
+// ActiveAlerts and publishes it to subscribers.
+func recordAlert(alert AnomalyAlert) AnomalyAlert {
+	if alert.Severity == "" {
+		alert.Severity = SeverityMedium
+	}
+	if alert.CountryInfo == (CountryInfo{}) && alert.IP != "" {
+		alert.CountryInfo = LookupCountry(alert.IP)
+	}
+	if alert.Timestamp.IsZero() {
+		alert.Timestamp = time.Now()
+	}
+
+	alertsMutex.Lock()
+	activeAlerts = append(activeAlerts, alert)
+	alertCounts[alert.Type]++
+	alertsMutex.Unlock()
+
+	publishAlert(alert)
+	return alert
+}
+
+// alertComments describes alerts as packet comments for pcapng files.
+func alertComments(alerts []AnomalyAlert) []string {
+	comments := make([]string, len(alerts))
+	for i, alert := range alerts {
+		comments[i] = fmt.Sprintf("%s alert (%s, %s): %s", alert.Type, alert.Detector, alert.Severity, alert.Message)
+	}
+	return comments
+}
+
+// AlertCounts returns the number of alerts raised so far, by alert type.
+func AlertCounts() map[string]int {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	result := make(map[string]int, len(alertCounts))
+	for alertType, count := range alertCounts {
+		result[alertType] = count
+	}
+	return result
 }
@@ -0,0 +1,157 @@
+package sniffer
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+var (
+	ErrCaptureRunning    = errors.New("capture is already running")
+	ErrCaptureNotRunning = errors.New("capture is not running")
+)
+
+// Capture runs a sniffing session in the background so that it can be
+// started and stopped on demand, for example from the HTTP API.
+type Capture struct {
+	mu        sync.Mutex
+	cfg       Config
+	src       PacketSource
+	stop      chan struct{}
+	finished  chan struct{}
+	startedAt time.Time
+}
+
+// CaptureStatus describes the state of a Capture.
+type CaptureStatus struct {
+	Running   bool      `json:"running"`
+	Source    string    `json:"source"`
+	Filter    string    `json:"filter,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+func NewCapture(cfg Config) *Capture {
+	return &Capture{cfg: cfg}
+}
+
+// Start opens the packet source and processes it in the background.
+func (c *Capture) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running() {
+		return ErrCaptureRunning
+	}
+
+	out, err := newConsole(c.cfg)
+	if err != nil {
+		return err
+	}
+
+	src, err := OpenSource(c.cfg)
+	if err != nil {
+		return err
+	}
+
+	c.src = src
+	c.stop = make(chan struct{})
+	c.finished = make(chan struct{})
+	c.startedAt = time.Now()
+
+	go func(src PacketSource, stop, finished chan struct{}) {
+		defer close(finished)
+
+		if err := run(src, c.cfg, out, stop); err != nil {
+			log.Printf("capture stopped: %v", err)
+		}
+
+		src.Close()
+
+		// Let the reader goroutine of the source drain and exit.
+		go func() {
+			for range src.Packets() {
+			}
+		}()
+	}(src, c.stop, c.finished)
+
+	return nil
+}
+
+// Stop ends the session and waits for it to finish.
+func (c *Capture) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running() {
+		return ErrCaptureNotRunning
+	}
+
+	close(c.stop)
+	<-c.finished
+
+	return nil
+}
+
+func (c *Capture) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := CaptureStatus{
+		Running: c.running(),
+		Source:  strings.Join(c.cfg.Interfaces, ","),
+		Filter:  c.cfg.Filter,
+	}
+	if c.src != nil {
+		if names := interfaceNames(c.src); len(names) > 0 {
+			status.Source = strings.Join(names, ",")
+		}
+	}
+	if c.cfg.ReadFile != "" {
+		status.Source = c.cfg.ReadFile
+	}
+	if status.Running {
+		status.StartedAt = c.startedAt
+	}
+	return status
+}
+
+// CaptureStats returns the kernel counters of the running session, or nil
+// when the source does not provide them.
+func (c *Capture) CaptureStats() *pcap.Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running() {
+		return nil
+	}
+
+	statsSource, ok := c.src.(CaptureStatsSource)
+	if !ok {
+		return nil
+	}
+
+	captureStats, err := statsSource.CaptureStats()
+	if err != nil {
+		return nil
+	}
+	return captureStats
+}
+
+// running reports whether a session is in progress. A session started
+// on a file ends on its own once the file is exhausted.
+func (c *Capture) running() bool {
+	if c.finished == nil {
+		return false
+	}
+
+	select {
+	case <-c.finished:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,217 @@
+package sniffer
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketInfo holds the fields of a decoded packet used by the pipeline
+// and handed to detectors.
+type PacketInfo struct {
+	Timestamp time.Time
+	Protocol  string
+	Src       string
+	Dst       string
+	SrcPort   int
+	DstPort   int
+	Length    int
+	TCPFlags  TCPFlags
+	// Interface is the interface the packet was captured on, when known.
+	Interface string
+
+	// DNS is the DNS message carried by the packet, if any. It belongs
+	// to the decoder and is only valid while the packet is processed.
+	DNS *layers.DNS
+}
+
+// sourceDecodeOptions makes packet sources skip gopacket's own decoding;
+// PacketDecoder decodes the raw bytes instead.
+var sourceDecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+
+// PacketDecoder extracts PacketInfo from raw packet data using
+// preallocated layers, so that decoding does not allocate per layer.
+// Packets it cannot fully decode fall back to gopacket's generic
+// decoding. A PacketDecoder is not safe for concurrent use.
+type PacketDecoder struct {
+	// iface and ifaceIndex identify the interface whose packets the
+	// decoder handles, if any.
+	iface      string
+	ifaceIndex int
+
+	parser   *gopacket.DecodingLayerParser
+	parserV6 *gopacket.DecodingLayerParser
+	decoded  []gopacket.LayerType
+
+	eth      layers.Ethernet
+	sll      layers.LinuxSLL
+	loopback layers.Loopback
+	dot1q    layers.Dot1Q
+	ip4      layers.IPv4
+	ip6      layers.IPv6
+	tcp      layers.TCP
+	udp      layers.UDP
+	icmp4    layers.ICMPv4
+	icmp6    layers.ICMPv6
+	arp      layers.ARP
+	dns      layers.DNS
+	payload  gopacket.Payload
+}
+
+// NewPacketDecoder returns a decoder for packets of the given link type.
+// Link types without a fast path are decoded generically.
+func NewPacketDecoder(linkType layers.LinkType) *PacketDecoder {
+	d := &PacketDecoder{decoded: make([]gopacket.LayerType, 0, 8)}
+
+	newParser := func(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+		return gopacket.NewDecodingLayerParser(first,
+			&d.eth, &d.sll, &d.loopback, &d.dot1q, &d.ip4, &d.ip6,
+			&d.tcp, &d.udp, &d.icmp4, &d.icmp6, &d.arp, &d.dns, &d.payload)
+	}
+
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		d.parser = newParser(layers.LayerTypeEthernet)
+	case layers.LinkTypeLinuxSLL:
+		d.parser = newParser(layers.LayerTypeLinuxSLL)
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		d.parser = newParser(layers.LayerTypeLoopback)
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		// Raw IP has no link header; the IP version picks the parser.
+		d.parser = newParser(layers.LayerTypeIPv4)
+		d.parserV6 = newParser(layers.LayerTypeIPv6)
+	}
+
+	return d
+}
+
+// Decode extracts the PacketInfo of packet.
+func (d *PacketDecoder) Decode(packet gopacket.Packet) PacketInfo {
+	info := d.decode(packet)
+	info.Interface = d.iface
+	return info
+}
+
+func (d *PacketDecoder) decode(packet gopacket.Packet) PacketInfo {
+	info := PacketInfo{
+		Timestamp: packet.Metadata().Timestamp,
+		Length:    packet.Metadata().Length,
+	}
+
+	data := packet.Data()
+	parser := d.parser
+	if d.parserV6 != nil && len(data) > 0 && data[0]>>4 == 6 {
+		parser = d.parserV6
+	}
+	if parser == nil {
+		return extractPacketInfo(packet)
+	}
+
+	err := parser.DecodeLayers(data, &d.decoded)
+	var unsupported gopacket.UnsupportedLayerType
+	if err != nil && !errors.As(err, &unsupported) {
+		return extractPacketInfo(packet)
+	}
+
+	complete := false
+	for _, layerType := range d.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			info.Src, info.Dst = ipString(d.ip4.SrcIP), ipString(d.ip4.DstIP)
+		case layers.LayerTypeIPv6:
+			info.Src, info.Dst = ipString(d.ip6.SrcIP), ipString(d.ip6.DstIP)
+		case layers.LayerTypeTCP:
+			info.Protocol = "TCP"
+			info.SrcPort, info.DstPort = int(d.tcp.SrcPort), int(d.tcp.DstPort)
+			info.TCPFlags = tcpFlagsOf(&d.tcp)
+			complete = true
+		case layers.LayerTypeUDP:
+			info.Protocol = "UDP"
+			info.SrcPort, info.DstPort = int(d.udp.SrcPort), int(d.udp.DstPort)
+			complete = true
+		case layers.LayerTypeICMPv4:
+			info.Protocol = "ICMPv4"
+			complete = true
+		case layers.LayerTypeICMPv6:
+			info.Protocol = "ICMPv6"
+			complete = true
+		case layers.LayerTypeARP:
+			// ARP is not IP traffic, so it gets no addresses or flow.
+			info.Protocol = "ARP"
+			complete = true
+		case layers.LayerTypeDNS:
+			info.DNS = &d.dns
+		}
+	}
+
+	// Stopped at a layer without a fast path before reaching the
+	// transport, such as IPv6 extension headers, tunnels or fragments.
+	if !complete && err != nil {
+		return extractPacketInfo(packet)
+	}
+
+	if info.Src == "" {
+		info.Src, info.Dst = "unknown", "unknown"
+	}
+	if info.Protocol == "" {
+		info.Protocol = "Other"
+	}
+	return info
+}
+
+func ipString(ip net.IP) string {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return "unknown"
+	}
+	return ip.String()
+}
+
+// extractPacketInfo decodes packet through gopacket's generic layers. It
+// is the slow path for packets the PacketDecoder cannot handle.
+func extractPacketInfo(packet gopacket.Packet) PacketInfo {
+	networkLayer := packet.NetworkLayer()
+	transportLayer := packet.TransportLayer()
+
+	info := PacketInfo{
+		Timestamp: packet.Metadata().Timestamp,
+		Length:    packet.Metadata().Length,
+	}
+
+	if networkLayer == nil {
+		info.Protocol = "Other"
+		info.Src = "unknown"
+		info.Dst = "unknown"
+	} else {
+		info.Src = networkLayer.NetworkFlow().Src().String()
+		info.Dst = networkLayer.NetworkFlow().Dst().String()
+
+		if transportLayer == nil {
+			info.Protocol = "Other"
+			if packet.Layer(layers.LayerTypeICMPv4) != nil {
+				info.Protocol = "ICMPv4"
+			} else if packet.Layer(layers.LayerTypeICMPv6) != nil {
+				info.Protocol = "ICMPv6"
+			}
+		} else {
+			info.Protocol = transportLayer.LayerType().String()
+
+			if tcpLayer, ok := transportLayer.(*layers.TCP); ok {
+				info.SrcPort = int(tcpLayer.SrcPort)
+				info.DstPort = int(tcpLayer.DstPort)
+				info.TCPFlags = tcpFlagsOf(tcpLayer)
+			} else if udpLayer, ok := transportLayer.(*layers.UDP); ok {
+				info.SrcPort = int(udpLayer.SrcPort)
+				info.DstPort = int(udpLayer.DstPort)
+			}
+		}
+	}
+
+	if dns, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+		info.DNS = dns
+	}
+
+	return info
+}
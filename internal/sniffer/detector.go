@@ -0,0 +1,175 @@
+package sniffer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Detector inspects decoded packets and finished flows and reports
+// anything suspicious as alerts. Detectors are called from a single
+// goroutine at a time and do not need their own locking.
+type Detector interface {
+	// Name is the registry name of the detector, used in alerts.
+	Name() string
+	// HandlePacket is called for every decoded packet.
+	HandlePacket(p *PacketInfo) []AnomalyAlert
+	// HandleFlow is called for every flow that expires or is still
+	// open when the capture ends.
+	HandleFlow(f *Flow) []AnomalyAlert
+}
+
+// concurrentDetector is implemented by the built-in detectors, which
+// lock their state per host and so are called from every pipeline worker
+// at once.
+type concurrentDetector interface {
+	Detector
+	concurrent()
+}
+
+// DetectorOptions holds the key=value settings of one detector.
+type DetectorOptions map[string]string
+
+// DetectorFactory creates a detector from its options. It should reject
+// options it does not know.
+type DetectorFactory func(opts DetectorOptions) (Detector, error)
+
+var detectorFactories = map[string]DetectorFactory{
+	"dns":      newDNSTunnelDetector,
+	"flood":    newFloodDetector,
+	"portscan": newPortScanDetector,
+	"sweep":    newSweepDetector,
+}
+
+// RegisterDetector makes a detector available under name. Registering
+// the same name twice replaces the earlier factory.
+func RegisterDetector(name string, factory DetectorFactory) {
+	detectorFactories[name] = factory
+}
+
+// DetectorNames returns the names of all registered detectors, sorted.
+func DetectorNames() []string {
+	names := make([]string, 0, len(detectorFactories))
+	for name := range detectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDetectors builds the named detectors with their options. A nil list
+// enables every registered detector and "none" disables them all.
+func NewDetectors(names []string, opts map[string]DetectorOptions) ([]Detector, error) {
+	if names == nil {
+		names = DetectorNames()
+	}
+
+	enabled := make(map[string]bool)
+	var detectors []Detector
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" || enabled[name] {
+			continue
+		}
+
+		factory, ok := detectorFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q (available: %s)", name, strings.Join(DetectorNames(), ", "))
+		}
+
+		d, err := factory(opts[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure detector %s: %w", name, err)
+		}
+		detectors = append(detectors, d)
+		enabled[name] = true
+	}
+
+	for name := range opts {
+		if _, ok := detectorFactories[name]; !ok {
+			return nil, fmt.Errorf("options given for unknown detector %q", name)
+		}
+	}
+
+	return detectors, nil
+}
+
+// ParseDetectorOptions parses settings of the form detector.key=value,
+// as given on the command line.
+func ParseDetectorOptions(specs []string) (map[string]DetectorOptions, error) {
+	result := make(map[string]DetectorOptions)
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		name, option, dotted := strings.Cut(key, ".")
+		if !ok || !dotted || name == "" || option == "" {
+			return nil, fmt.Errorf("invalid detector option %q, want detector.key=value", spec)
+		}
+
+		if result[name] == nil {
+			result[name] = make(DetectorOptions)
+		}
+		result[name][option] = value
+	}
+	return result, nil
+}
+
+// Int returns the integer option key, or def when it is not set.
+func (o DetectorOptions) Int(key string, def int) (int, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("option %s needs a positive number, got %q", key, value)
+	}
+	return n, nil
+}
+
+// Float returns the numeric option key, or def when it is not set.
+func (o DetectorOptions) Float(key string, def float64) (float64, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("option %s needs a positive number, got %q", key, value)
+	}
+	return f, nil
+}
+
+// Duration returns the duration option key, or def when it is not set.
+func (o DetectorOptions) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("option %s needs a positive duration, got %q", key, value)
+	}
+	return d, nil
+}
+
+// checkKeys reports an error for any option not in known.
+func (o DetectorOptions) checkKeys(known ...string) error {
+	for key := range o {
+		found := false
+		for _, k := range known {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown option %q (available: %s)", key, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
@@ -1,64 +1,170 @@
 package sniffer
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
-	"sync"
-	"time"
+	"sync/atomic"
 )
 
 var (
-	dnsCache      = make(map[string]string)
-	dnsCacheMutex sync.Mutex
+	dnsCacheStats cacheCounters
+
+	// reverseDNS runs PTR lookups in the background for addresses that no
+	// DNS response on the wire has named. It is nil while reverse lookups
+	// are disabled.
+	reverseDNS atomic.Pointer[Enricher]
 )
 
+// DefaultDNSPort is the port of a DNS server given without one.
+const DefaultDNSPort = "53"
+
+// LookupDomain returns the name of an address, with its country when
+// known. Names clients looked up, learned from the DNS responses in the
+// capture, come first. Otherwise, if reverse lookups are enabled, the
+// PTR record is used; the address is "unknown" when neither gives a
+// name. LookupDomain never waits for DNS: a PTR record that is not
+// cached yet is looked up in the background for a later call. The
+// address may carry a port, as in 192.0.2.1:443 or [2001:db8::1]:443.
 func LookupDomain(ipStr string) string {
-	ipParts := strings.Split(ipStr, ":")
-	ipStr = ipParts[0]
+	if host, _, err := net.SplitHostPort(ipStr); err == nil {
+		ipStr = host
+	}
 
 	ip := net.ParseIP(ipStr)
 	if ip != nil && IsPrivateIP(ip) {
 		return "local"
 	}
 
-	dnsCacheMutex.Lock()
-	if domain, found := dnsCache[ipStr]; found {
-		dnsCacheMutex.Unlock()
-		country := LookupCountry(ipStr)
-		if country.ISO != "XX" && country.ISO != "LO" {
-			return fmt.Sprintf("%s (%s %s)", domain, country.Flag, country.Name)
+	if domain, found := passiveDNS.lookup(ipStr); found {
+		dnsCacheStats.hit()
+		return withCountry(domain, ipStr)
+	}
+
+	if e := reverseDNS.Load(); e != nil {
+		if domain, found := e.Lookup(ipStr); found {
+			dnsCacheStats.hit()
+			if domain == "" {
+				domain = "unknown"
+			}
+			return withCountry(domain, ipStr)
 		}
-		return domain
 	}
-	dnsCacheMutex.Unlock()
+	dnsCacheStats.miss()
+
+	return withCountry("unknown", ipStr)
+}
+
+// configureReverseDNS starts the reverse lookups of a session, or stops
+// them when cfg does not enable them. Each session starts with an empty
+// cache, as the resolver may have changed.
+func configureReverseDNS(cfg Config) {
+	var e *Enricher
+	if cfg.ReverseDNS {
+		e = NewEnricher(EnricherOptions{
+			Timeout:   cfg.DNSTimeout,
+			RateLimit: cfg.DNSRateLimit,
+			Resolve:   NewReverseResolver(cfg.DNSServer, cfg.DNSTCP),
+		})
+	}
+	if old := reverseDNS.Swap(e); old != nil {
+		old.Close()
+	}
+}
 
-	domain := "unknown"
-	resultChan := make(chan string, 1)
+// NewReverseResolver returns a ResolveFunc that looks up the first PTR
+// record of an address. Queries go to server, a host with an optional
+// port, over TCP when useTCP is set; an empty server uses the system
+// resolver.
+func NewReverseResolver(server string, useTCP bool) ResolveFunc {
+	resolver := net.DefaultResolver
+	if server != "" || useTCP {
+		if server != "" {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				host := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+				server = net.JoinHostPort(host, DefaultDNSPort)
+			}
+		}
 
-	go func() {
-		names, err := net.LookupAddr(ipStr)
-		if err == nil && len(names) > 0 {
-			domain = strings.TrimSuffix(names[0], ".")
+		var dialer net.Dialer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if server != "" {
+					address = server
+				}
+				if useTCP {
+					network = "tcp"
+				}
+				return dialer.DialContext(ctx, network, address)
+			},
 		}
-		resultChan <- domain
-	}()
-
-	select {
-	case domain = <-resultChan:
-		dnsCacheMutex.Lock()
-		dnsCache[ipStr] = domain
-		dnsCacheMutex.Unlock()
-		country := LookupCountry(ipStr)
-		if country.ISO != "XX" && country.ISO != "LO" {
-			return fmt.Sprintf("%s (%s %s)", domain, country.Flag, country.Name)
+	}
+
+	return func(ctx context.Context, ip string) (string, error) {
+		names, err := resolver.LookupAddr(ctx, ip)
+		if err != nil || len(names) == 0 {
+			return "", err
 		}
-	case <-time.After(500 * time.Millisecond):
+		return strings.TrimSuffix(names[0], "."), nil
 	}
+}
 
+// withCountry appends the country of ip to domain, when it is known.
+func withCountry(domain, ip string) string {
+	country := LookupCountry(ip)
+	if country.ISO != "XX" && country.ISO != "LO" {
+		return fmt.Sprintf("%s (%s %s)", domain, country.Flag, country.Name)
+	}
 	return domain
 }
 
+// cachedDomain returns the domain already known for ip without doing a
+// lookup.
+func cachedDomain(ip string) (string, bool) {
+	if domain, ok := passiveDNS.lookup(ip); ok {
+		return domain, true
+	}
+	e := reverseDNS.Load()
+	if e == nil {
+		return "", false
+	}
+
+	domain, _ := e.Lookup(ip)
+	return domain, domain != ""
+}
+
+// DNSCacheStats returns the hit and miss counts of the domain lookups.
+func DNSCacheStats() CacheStats {
+	return dnsCacheStats.snapshot()
+}
+
+// ReverseDNSStats returns the counters of the background PTR lookups,
+// and false when reverse lookups are disabled.
+func ReverseDNSStats() (EnricherStats, bool) {
+	e := reverseDNS.Load()
+	if e == nil {
+		return EnricherStats{}, false
+	}
+	return e.Stats(), true
+}
+
+// ResolvedDomains returns the IP to domain mappings known so far, leaving
+// out addresses that did not resolve. Names learned from DNS responses
+// take precedence over reverse lookups.
+func ResolvedDomains() map[string]string {
+	result := make(map[string]string)
+	if e := reverseDNS.Load(); e != nil {
+		result = e.Names()
+	}
+
+	for ip, domain := range passiveDNS.snapshot() {
+		result[ip] = domain
+	}
+	return result
+}
+
 func IsPrivateIP(ip net.IP) bool {
 	if ip4 := ip.To4(); ip4 != nil {
 		switch {
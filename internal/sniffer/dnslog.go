@@ -0,0 +1,441 @@
+package sniffer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DNSQueryTimeout is how long a query waits for its response before
+	// it is logged as unanswered.
+	DNSQueryTimeout = 5 * time.Second
+	// dnsLogSize is the number of transactions kept for the log.
+	dnsLogSize = 1000
+	// dnsLatencySamples is the number of recent latencies kept per
+	// resolver for the percentiles.
+	dnsLatencySamples = 1024
+	// maxResolverNames bounds the names counted per resolver.
+	maxResolverNames = 10000
+	// topResolverNames is the number of names shown per resolver.
+	topResolverNames = 5
+)
+
+// DNSTransaction is a DNS query matched with its response by transaction
+// ID and 5-tuple. Queries that got no response within DNSQueryTimeout are
+// logged with Answered unset.
+type DNSTransaction struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Client       string    `json:"client"`
+	ClientPort   int       `json:"client_port"`
+	Resolver     string    `json:"resolver"`
+	ResolverPort int       `json:"resolver_port"`
+	Protocol     string    `json:"protocol"`
+	Interface    string    `json:"interface,omitempty"`
+	ID           uint16    `json:"id"`
+	Name         string    `json:"name"`
+	QueryType    string    `json:"query_type"`
+	Answered     bool      `json:"answered"`
+	RCode        string    `json:"rcode,omitempty"`
+	Answers      []string  `json:"answers,omitempty"`
+	// Latency is the time from the query to the response, in
+	// nanoseconds in JSON.
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// ResolverStats summarizes the transactions with one resolver.
+type ResolverStats struct {
+	Resolver   string `json:"resolver"`
+	Queries    int    `json:"queries"`
+	Answered   int    `json:"answered"`
+	Unanswered int    `json:"unanswered"`
+	NXDomain   int    `json:"nxdomain"`
+	// NXDomainRate is the share of answered queries, in percent, for
+	// names that do not exist.
+	NXDomainRate float64       `json:"nxdomain_rate"`
+	LatencyP50   time.Duration `json:"latency_p50"`
+	LatencyP99   time.Duration `json:"latency_p99"`
+	TopNames     []NameCount   `json:"top_names"`
+}
+
+// NameCount is the number of queries for a name.
+type NameCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type dnsKey struct {
+	client, resolver         string
+	clientPort, resolverPort int
+	protocol                 string
+	id                       uint16
+}
+
+type resolverCounters struct {
+	queries, answered, unanswered, nxdomain int
+	names                                   map[string]int
+	latencies                               []time.Duration
+	next                                    int
+}
+
+// DNSLog matches DNS queries with their responses and keeps the recent
+// transactions and the stats of each resolver.
+type DNSLog struct {
+	mu        sync.Mutex
+	pending   map[dnsKey]*DNSTransaction
+	recent    []DNSTransaction
+	next      int
+	resolvers map[string]*resolverCounters
+}
+
+func NewDNSLog() *DNSLog {
+	return &DNSLog{
+		pending:   make(map[dnsKey]*DNSTransaction),
+		resolvers: make(map[string]*resolverCounters),
+	}
+}
+
+// Observe records the DNS message of a packet, if it carries one. It
+// returns the transaction when the packet is the response that completes
+// it.
+func (l *DNSLog) Observe(info *PacketInfo) (DNSTransaction, bool) {
+	dns := info.DNS
+	if dns == nil {
+		return DNSTransaction{}, false
+	}
+
+	if !dns.QR {
+		if len(dns.Questions) == 0 {
+			return DNSTransaction{}, false
+		}
+		question := dns.Questions[0]
+		tx := &DNSTransaction{
+			Timestamp:    info.Timestamp,
+			Client:       info.Src,
+			ClientPort:   info.SrcPort,
+			Resolver:     info.Dst,
+			ResolverPort: info.DstPort,
+			Protocol:     info.Protocol,
+			Interface:    info.Interface,
+			ID:           dns.ID,
+			Name:         dnsName(question.Name),
+			QueryType:    question.Type.String(),
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// A retransmitted query keeps the time of the first one.
+		key := tx.key()
+		if _, exists := l.pending[key]; exists {
+			return DNSTransaction{}, false
+		}
+		l.pending[key] = tx
+
+		r := l.resolver(tx.Resolver)
+		r.queries++
+		if len(r.names) < maxResolverNames || r.names[tx.Name] > 0 {
+			r.names[tx.Name]++
+		}
+		return DNSTransaction{}, false
+	}
+
+	key := dnsKey{
+		client:       info.Dst,
+		clientPort:   info.DstPort,
+		resolver:     info.Src,
+		resolverPort: info.SrcPort,
+		protocol:     info.Protocol,
+		id:           dns.ID,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Responses to queries sent before the capture started cannot be
+	// matched.
+	tx, ok := l.pending[key]
+	if !ok {
+		return DNSTransaction{}, false
+	}
+	delete(l.pending, key)
+
+	tx.Answered = true
+	tx.RCode = dnsRCode(dns.ResponseCode)
+	tx.Latency = max(info.Timestamp.Sub(tx.Timestamp), 0)
+	for _, answer := range dns.Answers {
+		tx.Answers = append(tx.Answers, dnsAnswer(answer))
+	}
+
+	r := l.resolver(tx.Resolver)
+	r.answered++
+	if dns.ResponseCode == layers.DNSResponseCodeNXDomain {
+		r.nxdomain++
+	}
+	if len(r.latencies) < dnsLatencySamples {
+		r.latencies = append(r.latencies, tx.Latency)
+	} else {
+		r.latencies[r.next] = tx.Latency
+		r.next = (r.next + 1) % dnsLatencySamples
+	}
+
+	l.add(*tx)
+	return *tx, true
+}
+
+// Expire returns the queries that have waited longer than
+// DNSQueryTimeout at now, logging them as unanswered.
+func (l *DNSLog) Expire(now time.Time) []DNSTransaction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expired []DNSTransaction
+	for key, tx := range l.pending {
+		if now.Sub(tx.Timestamp) > DNSQueryTimeout {
+			delete(l.pending, key)
+			expired = append(expired, l.unanswered(tx))
+		}
+	}
+	sortTransactions(expired)
+	return expired
+}
+
+// Flush logs every query still waiting as unanswered, at the end of a
+// capture.
+func (l *DNSLog) Flush() []DNSTransaction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var flushed []DNSTransaction
+	for _, tx := range l.pending {
+		flushed = append(flushed, l.unanswered(tx))
+	}
+	l.pending = make(map[dnsKey]*DNSTransaction)
+	sortTransactions(flushed)
+	return flushed
+}
+
+// unanswered logs tx as a query without a response. l.mu must be held.
+func (l *DNSLog) unanswered(tx *DNSTransaction) DNSTransaction {
+	l.resolver(tx.Resolver).unanswered++
+	l.add(*tx)
+	return *tx
+}
+
+// add keeps tx in the log of recent transactions. l.mu must be held.
+func (l *DNSLog) add(tx DNSTransaction) {
+	if len(l.recent) < dnsLogSize {
+		l.recent = append(l.recent, tx)
+		return
+	}
+	l.recent[l.next] = tx
+	l.next = (l.next + 1) % dnsLogSize
+}
+
+// resolver returns the counters of a resolver. l.mu must be held.
+func (l *DNSLog) resolver(addr string) *resolverCounters {
+	r, ok := l.resolvers[addr]
+	if !ok {
+		r = &resolverCounters{names: make(map[string]int)}
+		l.resolvers[addr] = r
+	}
+	return r
+}
+
+// Transactions returns the most recent transactions, oldest first, up to
+// limit of them, or all that are kept when limit is zero.
+func (l *DNSLog) Transactions(limit int) []DNSTransaction {
+	l.mu.Lock()
+	result := append(append([]DNSTransaction{}, l.recent[l.next:]...), l.recent[:l.next]...)
+	l.mu.Unlock()
+
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// Resolvers returns the stats of each resolver, busiest first, with up
+// to topNames of the names queried most.
+func (l *DNSLog) Resolvers(topNames int) []ResolverStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]ResolverStats, 0, len(l.resolvers))
+	for addr, r := range l.resolvers {
+		s := ResolverStats{
+			Resolver:   addr,
+			Queries:    r.queries,
+			Answered:   r.answered,
+			Unanswered: r.unanswered,
+			NXDomain:   r.nxdomain,
+			TopNames:   topNameCounts(r.names, topNames),
+		}
+		if r.answered > 0 {
+			s.NXDomainRate = float64(r.nxdomain) / float64(r.answered) * 100
+		}
+		latencies := append([]time.Duration{}, r.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		s.LatencyP50 = percentile(latencies, 50)
+		s.LatencyP99 = percentile(latencies, 99)
+		result = append(result, s)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Queries != result[j].Queries {
+			return result[i].Queries > result[j].Queries
+		}
+		return result[i].Resolver < result[j].Resolver
+	})
+	return result
+}
+
+// expireLoop expires queries once a second until done is closed, handing
+// them to onExpire. clock gives the current time, which is the time of
+// the latest packet when reading a capture file.
+func (l *DNSLog) expireLoop(done <-chan struct{}, clock func() time.Time, onExpire func([]DNSTransaction)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if expired := l.Expire(clock()); len(expired) > 0 {
+			onExpire(expired)
+		}
+	}
+}
+
+// DNSTransactions returns the latest DNS transactions of the capture,
+// oldest first.
+func DNSTransactions(limit int) []DNSTransaction {
+	return current.Load().dnsLog.Transactions(limit)
+}
+
+// DNSResolvers returns the DNS stats of each resolver seen in the
+// capture.
+func DNSResolvers(topNames int) []ResolverStats {
+	return current.Load().dnsLog.Resolvers(topNames)
+}
+
+// logDNS hands finished transactions to the subscribers and the console.
+func logDNS(out *console, txs ...DNSTransaction) {
+	for _, tx := range txs {
+		publishDNS(tx)
+		if out != nil {
+			out.dns(tx)
+		}
+	}
+}
+
+func printResolvers(resolvers []ResolverStats) {
+	if len(resolvers) == 0 {
+		return
+	}
+
+	fmt.Println("DNS resolvers:")
+	fmt.Printf("%-40s %8s %8s %10s %9s %10s %10s\n",
+		"Resolver", "Queries", "Answers", "Unanswered", "NXDOMAIN", "p50", "p99")
+	for _, r := range resolvers {
+		fmt.Printf("%-40s %8d %8d %10d %8.1f%% %10s %10s\n",
+			r.Resolver, r.Queries, r.Answered, r.Unanswered, r.NXDomainRate,
+			r.LatencyP50.Round(time.Microsecond), r.LatencyP99.Round(time.Microsecond))
+		for _, name := range r.TopNames {
+			fmt.Printf("    %6d  %s\n", name.Count, name.Name)
+		}
+	}
+}
+
+func (tx *DNSTransaction) key() dnsKey {
+	return dnsKey{
+		client:       tx.Client,
+		clientPort:   tx.ClientPort,
+		resolver:     tx.Resolver,
+		resolverPort: tx.ResolverPort,
+		protocol:     tx.Protocol,
+		id:           tx.ID,
+	}
+}
+
+func sortTransactions(txs []DNSTransaction) {
+	sort.Slice(txs, func(i, j int) bool { return txs[i].Timestamp.Before(txs[j].Timestamp) })
+}
+
+func topNameCounts(names map[string]int, limit int) []NameCount {
+	counts := make([]NameCount, 0, len(names))
+	for name, count := range names {
+		counts = append(counts, NameCount{Name: name, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+var dnsRCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+}
+
+// dnsRCode returns the usual mnemonic of a response code.
+func dnsRCode(code layers.DNSResponseCode) string {
+	if name, ok := dnsRCodes[code]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(code))
+}
+
+// dnsAnswer formats a resource record as its type and data.
+func dnsAnswer(rr layers.DNSResourceRecord) string {
+	var data string
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		data = rr.IP.String()
+	case layers.DNSTypeCNAME:
+		data = dnsName(rr.CNAME)
+	case layers.DNSTypeNS:
+		data = dnsName(rr.NS)
+	case layers.DNSTypePTR:
+		data = dnsName(rr.PTR)
+	case layers.DNSTypeMX:
+		data = fmt.Sprintf("%d %s", rr.MX.Preference, dnsName(rr.MX.Name))
+	case layers.DNSTypeTXT:
+		txt := make([]string, len(rr.TXTs))
+		for i, t := range rr.TXTs {
+			txt[i] = strconv.Quote(string(t))
+		}
+		data = strings.Join(txt, " ")
+	default:
+		return rr.Type.String()
+	}
+	return rr.Type.String() + " " + data
+}
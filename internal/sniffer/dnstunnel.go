@@ -0,0 +1,389 @@
+package sniffer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	AlertDNSTunnel = "dns_tunnel"
+	AlertDGA       = "dga"
+)
+
+// Reasons given in the details of DNS alerts.
+const (
+	DNSReasonLongLabel = "long_label"
+	DNSReasonEntropy   = "entropy"
+	DNSReasonVolume    = "volume"
+	DNSReasonTXT       = "txt_records"
+	DNSReasonNXDomain  = "nxdomain_burst"
+)
+
+// minEntropyLength is the shortest subdomain whose entropy is judged;
+// shorter strings cannot reach a meaningful entropy.
+const minEntropyLength = 24
+
+// dnsTunnelDetector flags DNS traffic that looks like data tunneled
+// through queries, and bursts of failed lookups for names that look
+// algorithmically generated, as malware uses to find its controller.
+type dnsTunnelDetector struct {
+	labelLength int
+	entropy     float64
+	names       int
+	txt         int
+	nxdomain    int
+	window      time.Duration
+	cooldown    time.Duration
+
+	// domains tracks queries by client and parent domain, clients the
+	// failed lookups of each client.
+	domains *hostTable[dnsDomainKey, *dnsDomainActivity]
+	clients *hostTable[string, *dnsClientActivity]
+}
+
+type dnsDomainKey struct {
+	client, domain string
+}
+
+type dnsDomainActivity struct {
+	names     recentSet[string]
+	txt       *slidingCounter
+	lastSeen  time.Time
+	lastAlert map[string]time.Time
+}
+
+func (a *dnsDomainActivity) seen() time.Time {
+	return a.lastSeen
+}
+
+type dnsClientActivity struct {
+	nxdomain  *slidingCounter
+	domains   recentSet[string]
+	lastSeen  time.Time
+	lastAlert time.Time
+}
+
+func (a *dnsClientActivity) seen() time.Time {
+	return a.lastSeen
+}
+
+func newDNSTunnelDetector(opts DetectorOptions) (Detector, error) {
+	if err := opts.checkKeys("label_length", "entropy", "names", "txt", "nxdomain", "window", "idle", "cooldown"); err != nil {
+		return nil, err
+	}
+
+	labelLength, err := opts.Int("label_length", 50)
+	if err != nil {
+		return nil, err
+	}
+	entropy, err := opts.Float("entropy", 4.0)
+	if err != nil {
+		return nil, err
+	}
+	names, err := opts.Int("names", 100)
+	if err != nil {
+		return nil, err
+	}
+	txt, err := opts.Int("txt", 30)
+	if err != nil {
+		return nil, err
+	}
+	nxdomain, err := opts.Int("nxdomain", 10)
+	if err != nil {
+		return nil, err
+	}
+	window, err := opts.Duration("window", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	idle, err := opts.Duration("idle", defaultDetectorIdle)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := opts.Duration("cooldown", window)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsTunnelDetector{
+		labelLength: labelLength,
+		entropy:     entropy,
+		names:       names,
+		txt:         txt,
+		nxdomain:    nxdomain,
+		window:      window,
+		cooldown:    cooldown,
+		domains:     newHostTable[dnsDomainKey, *dnsDomainActivity](max(idle, window)),
+		clients:     newHostTable[string, *dnsClientActivity](max(idle, window)),
+	}, nil
+}
+
+func (d *dnsTunnelDetector) Name() string {
+	return "dns"
+}
+
+func (d *dnsTunnelDetector) HandlePacket(p *PacketInfo) []AnomalyAlert {
+	if p.DNS == nil || len(p.DNS.Questions) == 0 {
+		return nil
+	}
+	question := p.DNS.Questions[0]
+	name := dnsName(question.Name)
+	if p.DNS.QR {
+		if p.DNS.ResponseCode == layers.DNSResponseCodeNXDomain {
+			// The client is the destination of the response.
+			return d.handleNXDomain(p.Dst, name, p.Timestamp)
+		}
+		return nil
+	}
+	return d.handleQuery(p.Src, name, question.Type, p.Timestamp)
+}
+
+func (d *dnsTunnelDetector) handleQuery(client, name string, qtype layers.DNSType, now time.Time) []AnomalyAlert {
+	domain, subdomain := splitDomain(name)
+	if subdomain == "" && qtype != layers.DNSTypeTXT && qtype != layers.DNSTypeNULL {
+		return nil
+	}
+
+	key := dnsDomainKey{client: client, domain: domain}
+	shard := d.domains.lock(key, now)
+	defer shard.mu.Unlock()
+
+	act, ok := shard.hosts[key]
+	if !ok {
+		act = &dnsDomainActivity{
+			names:     make(recentSet[string]),
+			txt:       newSlidingCounter(d.window),
+			lastAlert: make(map[string]time.Time),
+		}
+		shard.hosts[key] = act
+	}
+	act.lastSeen = now
+
+	var alerts []AnomalyAlert
+	alert := func(reason, severity, what string, details map[string]string) {
+		if last, ok := act.lastAlert[reason]; ok && now.Sub(last) < d.cooldown {
+			return
+		}
+		act.lastAlert[reason] = now
+
+		details["domain"] = domain
+		details["client"] = client
+		details["reason"] = reason
+		alerts = append(alerts, AnomalyAlert{
+			Type:     AlertDNSTunnel,
+			Severity: severity,
+			Message:  fmt.Sprintf("Possible DNS tunneling from %s via %s: %s", client, domain, what),
+			IP:       client,
+			Details:  details,
+		})
+	}
+
+	if label := longestLabel(subdomain); len(label) > d.labelLength {
+		alert(DNSReasonLongLabel, SeverityMedium,
+			fmt.Sprintf("%d character label in %s", len(label), name),
+			map[string]string{"name": name, "label_length": strconv.Itoa(len(label))})
+	}
+
+	// Reverse lookup names spell out an address in hex or decimal
+	// digits, which scores like encoded data.
+	if flat := strings.ReplaceAll(subdomain, ".", ""); len(flat) >= minEntropyLength && !isReverseName(name) {
+		// Data encoded in a smaller alphabet, such as hex, cannot reach
+		// the entropy of letters and digits, so the threshold shrinks
+		// with the alphabet.
+		threshold := d.entropy * min(1, alphabetBits(flat)/hostnameBits)
+		if e := shannonEntropy(flat); e > threshold {
+			alert(DNSReasonEntropy, SeverityMedium,
+				fmt.Sprintf("high-entropy subdomain in %s (%.2f bits/char)", name, e),
+				map[string]string{"name": name, "entropy": strconv.FormatFloat(e, 'f', 2, 64)})
+		}
+	}
+
+	if subdomain != "" {
+		act.names[name] = now
+		if len(act.names) > d.names {
+			if count := act.names.prune(now, d.window); count > d.names {
+				alert(DNSReasonVolume, SeverityHigh,
+					fmt.Sprintf("%d distinct names queried in %s", count, d.window),
+					map[string]string{"names": strconv.Itoa(count), "window": d.window.String()})
+			}
+		}
+	}
+
+	if qtype == layers.DNSTypeTXT || qtype == layers.DNSTypeNULL {
+		act.txt.add(now, 1)
+		if count := act.txt.count(now); count > d.txt {
+			alert(DNSReasonTXT, SeverityHigh,
+				fmt.Sprintf("%d TXT/NULL queries in %s", count, d.window),
+				map[string]string{"queries": strconv.Itoa(count), "window": d.window.String()})
+		}
+	}
+
+	return alerts
+}
+
+// handleNXDomain counts failed lookups of names that look generated and
+// alerts when a client has too many of them within the window.
+func (d *dnsTunnelDetector) handleNXDomain(client, name string, now time.Time) []AnomalyAlert {
+	domain, _ := splitDomain(name)
+	if !looksGenerated(strings.SplitN(domain, ".", 2)[0]) {
+		return nil
+	}
+
+	shard := d.clients.lock(client, now)
+	defer shard.mu.Unlock()
+
+	act, ok := shard.hosts[client]
+	if !ok {
+		act = &dnsClientActivity{nxdomain: newSlidingCounter(d.window), domains: make(recentSet[string])}
+		shard.hosts[client] = act
+	}
+	act.lastSeen = now
+	act.domains[domain] = now
+	act.domains.prune(now, d.window)
+	act.nxdomain.add(now, 1)
+
+	count := act.nxdomain.count(now)
+	if count <= d.nxdomain || now.Sub(act.lastAlert) < d.cooldown {
+		return nil
+	}
+	act.lastAlert = now
+
+	return []AnomalyAlert{{
+		Type:     AlertDGA,
+		Severity: SeverityHigh,
+		Message: fmt.Sprintf("Possible DGA activity from %s: %d failed lookups of generated-looking domains in %s, such as %s",
+			client, count, d.window, domain),
+		IP: client,
+		Details: map[string]string{
+			"domain":   domain,
+			"client":   client,
+			"reason":   DNSReasonNXDomain,
+			"nxdomain": strconv.Itoa(count),
+			"domains":  strconv.Itoa(len(act.domains)),
+			"window":   d.window.String(),
+		},
+	}}
+}
+
+func (d *dnsTunnelDetector) HandleFlow(f *Flow) []AnomalyAlert {
+	return nil
+}
+
+func (d *dnsTunnelDetector) concurrent() {}
+
+// secondLevelDomains are the labels that, under a two-letter country
+// code, form a public suffix such as co.uk or com.au.
+var secondLevelDomains = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true,
+	"net": true, "org": true, "ne": true, "or": true,
+}
+
+// splitDomain splits a name into its registered domain and the
+// subdomain below it. Without a public suffix list the registered domain
+// is taken to be the last two labels, or three under suffixes like
+// co.uk.
+func splitDomain(name string) (domain, subdomain string) {
+	labels := strings.Split(name, ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && secondLevelDomains[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return name, ""
+	}
+	return strings.Join(labels[len(labels)-n:], "."), strings.Join(labels[:len(labels)-n], ".")
+}
+
+// isReverseName reports whether name is a reverse lookup under
+// in-addr.arpa or ip6.arpa.
+func isReverseName(name string) bool {
+	return strings.HasSuffix(name, ".in-addr.arpa") || strings.HasSuffix(name, ".ip6.arpa")
+}
+
+func longestLabel(name string) string {
+	var longest string
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > len(longest) {
+			longest = label
+		}
+	}
+	return longest
+}
+
+// shannonEntropy returns the entropy of s in bits per character.
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+
+	var entropy float64
+	n := float64(len(s))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// hostnameBits is the information in a character of a host name, drawn
+// from 36 letters and digits.
+var hostnameBits = math.Log2(36)
+
+// alphabetBits returns the bits per character of the smallest alphabet s
+// is written in: decimal digits, hex digits or, failing those, the
+// letters and digits of host names.
+func alphabetBits(s string) float64 {
+	digits := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f':
+			digits = false
+		default:
+			return hostnameBits
+		}
+	}
+	if digits {
+		return math.Log2(10)
+	}
+	return 4
+}
+
+// looksGenerated reports whether a domain label looks algorithmically
+// generated: long, varied, and either hard to pronounce or full of
+// digits.
+func looksGenerated(label string) bool {
+	if len(label) < 8 || shannonEntropy(label) < 3 {
+		return false
+	}
+
+	digits, run, longestRun := 0, 0, 0
+	for _, c := range label {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+			run = 0
+		case strings.ContainsRune("aeiouy", c):
+			run = 0
+		case c >= 'a' && c <= 'z':
+			run++
+			longestRun = max(longestRun, run)
+		default:
+			run = 0
+		}
+	}
+	return longestRun >= 4 || digits*3 >= len(label)
+}
@@ -0,0 +1,113 @@
+package sniffer
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// DefaultDropWarnThreshold is the share of lost packets, in percent,
+// above which a warning is printed.
+const DefaultDropWarnThreshold = 1.0
+
+const (
+	captureStatsInterval = time.Second
+	dropWarnInterval     = 5 * time.Second
+)
+
+// Dropped returns the packets lost by the kernel, the interface and the
+// worker queues.
+func (s StatsSnapshot) Dropped() int {
+	return s.KernelDropped + s.InterfaceDropped + s.QueueDropped
+}
+
+// DropRate returns the share of packets lost, in percent, out of all the
+// packets processed or dropped.
+func (s StatsSnapshot) DropRate() float64 {
+	seen := s.Total + s.Dropped()
+	if seen == 0 {
+		return 0
+	}
+	return float64(s.Dropped()) / float64(seen) * 100
+}
+
+// since returns the counts between an earlier snapshot and s, leaving
+// out the breakdown by interface.
+func (s StatsSnapshot) since(prev StatsSnapshot) StatsSnapshot {
+	return StatsSnapshot{
+		Total:            s.Total - prev.Total,
+		TCP:              s.TCP - prev.TCP,
+		UDP:              s.UDP - prev.UDP,
+		ICMP:             s.ICMP - prev.ICMP,
+		Other:            s.Other - prev.Other,
+		Bytes:            s.Bytes - prev.Bytes,
+		QueueDropped:     s.QueueDropped - prev.QueueDropped,
+		KernelReceived:   s.KernelReceived - prev.KernelReceived,
+		KernelDropped:    s.KernelDropped - prev.KernelDropped,
+		InterfaceDropped: s.InterfaceDropped - prev.InterfaceDropped,
+	}
+}
+
+// setCaptureStats records the latest counters of the capture handles,
+// one per interface.
+func (s *Stats) setCaptureStats(cs []pcap.Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capture = cs
+}
+
+// pollCaptureStats records the current counters of the capture handles
+// of src, if it has any.
+func pollCaptureStats(st *Stats, src PacketSource) {
+	statsSource, live := src.(interfaceStatsSource)
+	if !live {
+		return
+	}
+	if cs := statsSource.interfaceCaptureStats(); cs != nil {
+		st.setCaptureStats(cs)
+	}
+}
+
+// monitorDrops polls the capture counters of src into st until done is
+// closed. When warn is set, it is called whenever more than threshold
+// percent of the packets were lost over the last interval.
+func monitorDrops(st *Stats, src PacketSource, threshold float64, done <-chan struct{}, warn func(interval time.Duration, dropped StatsSnapshot)) {
+	ticker := time.NewTicker(captureStatsInterval)
+	defer ticker.Stop()
+
+	prev := st.Snapshot()
+	prevAt := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		pollCaptureStats(st, src)
+
+		if time.Since(prevAt) < dropWarnInterval {
+			continue
+		}
+		current := st.Snapshot()
+		delta := current.since(prev)
+		if warn != nil && threshold > 0 && delta.DropRate() > threshold {
+			warn(time.Since(prevAt), delta)
+		}
+		prev, prevAt = current, time.Now()
+	}
+}
+
+// logDrops warns about packet loss on stderr.
+func logDrops(interval time.Duration, dropped StatsSnapshot) {
+	log.Printf("WARNING: %d of %d packets (%.1f%%) dropped in the last %s (kernel: %d, interface: %d, queue: %d)",
+		dropped.Dropped(),
+		dropped.Total+dropped.Dropped(),
+		dropped.DropRate(),
+		interval.Round(time.Second),
+		dropped.KernelDropped,
+		dropped.InterfaceDropped,
+		dropped.QueueDropped,
+	)
+}
@@ -0,0 +1,287 @@
+package sniffer
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of EnricherOptions.
+const (
+	DefaultEnrichWorkers     = 4
+	DefaultEnrichQueueSize   = 256
+	DefaultEnrichCacheSize   = 10000
+	DefaultEnrichTTL         = time.Hour
+	DefaultEnrichNegativeTTL = 5 * time.Minute
+	DefaultEnrichTimeout     = 2 * time.Second
+)
+
+// ResolveFunc looks up the name of an address. An empty name with a nil
+// error means the address has no name.
+type ResolveFunc func(ctx context.Context, ip string) (string, error)
+
+// EnricherOptions configures an Enricher. Zero values use the defaults.
+type EnricherOptions struct {
+	// Workers is the number of lookups run at once, and QueueSize the
+	// number of addresses that can wait for one.
+	Workers   int
+	QueueSize int
+	// CacheSize is the number of results kept, least recently used
+	// first out. Names are kept for TTL, and addresses that did not
+	// resolve for NegativeTTL.
+	CacheSize   int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// Timeout bounds each lookup, and RateLimit, when positive, the
+	// lookups started per second across all workers.
+	Timeout   time.Duration
+	RateLimit float64
+	Resolve   ResolveFunc
+}
+
+// EnricherStats counts the lookups of an Enricher.
+type EnricherStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Dropped uint64 `json:"dropped"`
+	Cached  int    `json:"cached"`
+}
+
+// Enricher resolves addresses in the background. Callers only ever read
+// the cache: a miss queues the address for a fixed pool of workers and
+// returns at once, and the result is there for a later call. When the
+// queue is full the request is dropped and made again on the next miss.
+type Enricher struct {
+	opts  EnricherOptions
+	queue chan string
+
+	mu     sync.Mutex
+	cache  *lruCache
+	queued map[string]bool
+	// nextLookup is when the rate limit allows the next lookup.
+	nextLookup time.Time
+
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	dropped atomic.Uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewEnricher starts the workers of an Enricher. Close stops them.
+func NewEnricher(opts EnricherOptions) *Enricher {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultEnrichWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultEnrichQueueSize
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = DefaultEnrichCacheSize
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultEnrichTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultEnrichNegativeTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultEnrichTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Enricher{
+		opts:   opts,
+		queue:  make(chan string, opts.QueueSize),
+		cache:  newLRUCache(opts.CacheSize),
+		queued: make(map[string]bool),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for range opts.Workers {
+		e.wg.Add(1)
+		go e.work()
+	}
+	return e
+}
+
+// Lookup returns the cached name of ip without blocking. found reports
+// whether there is a result; name is empty when the address did not
+// resolve. On a miss the address is queued for lookup.
+func (e *Enricher) Lookup(ip string) (name string, found bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if name, ok := e.cache.get(ip, time.Now()); ok {
+		e.hits.Add(1)
+		return name, true
+	}
+	e.misses.Add(1)
+
+	if e.queued[ip] || e.ctx.Err() != nil {
+		return "", false
+	}
+	select {
+	case e.queue <- ip:
+		e.queued[ip] = true
+	default:
+		e.dropped.Add(1)
+	}
+	return "", false
+}
+
+// Names returns the cached addresses that resolved, with their names.
+func (e *Enricher) Names() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cache.names(time.Now())
+}
+
+// Stats returns the lookup counters.
+func (e *Enricher) Stats() EnricherStats {
+	e.mu.Lock()
+	cached := e.cache.len()
+	e.mu.Unlock()
+
+	return EnricherStats{
+		Hits:    e.hits.Load(),
+		Misses:  e.misses.Load(),
+		Dropped: e.dropped.Load(),
+		Cached:  cached,
+	}
+}
+
+// Close cancels the lookups in progress and stops the workers.
+func (e *Enricher) Close() {
+	e.cancel()
+	e.wg.Wait()
+}
+
+func (e *Enricher) work() {
+	defer e.wg.Done()
+
+	for {
+		var ip string
+		select {
+		case <-e.ctx.Done():
+			return
+		case ip = <-e.queue:
+		}
+		if !e.wait() {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(e.ctx, e.opts.Timeout)
+		name, err := e.opts.Resolve(ctx, ip)
+		cancel()
+		if e.ctx.Err() != nil {
+			return
+		}
+
+		ttl := e.opts.TTL
+		if err != nil || name == "" {
+			name, ttl = "", e.opts.NegativeTTL
+		}
+
+		e.mu.Lock()
+		delete(e.queued, ip)
+		e.cache.put(ip, name, time.Now().Add(ttl))
+		e.mu.Unlock()
+	}
+}
+
+// wait blocks until the rate limit allows another lookup, and reports
+// false if the Enricher is closed meanwhile.
+func (e *Enricher) wait() bool {
+	if e.opts.RateLimit <= 0 {
+		return true
+	}
+
+	e.mu.Lock()
+	now := time.Now()
+	at := e.nextLookup
+	if at.Before(now) {
+		at = now
+	}
+	e.nextLookup = at.Add(time.Duration(float64(time.Second) / e.opts.RateLimit))
+	e.mu.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-e.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// lruCache holds names by address until they expire, evicting the least
+// recently used entry when full. It is not safe for concurrent use.
+type lruCache struct {
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	name    string
+	expires time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string, now time.Time) (string, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*lruEntry)
+	if now.After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.name, true
+}
+
+func (c *lruCache) put(key, name string, expires time.Time) {
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry)
+		entry.name, entry.expires = name, expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, name: name, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) len() int {
+	return c.order.Len()
+}
+
+// names returns the entries that have a name and have not expired.
+func (c *lruCache) names(now time.Time) map[string]string {
+	result := make(map[string]string, len(c.entries))
+	for key, el := range c.entries {
+		entry := el.Value.(*lruEntry)
+		if entry.name != "" && !now.After(entry.expires) {
+			result[key] = entry.name
+		}
+	}
+	return result
+}
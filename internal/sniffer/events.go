@@ -0,0 +1,104 @@
+package sniffer
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	EventPacket = "packet"
+	EventAlert  = "alert"
+	EventDNS    = "dns"
+)
+
+// Event is a decoded packet, a new alert or a finished DNS transaction,
+// as delivered to subscribers.
+type Event struct {
+	Type   string          `json:"type"`
+	Packet *PacketEntry    `json:"packet,omitempty"`
+	Alert  *AnomalyAlert   `json:"alert,omitempty"`
+	DNS    *DNSTransaction `json:"dns,omitempty"`
+}
+
+// Subscription receives published events through its own buffer. When the
+// buffer is full new events are dropped and counted rather than blocking
+// the capture loop.
+type Subscription struct {
+	events  chan Event
+	filter  func(Event) bool
+	dropped atomic.Uint64
+}
+
+var (
+	subscribers   = make(map[*Subscription]struct{})
+	subscribersMu sync.RWMutex
+)
+
+// Subscribe registers a subscriber with room for buffer events. Only
+// events for which filter returns true are delivered; a nil filter
+// accepts everything.
+func Subscribe(buffer int, filter func(Event) bool) *Subscription {
+	if buffer <= 0 {
+		buffer = 256
+	}
+
+	sub := &Subscription{
+		events: make(chan Event, buffer),
+		filter: filter,
+	}
+
+	subscribersMu.Lock()
+	subscribers[sub] = struct{}{}
+	subscribersMu.Unlock()
+
+	return sub
+}
+
+// Unsubscribe stops delivery to sub and closes its event channel.
+func Unsubscribe(sub *Subscription) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	if _, exists := subscribers[sub]; exists {
+		delete(subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events lost because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func publish(ev Event) {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+
+	for sub := range subscribers {
+		if sub.filter != nil && !sub.filter(ev) {
+			continue
+		}
+
+		select {
+		case sub.events <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func publishPacket(entry PacketEntry) {
+	publish(Event{Type: EventPacket, Packet: &entry})
+}
+
+func publishAlert(alert AnomalyAlert) {
+	publish(Event{Type: EventAlert, Alert: &alert})
+}
+
+func publishDNS(tx DNSTransaction) {
+	publish(Event{Type: EventDNS, DNS: &tx})
+}
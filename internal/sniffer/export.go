@@ -0,0 +1,434 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ExportIPFIX     = "ipfix"
+	ExportNetFlowV9 = "netflow9"
+)
+
+const (
+	ipfixVersion     = 10
+	netflowV9Version = 9
+
+	templateIPv4 = 256
+	templateIPv6 = 257
+
+	// Keep export packets below a typical path MTU.
+	maxExportPacketSize = 1400
+
+	// Templates are resent periodically so that collectors that start
+	// after the exporter, or lose a packet, can still decode the data.
+	templateRefreshPackets  = 20
+	templateRefreshInterval = time.Minute
+
+	// Country codes have no standard information element, so they are
+	// sent as enterprise-specific fields under the documentation PEN
+	// (RFC 5612). NetFlow v9 has no enterprise numbers and uses the
+	// vendor range instead.
+	exportEnterpriseNumber = 32473
+)
+
+// Information element IDs shared by IPFIX and NetFlow v9.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieTCPControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+
+	// NetFlow v9 timestamps are milliseconds of system uptime.
+	ieV9LastSwitched  = 21
+	ieV9FirstSwitched = 22
+
+	// IPFIX timestamps are absolute milliseconds.
+	ieFlowStartMilliseconds = 152
+	ieFlowEndMilliseconds   = 153
+
+	ieSourceCountryCode      = 1
+	ieDestinationCountryCode = 2
+	v9VendorFieldBase        = 0x8000
+)
+
+type templateField struct {
+	id         uint16
+	length     uint16
+	enterprise bool
+}
+
+// FlowExporter sends expired flows to a collector as NetFlow v9 or IPFIX.
+type FlowExporter struct {
+	mu               sync.Mutex
+	conn             net.Conn
+	format           string
+	domainID         uint32
+	sequence         uint32
+	packetsSinceTmpl map[uint16]int
+	lastTemplate     map[uint16]time.Time
+
+	// now is the export clock. startedAt is the system boot that NetFlow
+	// v9 times count from; it moves back to the start of any older flow,
+	// such as those read from a file.
+	now       func() time.Time
+	startedAt time.Time
+}
+
+func NewFlowExporter(collector, format string) (*FlowExporter, error) {
+	if format == "" {
+		format = ExportIPFIX
+	}
+	if format != ExportIPFIX && format != ExportNetFlowV9 {
+		return nil, fmt.Errorf("unsupported export format %q (want %s or %s)",
+			format, ExportIPFIX, ExportNetFlowV9)
+	}
+
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to collector: %w", err)
+	}
+
+	return &FlowExporter{
+		conn:      conn,
+		format:    format,
+		domainID:  1,
+		now:       time.Now,
+		startedAt: time.Now(),
+
+		packetsSinceTmpl: make(map[uint16]int),
+		lastTemplate:     make(map[uint16]time.Time),
+	}, nil
+}
+
+// newExporter returns the exporter configured by cfg, or nil when flows
+// are not exported. clock stamps the export packets, so that flows read
+// from a file are exported in capture time.
+func newExporter(cfg Config, clock func() time.Time) (*FlowExporter, error) {
+	if cfg.ExportCollector == "" {
+		return nil, nil
+	}
+
+	exporter, err := NewFlowExporter(cfg.ExportCollector, cfg.ExportFormat)
+	if err != nil {
+		return nil, err
+	}
+	exporter.now = clock
+	return exporter, nil
+}
+
+// exportFlows is the flow expiry callback. It is safe to call on a nil
+// exporter, in which case expired flows are dropped.
+func (e *FlowExporter) exportFlows(flowList []Flow) {
+	if e == nil || len(flowList) == 0 {
+		return
+	}
+	if err := e.Export(flowList); err != nil {
+		log.Printf("error exporting flows: %v", err)
+	}
+}
+
+func (e *FlowExporter) Close() error {
+	return e.conn.Close()
+}
+
+// Export sends one record per direction of each flow. Flows are
+// bidirectional while NetFlow records are not, so the reverse direction
+// becomes its own record.
+func (e *FlowExporter) Export(flowList []Flow) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i := range flowList {
+		if flowList[i].FirstSeen.Before(e.startedAt) {
+			e.startedAt = flowList[i].FirstSeen
+		}
+	}
+
+	var v4, v6 [][]byte
+	for i := range flowList {
+		for _, rec := range e.flowRecords(&flowList[i]) {
+			if len(rec.src) == net.IPv4len {
+				v4 = append(v4, e.encodeRecord(rec))
+			} else {
+				v6 = append(v6, e.encodeRecord(rec))
+			}
+		}
+	}
+
+	if err := e.sendRecords(templateIPv4, v4); err != nil {
+		return err
+	}
+	return e.sendRecords(templateIPv6, v6)
+}
+
+type exportRecord struct {
+	src, dst         net.IP
+	srcPort, dstPort int
+	protocol         uint8
+	tcpFlags         TCPFlags
+	bytes, packets   int
+	start, end       time.Time
+	srcISO, dstISO   string
+}
+
+func (e *FlowExporter) flowRecords(f *Flow) []exportRecord {
+	src, dst := net.ParseIP(f.Key.SrcIP), net.ParseIP(f.Key.DstIP)
+	if src == nil || dst == nil {
+		return nil
+	}
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		src, dst = src4, dst4
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+
+	srcISO := LookupCountry(f.Key.SrcIP).ISO
+	dstISO := LookupCountry(f.Key.DstIP).ISO
+	proto := protocolNumber(f.Key.Protocol)
+
+	records := []exportRecord{{
+		src: src, dst: dst,
+		srcPort: f.Key.SrcPort, dstPort: f.Key.DstPort,
+		protocol: proto, tcpFlags: f.TCPFlags,
+		bytes: f.SrcBytes, packets: f.SrcPackets,
+		start: f.FirstSeen, end: f.LastSeen,
+		srcISO: srcISO, dstISO: dstISO,
+	}}
+
+	if f.DstPackets > 0 {
+		records = append(records, exportRecord{
+			src: dst, dst: src,
+			srcPort: f.Key.DstPort, dstPort: f.Key.SrcPort,
+			protocol: proto, tcpFlags: f.TCPFlags,
+			bytes: f.DstBytes, packets: f.DstPackets,
+			start: f.FirstSeen, end: f.LastSeen,
+			srcISO: dstISO, dstISO: srcISO,
+		})
+	}
+
+	return records
+}
+
+func protocolNumber(protocol string) uint8 {
+	switch protocol {
+	case "TCP":
+		return 6
+	case "UDP":
+		return 17
+	case "ICMPv4":
+		return 1
+	case "ICMPv6":
+		return 58
+	}
+	return 0
+}
+
+func (e *FlowExporter) templateFields(templateID uint16) []templateField {
+	addrIEs := [2]uint16{ieSourceIPv4Address, ieDestinationIPv4Address}
+	addrLen := uint16(net.IPv4len)
+	if templateID == templateIPv6 {
+		addrIEs = [2]uint16{ieSourceIPv6Address, ieDestinationIPv6Address}
+		addrLen = net.IPv6len
+	}
+
+	fields := []templateField{
+		{id: addrIEs[0], length: addrLen},
+		{id: addrIEs[1], length: addrLen},
+		{id: ieSourceTransportPort, length: 2},
+		{id: ieDestinationTransportPort, length: 2},
+		{id: ieProtocolIdentifier, length: 1},
+		{id: ieTCPControlBits, length: 1},
+		{id: ieOctetDeltaCount, length: 8},
+		{id: iePacketDeltaCount, length: 8},
+	}
+
+	if e.format == ExportIPFIX {
+		fields = append(fields,
+			templateField{id: ieFlowStartMilliseconds, length: 8},
+			templateField{id: ieFlowEndMilliseconds, length: 8},
+			templateField{id: ieSourceCountryCode, length: 2, enterprise: true},
+			templateField{id: ieDestinationCountryCode, length: 2, enterprise: true},
+		)
+	} else {
+		fields = append(fields,
+			templateField{id: ieV9FirstSwitched, length: 4},
+			templateField{id: ieV9LastSwitched, length: 4},
+			templateField{id: v9VendorFieldBase + ieSourceCountryCode, length: 2},
+			templateField{id: v9VendorFieldBase + ieDestinationCountryCode, length: 2},
+		)
+	}
+
+	return fields
+}
+
+func (e *FlowExporter) encodeRecord(r exportRecord) []byte {
+	b := make([]byte, 0, 64)
+	b = append(b, r.src...)
+	b = append(b, r.dst...)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.srcPort))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.dstPort))
+	b = append(b, r.protocol, byte(r.tcpFlags))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.bytes))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.packets))
+
+	if e.format == ExportIPFIX {
+		b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	} else {
+		b = binary.BigEndian.AppendUint32(b, e.uptimeMillis(r.start))
+		b = binary.BigEndian.AppendUint32(b, e.uptimeMillis(r.end))
+	}
+
+	b = append(b, countryCode(r.srcISO)...)
+	b = append(b, countryCode(r.dstISO)...)
+
+	return b
+}
+
+func (e *FlowExporter) uptimeMillis(t time.Time) uint32 {
+	if t.Before(e.startedAt) {
+		return 0
+	}
+	return uint32(t.Sub(e.startedAt).Milliseconds())
+}
+
+func countryCode(iso string) []byte {
+	if len(iso) != 2 {
+		return []byte("--")
+	}
+	return []byte(iso)
+}
+
+// sendRecords packs the records into as few export packets as fit the
+// size limit, adding the template when it is due.
+func (e *FlowExporter) sendRecords(templateID uint16, records [][]byte) error {
+	for len(records) > 0 {
+		withTemplate := e.templateDue(templateID)
+
+		var sets []byte
+		count := 0
+		if withTemplate {
+			sets = append(sets, e.encodeTemplateSet(templateID)...)
+			count++
+		}
+
+		budget := maxExportPacketSize - e.headerLen() - len(sets) - 4
+		var data []byte
+		n := 0
+		for n < len(records) && len(data)+len(records[n]) <= budget {
+			data = append(data, records[n]...)
+			n++
+		}
+		if n == 0 {
+			// A single record larger than the budget; send it anyway.
+			data, n = records[0], 1
+		}
+
+		sets = append(sets, e.encodeSet(templateID, data)...)
+		count += n
+
+		if _, err := e.conn.Write(e.encodeMessage(sets, count, n)); err != nil {
+			return fmt.Errorf("failed to send flow records: %w", err)
+		}
+
+		if withTemplate {
+			e.packetsSinceTmpl[templateID] = 0
+			e.lastTemplate[templateID] = time.Now()
+		} else {
+			e.packetsSinceTmpl[templateID]++
+		}
+		records = records[n:]
+	}
+
+	return nil
+}
+
+func (e *FlowExporter) templateDue(templateID uint16) bool {
+	last, sent := e.lastTemplate[templateID]
+	return !sent ||
+		e.packetsSinceTmpl[templateID] >= templateRefreshPackets ||
+		time.Since(last) >= templateRefreshInterval
+}
+
+func (e *FlowExporter) headerLen() int {
+	if e.format == ExportIPFIX {
+		return 16
+	}
+	return 20
+}
+
+func (e *FlowExporter) encodeTemplateSet(templateID uint16) []byte {
+	fields := e.templateFields(templateID)
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, templateID)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(fields)))
+	for _, f := range fields {
+		if f.enterprise {
+			body = binary.BigEndian.AppendUint16(body, f.id|0x8000)
+			body = binary.BigEndian.AppendUint16(body, f.length)
+			body = binary.BigEndian.AppendUint32(body, exportEnterpriseNumber)
+		} else {
+			body = binary.BigEndian.AppendUint16(body, f.id)
+			body = binary.BigEndian.AppendUint16(body, f.length)
+		}
+	}
+
+	// IPFIX template sets use ID 2, NetFlow v9 template flowsets ID 0.
+	setID := uint16(2)
+	if e.format == ExportNetFlowV9 {
+		setID = 0
+	}
+	return e.encodeSet(setID, body)
+}
+
+func (e *FlowExporter) encodeSet(setID uint16, body []byte) []byte {
+	// Pad sets to a 4-byte boundary, as NetFlow v9 requires.
+	padding := (4 - (len(body)+4)%4) % 4
+	length := 4 + len(body) + padding
+
+	set := make([]byte, 0, length)
+	set = binary.BigEndian.AppendUint16(set, setID)
+	set = binary.BigEndian.AppendUint16(set, uint16(length))
+	set = append(set, body...)
+	set = append(set, make([]byte, padding)...)
+	return set
+}
+
+// encodeMessage prepends the message header. count is the number of
+// template and data records, dataRecords the number of flow records, which
+// drives the IPFIX sequence number.
+func (e *FlowExporter) encodeMessage(sets []byte, count, dataRecords int) []byte {
+	now := e.now()
+	msg := make([]byte, 0, e.headerLen()+len(sets))
+
+	if e.format == ExportIPFIX {
+		msg = binary.BigEndian.AppendUint16(msg, ipfixVersion)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(16+len(sets)))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(now.Unix()))
+		msg = binary.BigEndian.AppendUint32(msg, e.sequence)
+		msg = binary.BigEndian.AppendUint32(msg, e.domainID)
+		e.sequence += uint32(dataRecords)
+	} else {
+		msg = binary.BigEndian.AppendUint16(msg, netflowV9Version)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(count))
+		msg = binary.BigEndian.AppendUint32(msg, e.uptimeMillis(now))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(now.Unix()))
+		msg = binary.BigEndian.AppendUint32(msg, e.sequence)
+		msg = binary.BigEndian.AppendUint32(msg, e.domainID)
+		e.sequence++
+	}
+
+	return append(msg, sets...)
+}
@@ -0,0 +1,105 @@
+package sniffer
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// defaultDetectorIdle is how long detectors remember a host after its
+// last packet.
+const defaultDetectorIdle = 30 * time.Second
+
+// floodDetector raises an alert when a source sends more than rate
+// packets per second, measured over a sliding window.
+type floodDetector struct {
+	rate     float64
+	window   time.Duration
+	cooldown time.Duration
+	hosts    *hostTable[string, *floodActivity]
+}
+
+type floodActivity struct {
+	packets   *slidingCounter
+	lastSeen  time.Time
+	lastAlert time.Time
+}
+
+func (a *floodActivity) seen() time.Time {
+	return a.lastSeen
+}
+
+func newFloodDetector(opts DetectorOptions) (Detector, error) {
+	if err := opts.checkKeys("rate", "window", "idle", "cooldown"); err != nil {
+		return nil, err
+	}
+
+	rate, err := opts.Float("rate", 100)
+	if err != nil {
+		return nil, err
+	}
+	window, err := opts.Duration("window", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	idle, err := opts.Duration("idle", defaultDetectorIdle)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := opts.Duration("cooldown", window)
+	if err != nil {
+		return nil, err
+	}
+
+	return &floodDetector{
+		rate:     rate,
+		window:   window,
+		cooldown: cooldown,
+		hosts:    newHostTable[string, *floodActivity](max(idle, window)),
+	}, nil
+}
+
+func (d *floodDetector) Name() string {
+	return "flood"
+}
+
+func (d *floodDetector) HandlePacket(p *PacketInfo) []AnomalyAlert {
+	if p.Src == "unknown" {
+		return nil
+	}
+	shard := d.hosts.lock(p.Src, p.Timestamp)
+	defer shard.mu.Unlock()
+
+	act, ok := shard.hosts[p.Src]
+	if !ok {
+		act = &floodActivity{packets: newSlidingCounter(d.window)}
+		shard.hosts[p.Src] = act
+	}
+	act.packets.add(p.Timestamp, 1)
+	act.lastSeen = p.Timestamp
+
+	count := act.packets.count(p.Timestamp)
+	rate := float64(count) / d.window.Seconds()
+	if rate <= d.rate || p.Timestamp.Sub(act.lastAlert) < d.cooldown {
+		return nil
+	}
+	act.lastAlert = p.Timestamp
+
+	return []AnomalyAlert{{
+		Type:     AlertFlood,
+		Severity: SeverityHigh,
+		Message:  fmt.Sprintf("Flood detected from %s (%.0f packets/s over %s)", LookupDomain(p.Src), rate, d.window),
+		IP:       p.Src,
+		Details: map[string]string{
+			"packets": strconv.Itoa(count),
+			"rate":    strconv.FormatFloat(rate, 'f', 1, 64),
+			"window":  d.window.String(),
+		},
+	}}
+}
+
+func (d *floodDetector) HandleFlow(f *Flow) []AnomalyAlert {
+	return nil
+}
+
+func (d *floodDetector) concurrent() {}
@@ -0,0 +1,448 @@
+package sniffer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCPFlags is a bitmask of the TCP control flags.
+type TCPFlags uint8
+
+const (
+	FlagFIN TCPFlags = 1 << iota
+	FlagSYN
+	FlagRST
+	FlagPSH
+	FlagACK
+	FlagURG
+	FlagECE
+	FlagCWR
+)
+
+var tcpFlagNames = []struct {
+	flag TCPFlags
+	name string
+}{
+	{FlagSYN, "SYN"},
+	{FlagACK, "ACK"},
+	{FlagFIN, "FIN"},
+	{FlagRST, "RST"},
+	{FlagPSH, "PSH"},
+	{FlagURG, "URG"},
+	{FlagECE, "ECE"},
+	{FlagCWR, "CWR"},
+}
+
+func tcpFlagsOf(tcp *layers.TCP) TCPFlags {
+	var f TCPFlags
+	if tcp.FIN {
+		f |= FlagFIN
+	}
+	if tcp.SYN {
+		f |= FlagSYN
+	}
+	if tcp.RST {
+		f |= FlagRST
+	}
+	if tcp.PSH {
+		f |= FlagPSH
+	}
+	if tcp.ACK {
+		f |= FlagACK
+	}
+	if tcp.URG {
+		f |= FlagURG
+	}
+	if tcp.ECE {
+		f |= FlagECE
+	}
+	if tcp.CWR {
+		f |= FlagCWR
+	}
+	return f
+}
+
+func (f TCPFlags) Has(flag TCPFlags) bool {
+	return f&flag != 0
+}
+
+func (f TCPFlags) String() string {
+	var names []string
+	for _, n := range tcpFlagNames {
+		if f.Has(n.flag) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "|")
+}
+
+func (f TCPFlags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *TCPFlags) UnmarshalText(text []byte) error {
+	*f = 0
+	if s := string(text); s == "" || s == "-" {
+		return nil
+	}
+
+	for _, name := range strings.Split(string(text), "|") {
+		found := false
+		for _, n := range tcpFlagNames {
+			if n.name == name {
+				*f |= n.flag
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown TCP flag %q", name)
+		}
+	}
+	return nil
+}
+
+// FlowState is the connection state of a flow. Only TCP flows move
+// through the handshake states; other protocols stay ACTIVE.
+type FlowState string
+
+const (
+	FlowSynSent     FlowState = "SYN_SENT"
+	FlowSynReceived FlowState = "SYN_RECEIVED"
+	FlowEstablished FlowState = "ESTABLISHED"
+	FlowFinWait     FlowState = "FIN_WAIT"
+	FlowClosed      FlowState = "CLOSED"
+	FlowActive      FlowState = "ACTIVE"
+)
+
+// FlowKey identifies a conversation by its 5-tuple and the interface it
+// was captured on, oriented from the host that sent the first packet
+// seen. The same conversation seen on two interfaces, such as an uplink
+// and a bridge, makes two flows.
+type FlowKey struct {
+	SrcIP     string `json:"src_ip"`
+	DstIP     string `json:"dst_ip"`
+	SrcPort   int    `json:"src_port"`
+	DstPort   int    `json:"dst_port"`
+	Protocol  string `json:"protocol"`
+	Interface string `json:"interface,omitempty"`
+}
+
+func (k FlowKey) reverse() FlowKey {
+	return FlowKey{
+		SrcIP:     k.DstIP,
+		DstIP:     k.SrcIP,
+		SrcPort:   k.DstPort,
+		DstPort:   k.SrcPort,
+		Protocol:  k.Protocol,
+		Interface: k.Interface,
+	}
+}
+
+func (k FlowKey) String() string {
+	if k.SrcPort == 0 && k.DstPort == 0 {
+		return fmt.Sprintf("%s %s <-> %s", k.Protocol, k.SrcIP, k.DstIP)
+	}
+	return fmt.Sprintf("%s %s:%d <-> %s:%d", k.Protocol, k.SrcIP, k.SrcPort, k.DstIP, k.DstPort)
+}
+
+// Flow is a bidirectional conversation. Src counters cover packets sent
+// by Key.SrcIP, Dst counters packets sent back by Key.DstIP.
+type Flow struct {
+	Key        FlowKey   `json:"key"`
+	SrcPackets int       `json:"src_packets"`
+	SrcBytes   int       `json:"src_bytes"`
+	DstPackets int       `json:"dst_packets"`
+	DstBytes   int       `json:"dst_bytes"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	TCPFlags   TCPFlags  `json:"tcp_flags"`
+	State      FlowState `json:"state"`
+
+	srcFin bool
+	dstFin bool
+}
+
+func (f *Flow) Packets() int {
+	return f.SrcPackets + f.DstPackets
+}
+
+func (f *Flow) Bytes() int {
+	return f.SrcBytes + f.DstBytes
+}
+
+func (f *Flow) Duration() time.Duration {
+	return f.LastSeen.Sub(f.FirstSeen)
+}
+
+// FlowTable tracks active flows. A flow expires once it has been idle for
+// IdleTimeout, has lasted longer than ActiveTimeout, or has been closed.
+// The packets of a flow always go to the same pipeline worker, so every
+// worker tracks its flows in a shard of its own, and the shards are
+// merged when read.
+type FlowTable struct {
+	mu            sync.Mutex
+	shards        []*flowShard
+	IdleTimeout   time.Duration
+	ActiveTimeout time.Duration
+}
+
+type flowShard struct {
+	mu         sync.Mutex
+	flows      map[FlowKey]*Flow
+	lastPacket time.Time
+}
+
+const (
+	DefaultFlowIdleTimeout   = 30 * time.Second
+	DefaultFlowActiveTimeout = 30 * time.Minute
+)
+
+func NewFlowTable(idleTimeout, activeTimeout time.Duration) *FlowTable {
+	return &FlowTable{
+		IdleTimeout:   idleTimeout,
+		ActiveTimeout: activeTimeout,
+	}
+}
+
+// ActiveFlows returns a copy of the flows currently tracked, largest first.
+func ActiveFlows() []Flow {
+	return current.Load().flows.Snapshot()
+}
+
+// newShard adds a shard for a pipeline worker.
+func (t *FlowTable) newShard() *flowShard {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shard := &flowShard{flows: make(map[FlowKey]*Flow)}
+	t.shards = append(t.shards, shard)
+	return shard
+}
+
+func (t *FlowTable) allShards() []*flowShard {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.shards
+}
+
+// update counts a packet in its flow.
+func (s *flowShard) update(info PacketInfo) {
+	if info.Src == "unknown" || info.Dst == "unknown" {
+		return
+	}
+
+	key := FlowKey{
+		SrcIP:     info.Src,
+		DstIP:     info.Dst,
+		SrcPort:   info.SrcPort,
+		DstPort:   info.DstPort,
+		Protocol:  info.Protocol,
+		Interface: info.Interface,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info.Timestamp.After(s.lastPacket) {
+		s.lastPacket = info.Timestamp
+	}
+
+	fromSrc := true
+	flow, exists := s.flows[key]
+	if !exists {
+		if flow, exists = s.flows[key.reverse()]; exists {
+			fromSrc = false
+		}
+	}
+
+	if !exists {
+		flow = &Flow{
+			Key:       key,
+			FirstSeen: info.Timestamp,
+			State:     FlowActive,
+		}
+		s.flows[key] = flow
+	}
+
+	if fromSrc {
+		flow.SrcPackets++
+		flow.SrcBytes += info.Length
+	} else {
+		flow.DstPackets++
+		flow.DstBytes += info.Length
+	}
+	flow.LastSeen = info.Timestamp
+
+	if info.Protocol == "TCP" {
+		flow.TCPFlags |= info.TCPFlags
+		flow.advance(info.TCPFlags, fromSrc, !exists)
+	}
+}
+
+// advance moves a TCP flow through a simplified connection state machine.
+func (f *Flow) advance(flags TCPFlags, fromSrc, first bool) {
+	switch {
+	case flags.Has(FlagRST):
+		f.State = FlowClosed
+		return
+	case flags.Has(FlagFIN):
+		if fromSrc {
+			f.srcFin = true
+		} else {
+			f.dstFin = true
+		}
+		if f.srcFin && f.dstFin {
+			f.State = FlowClosed
+		} else {
+			f.State = FlowFinWait
+		}
+		return
+	}
+
+	switch f.State {
+	case FlowActive:
+		if first && flags.Has(FlagSYN) && !flags.Has(FlagACK) {
+			f.State = FlowSynSent
+		} else {
+			// Picked up mid-stream.
+			f.State = FlowEstablished
+		}
+	case FlowSynSent:
+		if !fromSrc && flags.Has(FlagSYN) && flags.Has(FlagACK) {
+			f.State = FlowSynReceived
+		}
+	case FlowSynReceived:
+		if fromSrc && flags.Has(FlagACK) {
+			f.State = FlowEstablished
+		}
+	}
+}
+
+// Expire removes and returns the flows that timed out or closed as of now.
+func (t *FlowTable) Expire(now time.Time) []Flow {
+	var expired []Flow
+	for _, shard := range t.allShards() {
+		shard.mu.Lock()
+		for key, flow := range shard.flows {
+			idle := now.Sub(flow.LastSeen) > t.IdleTimeout
+			active := now.Sub(flow.FirstSeen) > t.ActiveTimeout
+			if flow.State == FlowClosed || idle || active {
+				expired = append(expired, *flow)
+				delete(shard.flows, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return expired
+}
+
+// Flush removes and returns every flow in the table.
+func (t *FlowTable) Flush() []Flow {
+	var all []Flow
+	for _, shard := range t.allShards() {
+		shard.mu.Lock()
+		for _, flow := range shard.flows {
+			all = append(all, *flow)
+		}
+		shard.flows = make(map[FlowKey]*Flow)
+		shard.mu.Unlock()
+	}
+
+	return all
+}
+
+// LastPacketTime returns the capture timestamp of the newest packet seen,
+// which serves as the clock when reading capture files.
+func (t *FlowTable) LastPacketTime() time.Time {
+	var last time.Time
+	for _, shard := range t.allShards() {
+		shard.mu.Lock()
+		if shard.lastPacket.After(last) {
+			last = shard.lastPacket
+		}
+		shard.mu.Unlock()
+	}
+
+	return last
+}
+
+func (t *FlowTable) Snapshot() []Flow {
+	result := []Flow{}
+	for _, shard := range t.allShards() {
+		shard.mu.Lock()
+		for _, flow := range shard.flows {
+			result = append(result, *flow)
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Bytes() > result[j].Bytes()
+	})
+
+	return result
+}
+
+func printFlows(flowList []Flow, limit int) {
+	if len(flowList) == 0 {
+		fmt.Println("no flows.")
+		return
+	}
+
+	fmt.Printf("%-48s %-12s %8s %10s %8s %10s %-12s %s\n",
+		"Flow", "State", "Pkts>", "Bytes>", "Pkts<", "Bytes<", "Flags", "Iface")
+	for i, f := range flowList {
+		if limit > 0 && i >= limit {
+			fmt.Printf("... and %d more\n", len(flowList)-limit)
+			break
+		}
+		fmt.Printf("%-48s %-12s %8d %10d %8d %10d %-12s %s\n",
+			f.Key, f.State, f.SrcPackets, f.SrcBytes, f.DstPackets, f.DstBytes, f.TCPFlags, f.Key.Interface)
+	}
+}
+
+// expireLoop expires flows once a second until done is closed, handing
+// them to onExpire. When reading a capture file the packet timestamps are
+// used as the clock instead of the wall clock.
+func (t *FlowTable) expireLoop(done <-chan struct{}, captureClock bool, onExpire func([]Flow)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		if captureClock {
+			now = t.LastPacketTime()
+		}
+
+		if expired := t.Expire(now); len(expired) > 0 && onExpire != nil {
+			onExpire(expired)
+		}
+	}
+}
+
+func newFlowTable(cfg Config) *FlowTable {
+	idle := cfg.FlowIdleTimeout
+	if idle <= 0 {
+		idle = DefaultFlowIdleTimeout
+	}
+	active := cfg.FlowActiveTimeout
+	if active <= 0 {
+		active = DefaultFlowActiveTimeout
+	}
+	return NewFlowTable(idle, active)
+}
@@ -1,29 +1,92 @@
 package sniffer
 
 import (
+	"hash/maphash"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/oschwald/geoip2-golang"
 )
 
+// The country cache is split into shards, each with its own lock, so that
+// pipeline workers rarely wait on each other. A full shard forgets an
+// arbitrary entry to make room.
+const (
+	geoCacheShards    = 64
+	geoCacheShardSize = 1024
+)
+
 var (
-	geoDB       *geoip2.Reader
-	geoDBMutex  sync.Mutex
-	countryInfo = map[string]CountryInfo{}
+	// geoDB is opened by the first InitGeoIP and closed by the last
+	// CloseGeoIP; geoDBUsers counts the callers in between. Lookups share
+	// the reader under a read lock.
+	geoDB         *geoip2.Reader
+	geoDBUsers    int
+	geoDBMutex    sync.RWMutex
+	geoCache      [geoCacheShards]geoCacheShard
+	geoCacheSeed  = maphash.MakeSeed()
+	geoCacheStats cacheCounters
 )
 
+type geoCacheShard struct {
+	mu        sync.RWMutex
+	countries map[string]CountryInfo
+}
+
+func geoCacheFor(ipStr string) *geoCacheShard {
+	return &geoCache[maphash.String(geoCacheSeed, ipStr)%geoCacheShards]
+}
+
+func (s *geoCacheShard) get(ipStr string) (CountryInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, found := s.countries[ipStr]
+	return info, found
+}
+
+func (s *geoCacheShard) put(ipStr string, info CountryInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.countries == nil {
+		s.countries = make(map[string]CountryInfo)
+	}
+	if _, found := s.countries[ipStr]; !found && len(s.countries) >= geoCacheShardSize {
+		for evict := range s.countries {
+			delete(s.countries, evict)
+			break
+		}
+	}
+	s.countries[ipStr] = info
+}
+
 type CountryInfo struct {
-	Name string
-	ISO  string
-	Flag string
+	Name string `json:"name"`
+	ISO  string `json:"iso"`
+	Flag string `json:"flag"`
+}
+
+// CountryStat counts the hosts and traffic seen for one country.
+type CountryStat struct {
+	Country CountryInfo `json:"country"`
+	Hosts   int         `json:"hosts"`
+	Bytes   int         `json:"bytes"`
 }
 
 func InitGeoIP() error {
+	geoDBMutex.Lock()
+	defer geoDBMutex.Unlock()
+
+	if geoDB != nil {
+		geoDBUsers++
+		return nil
+	}
+
 	dbPath := "GeoLite2-Country.mmdb"
 
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
@@ -38,10 +101,8 @@ func InitGeoIP() error {
 		return err
 	}
 
-	geoDBMutex.Lock()
 	geoDB = db
-	geoDBMutex.Unlock()
-
+	geoDBUsers = 1
 	return nil
 }
 
@@ -73,8 +134,8 @@ func downloadGeoIPDB(path string) error {
 }
 
 func LookupCountry(ipStr string) CountryInfo {
-	geoDBMutex.Lock()
-	defer geoDBMutex.Unlock()
+	geoDBMutex.RLock()
+	defer geoDBMutex.RUnlock()
 
 	if geoDB == nil {
 		return CountryInfo{Name: "Unknown", ISO: "XX", Flag: "🏴"}
@@ -89,9 +150,12 @@ func LookupCountry(ipStr string) CountryInfo {
 		return CountryInfo{Name: "Local Network", ISO: "LO", Flag: "🏠"}
 	}
 
-	if info, found := countryInfo[ipStr]; found {
+	cache := geoCacheFor(ipStr)
+	if info, found := cache.get(ipStr); found {
+		geoCacheStats.hit()
 		return info
 	}
+	geoCacheStats.miss()
 
 	record, err := geoDB.Country(ip)
 	if err != nil {
@@ -104,10 +168,63 @@ func LookupCountry(ipStr string) CountryInfo {
 		Flag: GetEmojiFlag(record.Country.IsoCode),
 	}
 
-	countryInfo[ipStr] = country
+	cache.put(ipStr, country)
 	return country
 }
 
+// GeoIPCacheStats returns the hit and miss counts of the country cache.
+func GeoIPCacheStats() CacheStats {
+	return geoCacheStats.snapshot()
+}
+
+// TopCountries ranks the countries of the hosts in the active flows by
+// number of hosts. Local and unknown addresses are skipped.
+func TopCountries(limit int) []CountryStat {
+	byISO := make(map[string]*CountryStat)
+	seen := make(map[string]bool)
+
+	count := func(ip string, bytes int) {
+		country := LookupCountry(ip)
+		if country.ISO == "" || country.ISO == "XX" || country.ISO == "LO" {
+			return
+		}
+
+		stat, exists := byISO[country.ISO]
+		if !exists {
+			stat = &CountryStat{Country: country}
+			byISO[country.ISO] = stat
+		}
+		stat.Bytes += bytes
+
+		if !seen[ip] {
+			seen[ip] = true
+			stat.Hosts++
+		}
+	}
+
+	for _, f := range ActiveFlows() {
+		count(f.Key.SrcIP, f.Bytes())
+		count(f.Key.DstIP, f.Bytes())
+	}
+
+	result := make([]CountryStat, 0, len(byISO))
+	for _, stat := range byISO {
+		result = append(result, *stat)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hosts != result[j].Hosts {
+			return result[i].Hosts > result[j].Hosts
+		}
+		return result[i].Bytes > result[j].Bytes
+	})
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
 func CleanIPString(ipStr string) string {
 	host, _, err := net.SplitHostPort(ipStr)
 	if err != nil {
@@ -140,7 +257,10 @@ func CloseGeoIP() {
 	geoDBMutex.Lock()
 	defer geoDBMutex.Unlock()
 
-	if geoDB != nil {
+	if geoDBUsers > 0 {
+		geoDBUsers--
+	}
+	if geoDBUsers == 0 && geoDB != nil {
 		geoDB.Close()
 		geoDB = nil
 	}
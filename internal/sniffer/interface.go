@@ -1,21 +1,261 @@
 package sniffer
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/gopacket/pcap"
 )
 
-func ListInterfaces() error {
+// InterfaceInfo describes a network interface as listed by
+// list-interfaces.
+type InterfaceInfo struct {
+	Index       int                `json:"index"`
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Addresses   []InterfaceAddress `json:"addresses"`
+	Flags       []string           `json:"flags"`
+	MTU         int                `json:"mtu,omitempty"`
+	LinkType    string             `json:"link_type,omitempty"`
+	// CanCapture reports whether the interface could be opened for
+	// capture; CaptureError says why not.
+	CanCapture   bool   `json:"can_capture"`
+	CaptureError string `json:"capture_error,omitempty"`
+}
+
+// InterfaceAddress is an address of an interface and its netmask.
+type InterfaceAddress struct {
+	IP        string `json:"ip"`
+	Netmask   string `json:"netmask,omitempty"`
+	PrefixLen int    `json:"prefix_len,omitempty"`
+}
+
+// pcap_if_t flags.
+const (
+	pcapIfLoopback = 0x00000001
+	pcapIfUp       = 0x00000002
+	pcapIfRunning  = 0x00000004
+	pcapIfWireless = 0x00000008
+)
+
+var interfaceFlagNames = []struct {
+	flag uint32
+	name string
+}{
+	{pcapIfUp, "up"},
+	{pcapIfLoopback, "loopback"},
+	{pcapIfRunning, "running"},
+	{pcapIfWireless, "wireless"},
+}
+
+// Interfaces returns the interfaces libpcap can see, in the order of
+// their index. Each one is briefly opened to find its link type and
+// whether we may capture on it.
+func Interfaces() ([]InterfaceInfo, error) {
 	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	infos := make([]InterfaceInfo, 0, len(devices))
+	for i, device := range devices {
+		infos = append(infos, interfaceInfo(i, device))
+	}
+	return infos, nil
+}
+
+func interfaceInfo(index int, device pcap.Interface) InterfaceInfo {
+	info := InterfaceInfo{
+		Index:       index,
+		Name:        device.Name,
+		Description: device.Description,
+		Addresses:   []InterfaceAddress{},
+		Flags:       []string{},
+	}
+
+	for _, addr := range device.Addresses {
+		a := InterfaceAddress{IP: addr.IP.String()}
+		if len(addr.Netmask) > 0 {
+			a.Netmask = net.IP(addr.Netmask).String()
+			a.PrefixLen, _ = addr.Netmask.Size()
+		}
+		info.Addresses = append(info.Addresses, a)
+	}
+
+	for _, f := range interfaceFlagNames {
+		if device.Flags&f.flag != 0 {
+			info.Flags = append(info.Flags, f.name)
+		}
+	}
+
+	// NPF device names on Windows are not known to the net package, so
+	// the MTU is left out there.
+	if iface, err := net.InterfaceByName(device.Name); err == nil {
+		info.MTU = iface.MTU
+	}
+
+	handle, err := openHandle(device.Name, CaptureOptions{SnapLen: 128, Timeout: time.Millisecond})
+	if err != nil {
+		info.CaptureError = err.Error()
+		return info
+	}
+	info.LinkType = handle.LinkType().String()
+	info.CanCapture = true
+	handle.Close()
+
+	return info
+}
+
+// ListInterfaces prints the available interfaces, as JSON when asJSON is
+// set.
+func ListInterfaces(asJSON bool) error {
+	infos, err := Interfaces()
 	if err != nil {
 		return err
 	}
 
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+
 	fmt.Println("Available Interfaces: ")
-	for i, device := range devices {
-		fmt.Printf("[%d] %s (%s)\n", i, device.Name, device.Description)
+	for _, info := range infos {
+		fmt.Printf("[%d] %s", info.Index, info.Name)
+		if info.Description != "" {
+			fmt.Printf(" (%s)", info.Description)
+		}
+		fmt.Println()
+
+		if len(info.Flags) > 0 {
+			fmt.Printf("    Flags:     %s\n", strings.Join(info.Flags, ", "))
+		}
+		if info.MTU > 0 {
+			fmt.Printf("    MTU:       %d\n", info.MTU)
+		}
+		for _, addr := range info.Addresses {
+			if addr.Netmask != "" {
+				fmt.Printf("    Address:   %s/%d (netmask %s)\n", addr.IP, addr.PrefixLen, addr.Netmask)
+			} else {
+				fmt.Printf("    Address:   %s\n", addr.IP)
+			}
+		}
+		if info.CanCapture {
+			fmt.Printf("    Link type: %s\n", info.LinkType)
+			fmt.Println("    Capture:   ok")
+		} else {
+			fmt.Printf("    Capture:   not permitted (%s)\n", info.CaptureError)
+		}
 	}
 
 	return nil
 }
+
+// interfaceDescription returns the description libpcap reports for an
+// interface, or "" when it is unknown.
+func interfaceDescription(name string) string {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return ""
+	}
+
+	for _, device := range devices {
+		if device.Name == name {
+			return device.Description
+		}
+	}
+	return ""
+}
+
+// AnyInterface stands for every interface that is up.
+const AnyInterface = "any"
+
+// ResolveInterfaces returns the interfaces to capture on. Names are used
+// as given, except numbers, which stand for the interface with that
+// index in list-interfaces, and "any", which stands for every interface
+// that is up and whose name matches one of the include patterns, if
+// there are any, and none of the exclude patterns. Patterns use
+// path.Match syntax.
+func ResolveInterfaces(names, include, exclude []string) ([]string, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %w", pattern, err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var result []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+
+	for _, name := range names {
+		if index, err := strconv.Atoi(name); err == nil {
+			resolved, err := interfaceByIndex(index)
+			if err != nil {
+				return nil, err
+			}
+			add(resolved)
+			continue
+		}
+		if name != AnyInterface {
+			add(name)
+			continue
+		}
+
+		devices, err := pcap.FindAllDevs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interfaces: %w", err)
+		}
+		for _, device := range devices {
+			if device.Name == AnyInterface || device.Flags&pcapIfUp == 0 {
+				continue
+			}
+			if matchesAny(device.Name, include, true) && !matchesAny(device.Name, exclude, false) {
+				add(device.Name)
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no interfaces to capture on")
+	}
+	return result, nil
+}
+
+// interfaceByIndex returns the name of the interface with the given index
+// in list-interfaces.
+func interfaceByIndex(index int) (string, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	if index < 0 || index >= len(devices) {
+		return "", fmt.Errorf("no interface with index %d (see list-interfaces)", index)
+	}
+	return devices[index].Name, nil
+}
+
+// matchesAny reports whether name matches one of patterns, or empty when
+// there are none.
+func matchesAny(name string, patterns []string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Console output formats.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Record types of the JSON Lines output.
+const (
+	RecordPacket    = "packet"
+	RecordAlert     = "alert"
+	RecordStats     = "stats"
+	RecordSummary   = "summary"
+	RecordFlows     = "flows"
+	RecordDNS       = "dns"
+	RecordResolvers = "resolvers"
+)
+
+// PacketRecord is a packet in the JSON Lines output.
+type PacketRecord struct {
+	Type       string       `json:"type"`
+	Timestamp  time.Time    `json:"timestamp"`
+	Protocol   string       `json:"protocol"`
+	Src        string       `json:"src"`
+	Dst        string       `json:"dst"`
+	SrcPort    int          `json:"src_port,omitempty"`
+	DstPort    int          `json:"dst_port,omitempty"`
+	Length     int          `json:"length"`
+	Interface  string       `json:"interface,omitempty"`
+	TCPFlags   *TCPFlags    `json:"tcp_flags,omitempty"`
+	SrcCountry *CountryInfo `json:"src_country,omitempty"`
+	DstCountry *CountryInfo `json:"dst_country,omitempty"`
+	SrcDomain  string       `json:"src_domain,omitempty"`
+	DstDomain  string       `json:"dst_domain,omitempty"`
+}
+
+// AlertRecord is an alert in the JSON Lines output.
+type AlertRecord struct {
+	Type string `json:"type"`
+	AnomalyAlert
+}
+
+// StatsRecord is a periodic or final stats snapshot in the JSON Lines
+// output.
+type StatsRecord struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	StatsSnapshot
+	BytesPerSecond float64 `json:"bytes_per_sec"`
+	DropRate       float64 `json:"drop_rate"`
+	ActiveFlows    int     `json:"active_flows"`
+	SavedPackets   *int    `json:"saved_packets,omitempty"`
+}
+
+// FlowsRecord lists the largest flows in the JSON Lines output.
+type FlowsRecord struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Flows     []Flow    `json:"flows"`
+}
+
+// DNSRecord is a DNS transaction in the JSON Lines output.
+type DNSRecord struct {
+	Type string `json:"type"`
+	DNSTransaction
+}
+
+// ResolversRecord holds the DNS stats of each resolver in the JSON Lines
+// output.
+type ResolversRecord struct {
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Resolvers []ResolverStats `json:"resolvers"`
+}
+
+// console writes packets, alerts and stats to stdout in the configured
+// format. In JSON mode stdout carries only records, and status messages
+// go to stderr.
+type console struct {
+	mu     sync.Mutex
+	quiet  bool
+	json   bool
+	out    io.Writer
+	status io.Writer
+	enc    *json.Encoder
+}
+
+func newConsole(cfg Config) (*console, error) {
+	c := &console{quiet: cfg.Quiet, out: os.Stdout, status: os.Stdout}
+
+	switch cfg.Output {
+	case "", OutputText:
+	case OutputJSON:
+		c.json = true
+		c.status = os.Stderr
+		c.enc = json.NewEncoder(c.out)
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", cfg.Output)
+	}
+
+	return c, nil
+}
+
+// statusf prints a status message for humans.
+func (c *console) statusf(format string, args ...any) {
+	if c.quiet {
+		return
+	}
+	fmt.Fprintf(c.status, format, args...)
+}
+
+func (c *console) write(record any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.enc.Encode(record); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing output: %v\n", err)
+	}
+}
+
+func (c *console) packet(info PacketInfo) {
+	if c.quiet {
+		return
+	}
+	if !c.json {
+		protocol := info.Protocol
+		if info.Interface != "" {
+			protocol = info.Interface + " " + protocol
+		}
+		fmt.Fprintf(c.out, "[%s] %s | %s -> %s | LEN: %d\n", info.Timestamp.Format(time.RFC3339), protocol, info.Src, info.Dst, info.Length)
+		return
+	}
+
+	record := PacketRecord{
+		Type:      RecordPacket,
+		Timestamp: info.Timestamp,
+		Protocol:  info.Protocol,
+		Src:       info.Src,
+		Dst:       info.Dst,
+		SrcPort:   info.SrcPort,
+		DstPort:   info.DstPort,
+		Length:    info.Length,
+		Interface: info.Interface,
+	}
+	if info.Protocol == "TCP" {
+		flags := info.TCPFlags
+		record.TCPFlags = &flags
+	}
+	record.SrcCountry, record.SrcDomain = resolvedHost(info.Src)
+	record.DstCountry, record.DstDomain = resolvedHost(info.Dst)
+
+	c.write(record)
+}
+
+// resolvedHost returns what is already known about an address, without
+// waiting for DNS.
+func resolvedHost(ip string) (*CountryInfo, string) {
+	if ip == "unknown" {
+		return nil, ""
+	}
+
+	var country *CountryInfo
+	if info := LookupCountry(ip); info.ISO != "XX" {
+		country = &info
+	}
+	domain, _ := cachedDomain(ip)
+	return country, domain
+}
+
+// dns writes a DNS transaction. Only the JSON output has them; the text
+// output summarizes the resolvers at the end instead.
+func (c *console) dns(tx DNSTransaction) {
+	if c.quiet || !c.json {
+		return
+	}
+	c.write(DNSRecord{Type: RecordDNS, DNSTransaction: tx})
+}
+
+func (c *console) alert(alert AnomalyAlert) {
+	if c.quiet {
+		return
+	}
+	if !c.json {
+		fmt.Fprintf(c.out, "🚨 [%s] %s\n", alert.Detector, alert.Message)
+		return
+	}
+	c.write(AlertRecord{Type: RecordAlert, AnomalyAlert: alert})
+}
+
+// stats prints the periodic stats of s; prevBytes is the byte count at
+// the previous call, interval apart.
+func (c *console) stats(s *session, prevBytes int, interval time.Duration, showFlows bool) int {
+	if c.quiet {
+		return prevBytes
+	}
+	if !c.json {
+		prevBytes = s.stats.PrintRateAndPieChart(prevBytes, interval)
+		if s.saver != nil {
+			count, _ := s.saver.GetStats()
+			fmt.Fprintf(c.out, "Saved packets: %d\n", count)
+		}
+		if showFlows {
+			printFlows(s.flows.Snapshot(), 10)
+		}
+		return prevBytes
+	}
+
+	snapshot := s.stats.Snapshot()
+	c.write(c.statsRecord(s, RecordStats, snapshot, float64(snapshot.Bytes-prevBytes)/interval.Seconds()))
+	if showFlows {
+		c.flows(s, 10)
+	}
+	return snapshot.Bytes
+}
+
+// summary prints the totals of s at the end of a capture.
+func (c *console) summary(s *session, showFlows bool) {
+	if c.quiet {
+		return
+	}
+	if !c.json {
+		fmt.Fprintln(c.out, "\ncapture finished")
+		s.stats.PrintSummary()
+		printResolvers(s.dnsLog.Resolvers(topResolverNames))
+		if showFlows {
+			printFlows(s.flows.Snapshot(), 0)
+		}
+		return
+	}
+
+	c.write(c.statsRecord(s, RecordSummary, s.stats.Snapshot(), 0))
+	if resolvers := s.dnsLog.Resolvers(topResolverNames); len(resolvers) > 0 {
+		c.write(ResolversRecord{Type: RecordResolvers, Timestamp: time.Now(), Resolvers: resolvers})
+	}
+	if showFlows {
+		c.flows(s, 0)
+	}
+}
+
+func (c *console) statsRecord(s *session, recordType string, snapshot StatsSnapshot, rate float64) StatsRecord {
+	record := StatsRecord{
+		Type:           recordType,
+		Timestamp:      time.Now(),
+		StatsSnapshot:  snapshot,
+		BytesPerSecond: rate,
+		DropRate:       snapshot.DropRate(),
+		ActiveFlows:    len(s.flows.Snapshot()),
+	}
+	if s.saver != nil {
+		count, _ := s.saver.GetStats()
+		record.SavedPackets = &count
+	}
+	return record
+}
+
+func (c *console) flows(s *session, limit int) {
+	list := s.flows.Snapshot()
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	c.write(FlowsRecord{Type: RecordFlows, Timestamp: time.Now(), Flows: list})
+}
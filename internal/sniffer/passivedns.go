@@ -0,0 +1,161 @@
+package sniffer
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// minPassiveTTL keeps names from answers with a very short TTL long
+	// enough to label the connection that usually follows them.
+	minPassiveTTL = time.Minute
+	// maxPassiveNames bounds the passive DNS table.
+	maxPassiveNames = 100000
+	// maxCNAMEChain bounds how many CNAMEs are followed back to the name
+	// that was asked for.
+	maxCNAMEChain = 16
+)
+
+// passiveName is a name learned for an address from a DNS answer.
+type passiveName struct {
+	name    string
+	expires time.Time
+}
+
+// passiveDNSTable maps addresses to the names clients looked up for them,
+// learned from the DNS responses seen on the wire. Entries expire with
+// the TTL of the answer, measured by the capture clock, so that reading
+// an old capture file works the same as a live capture.
+type passiveDNSTable struct {
+	mu    sync.Mutex
+	names map[string]passiveName
+	// clock is the latest packet timestamp seen, in Unix nanoseconds.
+	clock atomic.Int64
+}
+
+var passiveDNS = newPassiveDNSTable()
+
+func newPassiveDNSTable() *passiveDNSTable {
+	return &passiveDNSTable{names: make(map[string]passiveName)}
+}
+
+// reset forgets every name, for a new capture.
+func (t *passiveDNSTable) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names = make(map[string]passiveName)
+	t.clock.Store(0)
+}
+
+// observe advances the clock to the packet and learns the names in its
+// DNS response, if it carries one.
+func (t *passiveDNSTable) observe(info *PacketInfo) {
+	now := info.Timestamp.UnixNano()
+	for {
+		clock := t.clock.Load()
+		if now <= clock || t.clock.CompareAndSwap(clock, now) {
+			break
+		}
+	}
+
+	if info.DNS != nil {
+		t.learn(info.DNS, info.Timestamp)
+	}
+}
+
+// learn records the A and AAAA answers of a DNS response under the name
+// the client asked for, following CNAME chains back to it.
+func (t *passiveDNSTable) learn(dns *layers.DNS, at time.Time) {
+	if !dns.QR || dns.ResponseCode != layers.DNSResponseCodeNoErr {
+		return
+	}
+
+	// aliases maps the target of each CNAME back to its owner.
+	aliases := make(map[string]layers.DNSResourceRecord)
+	for _, answer := range dns.Answers {
+		if answer.Type == layers.DNSTypeCNAME {
+			aliases[dnsName(answer.CNAME)] = answer
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA || answer.IP == nil {
+			continue
+		}
+
+		name, ttl := dnsName(answer.Name), answer.TTL
+		for range maxCNAMEChain {
+			alias, ok := aliases[name]
+			if !ok {
+				break
+			}
+			name, ttl = dnsName(alias.Name), min(ttl, alias.TTL)
+		}
+		if name == "" {
+			continue
+		}
+
+		expiry := max(time.Duration(ttl)*time.Second, minPassiveTTL)
+		t.add(answer.IP.String(), passiveName{name: name, expires: at.Add(expiry)})
+	}
+}
+
+// add records a name, making room by dropping expired entries once the
+// table is full. t.mu must be held.
+func (t *passiveDNSTable) add(ip string, entry passiveName) {
+	if _, exists := t.names[ip]; !exists && len(t.names) >= maxPassiveNames {
+		t.expire()
+		if len(t.names) >= maxPassiveNames {
+			return
+		}
+	}
+	t.names[ip] = entry
+}
+
+// expire drops the entries whose TTL has run out. t.mu must be held.
+func (t *passiveDNSTable) expire() {
+	now := time.Unix(0, t.clock.Load())
+	for ip, entry := range t.names {
+		if now.After(entry.expires) {
+			delete(t.names, ip)
+		}
+	}
+}
+
+// lookup returns the name learned for ip, if it has not expired.
+func (t *passiveDNSTable) lookup(ip string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.names[ip]
+	if !ok || time.Unix(0, t.clock.Load()).After(entry.expires) {
+		return "", false
+	}
+	return entry.name, true
+}
+
+// snapshot returns the names that have not expired, by address.
+func (t *passiveDNSTable) snapshot() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Unix(0, t.clock.Load())
+	result := make(map[string]string, len(t.names))
+	for ip, entry := range t.names {
+		if !now.After(entry.expires) {
+			result[ip] = entry.name
+		}
+	}
+	return result
+}
+
+func dnsName(name []byte) string {
+	return strings.TrimSuffix(strings.ToLower(string(name)), ".")
+}
@@ -0,0 +1,304 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"log"
+	"runtime"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DefaultQueueSize is the number of packets each worker queue holds.
+const DefaultQueueSize = 1024
+
+// packetHandler processes one decoded packet on a pipeline worker and
+// returns the alerts it raised.
+type packetHandler func(packet gopacket.Packet, info *PacketInfo, w *pipelineWorker) []AnomalyAlert
+
+// pipeline spreads packets over a set of workers. Packets are sharded by
+// a hash of their flow, so the packets of one flow are always handled by
+// the same worker, in capture order. When packets are saved, a single
+// writer takes the results of the workers in the order the packets were
+// dispatched, so files keep the capture order too.
+type pipeline struct {
+	workers  []*pipelineWorker
+	linkType layers.LinkType
+	// interfaces are the interfaces of the source, indexed by the
+	// InterfaceIndex of its packets.
+	interfaces []CaptureInterface
+	// lossy drops packets when a queue is full instead of waiting. Live
+	// captures cannot be paused, so they are lossy; files are not.
+	lossy bool
+
+	handle   packetHandler
+	saver    *PacketSaver
+	recorder *TriggerRecorder
+	wg       sync.WaitGroup
+
+	// order holds the worker of each packet queued, in dispatch order,
+	// for the writer. It is nil when nothing is saved. written is closed
+	// once the writer is done.
+	order   chan *pipelineWorker
+	written chan struct{}
+}
+
+type pipelineWorker struct {
+	queue chan gopacket.Packet
+	// results holds the packets handled, with the alerts they raised,
+	// until the writer takes them.
+	results chan pipelineResult
+	// decoders has a decoder for each interface of the source, or a
+	// single one when it has none.
+	decoders []*PacketDecoder
+	// shard and flows are the stats and flow table shards the worker
+	// counts into.
+	shard *statsShard
+	flows *flowShard
+}
+
+type pipelineResult struct {
+	packet gopacket.Packet
+	alerts []AnomalyAlert
+}
+
+// newPipeline starts the workers for packets from src, counting them in
+// the stats of s and saving them with its saver and recorder.
+func newPipeline(cfg Config, src PacketSource, s *session, handle packetHandler) *pipeline {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	_, live := src.(CaptureStatsSource)
+	p := &pipeline{
+		linkType:   src.LinkType(),
+		interfaces: interfacesOf(src),
+		lossy:      live,
+		handle:     handle,
+		saver:      s.saver,
+		recorder:   s.recorder,
+	}
+
+	s.stats.setInterfaces(interfaceNames(src))
+
+	if p.saver != nil || p.recorder != nil {
+		// Room for every packet a worker can hold: those queued, those
+		// waiting for the writer and the one in hand. Queuing a packet
+		// therefore never waits for the order to have room.
+		p.order = make(chan *pipelineWorker, workers*(2*queueSize+1))
+		p.written = make(chan struct{})
+		go p.write()
+	}
+
+	for range workers {
+		w := &pipelineWorker{
+			queue: make(chan gopacket.Packet, queueSize),
+			shard: s.stats.newShard(),
+			flows: s.flows.newShard(),
+		}
+		if p.order != nil {
+			w.results = make(chan pipelineResult, queueSize)
+		}
+		if len(p.interfaces) == 0 {
+			w.decoders = []*PacketDecoder{NewPacketDecoder(p.linkType)}
+		}
+		for i, iface := range p.interfaces {
+			d := NewPacketDecoder(iface.LinkType)
+			d.iface, d.ifaceIndex = iface.Name, i
+			w.decoders = append(w.decoders, d)
+		}
+		p.workers = append(p.workers, w)
+
+		p.wg.Add(1)
+		go p.work(w)
+	}
+
+	return p
+}
+
+// dispatch queues a packet on the worker of its flow. It reports false
+// when the packet was dropped because the queue was full.
+func (p *pipeline) dispatch(packet gopacket.Packet) bool {
+	w := p.workers[0]
+	if len(p.workers) > 1 {
+		hash := flowHash(packet.Data(), p.linkTypeOf(packet), packet.Metadata().InterfaceIndex)
+		w = p.workers[hash%uint64(len(p.workers))]
+	}
+
+	if !p.lossy {
+		w.queue <- packet
+	} else {
+		select {
+		case w.queue <- packet:
+		default:
+			w.shard.drop(packet.Metadata().InterfaceIndex)
+			return false
+		}
+	}
+
+	if p.order != nil {
+		p.order <- w
+	}
+	return true
+}
+
+// close waits for the workers to finish the packets already queued, and
+// for the writer to save them.
+func (p *pipeline) close() {
+	for _, w := range p.workers {
+		close(w.queue)
+	}
+	p.wg.Wait()
+
+	if p.order != nil {
+		close(p.order)
+		<-p.written
+	}
+}
+
+// linkTypeOf returns the link type of the interface packet came from.
+func (p *pipeline) linkTypeOf(packet gopacket.Packet) layers.LinkType {
+	if i := packet.Metadata().InterfaceIndex; i >= 0 && i < len(p.interfaces) {
+		return p.interfaces[i].LinkType
+	}
+	return p.linkType
+}
+
+func (p *pipeline) work(w *pipelineWorker) {
+	defer p.wg.Done()
+
+	for packet := range w.queue {
+		decoder := w.decoders[0]
+		if i := packet.Metadata().InterfaceIndex; i >= 0 && i < len(w.decoders) {
+			decoder = w.decoders[i]
+		}
+		info := decoder.Decode(packet)
+		w.shard.count(&info, decoder.ifaceIndex)
+		passiveDNS.observe(&info)
+
+		alerts := p.handle(packet, &info, w)
+		if w.results != nil {
+			w.results <- pipelineResult{packet: packet, alerts: alerts}
+		}
+	}
+}
+
+// write saves the packets handled by the workers in dispatch order, and
+// starts the captures their alerts trigger. The results of each worker
+// come in the order of its queue, so the next one of the worker a packet
+// was dispatched to is that packet.
+func (p *pipeline) write() {
+	defer close(p.written)
+
+	for w := range p.order {
+		result := <-w.results
+		comments := alertComments(result.alerts)
+		if p.saver != nil {
+			if err := p.saver.SaveAnnotatedPacket(result.packet, comments...); err != nil {
+				log.Printf("error saving packet: %v", err)
+			}
+		}
+		p.recorder.Add(result.packet, comments...)
+		for _, alert := range result.alerts {
+			p.recorder.Trigger(alert)
+		}
+	}
+}
+
+// flowHash hashes the addresses, protocol and ports of a raw packet and
+// the index of the interface it was captured on, without decoding it.
+// Both directions of a flow hash to the same value; packets that are
+// not IP hash to 0.
+func flowHash(data []byte, linkType layers.LinkType, iface int) uint64 {
+	ip, ok := ipHeader(data, linkType)
+	if !ok || len(ip) == 0 {
+		return 0
+	}
+
+	var src, dst, transport []byte
+	var proto byte
+	switch ip[0] >> 4 {
+	case 4:
+		headerLen := int(ip[0]&0x0f) * 4
+		if len(ip) < 20 || headerLen < 20 || len(ip) < headerLen {
+			return 0
+		}
+		proto, src, dst = ip[9], ip[12:16], ip[16:20]
+		// Only the first fragment carries the ports.
+		if binary.BigEndian.Uint16(ip[6:8])&0x1fff == 0 {
+			transport = ip[headerLen:]
+		}
+	case 6:
+		if len(ip) < 40 {
+			return 0
+		}
+		proto, src, dst, transport = ip[6], ip[8:24], ip[24:40], ip[40:]
+	default:
+		return 0
+	}
+
+	var srcPort, dstPort []byte
+	if (proto == byte(layers.IPProtocolTCP) || proto == byte(layers.IPProtocolUDP)) && len(transport) >= 4 {
+		srcPort, dstPort = transport[0:2], transport[2:4]
+	}
+
+	// Adding the hashes of the two endpoints makes the result the same
+	// whichever way the packet goes.
+	h := fnvHash(fnvHash(fnvOffset, src), srcPort) + fnvHash(fnvHash(fnvOffset, dst), dstPort)
+	return fnvHash(h, binary.BigEndian.AppendUint32([]byte{proto}, uint32(iface)))
+}
+
+// ipHeader returns the data of a raw packet from its IP header on.
+func ipHeader(data []byte, linkType layers.LinkType) ([]byte, bool) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, offset := binary.BigEndian.Uint16(data[12:14]), 14
+		for etherType == uint16(layers.EthernetTypeDot1Q) || etherType == uint16(layers.EthernetTypeQinQ) {
+			if len(data) < offset+4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+			offset += 4
+		}
+		if etherType != uint16(layers.EthernetTypeIPv4) && etherType != uint16(layers.EthernetTypeIPv6) {
+			return nil, false
+		}
+		return data[offset:], true
+	case layers.LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		return data[16:], true
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return data, true
+	}
+	return nil, false
+}
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// fnvHash continues an FNV-1a hash over data.
+func fnvHash(h uint64, data []byte) uint64 {
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= fnvPrime
+	}
+	return h
+}
@@ -0,0 +1,157 @@
+package sniffer
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// portScanDetector raises an alert when a source reaches more than the
+// configured number of distinct destination ports within the window.
+type portScanDetector struct {
+	ports    int
+	window   time.Duration
+	cooldown time.Duration
+	hosts    *hostTable[string, *scanActivity]
+}
+
+type scanActivity struct {
+	ports     recentSet[int]
+	types     scanTypes
+	lastSeen  time.Time
+	lastAlert time.Time
+}
+
+func (a *scanActivity) seen() time.Time {
+	return a.lastSeen
+}
+
+func newPortScanDetector(opts DetectorOptions) (Detector, error) {
+	if err := opts.checkKeys("ports", "window", "idle", "cooldown"); err != nil {
+		return nil, err
+	}
+
+	ports, err := opts.Int("ports", 50)
+	if err != nil {
+		return nil, err
+	}
+	window, err := opts.Duration("window", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	idle, err := opts.Duration("idle", defaultDetectorIdle)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := opts.Duration("cooldown", window)
+	if err != nil {
+		return nil, err
+	}
+
+	return &portScanDetector{
+		ports:    ports,
+		window:   window,
+		cooldown: cooldown,
+		hosts:    newHostTable[string, *scanActivity](max(idle, window)),
+	}, nil
+}
+
+func (d *portScanDetector) Name() string {
+	return "portscan"
+}
+
+func (d *portScanDetector) HandlePacket(p *PacketInfo) []AnomalyAlert {
+	if p.Protocol != "TCP" && p.Protocol != "UDP" {
+		return nil
+	}
+	shard := d.hosts.lock(p.Src, p.Timestamp)
+	defer shard.mu.Unlock()
+
+	act, ok := shard.hosts[p.Src]
+	if !ok {
+		act = &scanActivity{ports: make(recentSet[int]), types: make(scanTypes)}
+		shard.hosts[p.Src] = act
+	}
+	act.lastSeen = p.Timestamp
+	act.ports[p.DstPort] = p.Timestamp
+	act.types[scanTypeOf(p)]++
+
+	if len(act.ports) <= d.ports {
+		return nil
+	}
+
+	// Only ports contacted within the window count.
+	count := act.ports.prune(p.Timestamp, d.window)
+	if count <= d.ports || p.Timestamp.Sub(act.lastAlert) < d.cooldown {
+		return nil
+	}
+	act.lastAlert = p.Timestamp
+
+	scanType := act.types.dominant()
+	act.types = make(scanTypes)
+
+	return []AnomalyAlert{{
+		Type:     AlertPortScan,
+		Severity: SeverityMedium,
+		Message:  fmt.Sprintf("%s port scan detected from %s (%d ports in %s)", scanType, LookupDomain(p.Src), count, d.window),
+		IP:       p.Src,
+		Details: map[string]string{
+			"ports":     strconv.Itoa(count),
+			"scan_type": scanType,
+			"window":    d.window.String(),
+		},
+	}}
+}
+
+func (d *portScanDetector) HandleFlow(f *Flow) []AnomalyAlert {
+	return nil
+}
+
+func (d *portScanDetector) concurrent() {}
+
+// Scan types, named after the probes nmap sends.
+const (
+	ScanSYN  = "SYN"
+	ScanFIN  = "FIN"
+	ScanNULL = "NULL"
+	ScanXMAS = "XMAS"
+	ScanUDP  = "UDP"
+	// ScanTCP covers TCP packets that are not a typical probe, such as
+	// full connections.
+	ScanTCP = "TCP"
+)
+
+// scanTypeOf classifies a TCP or UDP packet by the kind of probe it
+// looks like.
+func scanTypeOf(p *PacketInfo) string {
+	if p.Protocol == "UDP" {
+		return ScanUDP
+	}
+
+	switch p.TCPFlags & (FlagFIN | FlagSYN | FlagRST | FlagPSH | FlagACK | FlagURG) {
+	case FlagSYN:
+		return ScanSYN
+	case FlagFIN:
+		return ScanFIN
+	case 0:
+		return ScanNULL
+	case FlagFIN | FlagPSH | FlagURG:
+		return ScanXMAS
+	}
+	return ScanTCP
+}
+
+// scanTypes counts the packets of a scan by type.
+type scanTypes map[string]int
+
+// dominant returns the most common scan type, preferring the more
+// specific probe types on a tie.
+func (t scanTypes) dominant() string {
+	best := ScanSYN
+	for _, scanType := range []string{ScanFIN, ScanNULL, ScanXMAS, ScanUDP, ScanTCP} {
+		if t[scanType] > t[best] {
+			best = scanType
+		}
+	}
+	return best
+}
@@ -3,6 +3,8 @@ package sniffer
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
 )
@@ -18,7 +20,25 @@ func renderStats(total int, rate float64) string {
 		Render(fmt.Sprintf("📦 Packets: %d | ⚡ Rate: %.2f bytes/s", total, rate))
 }
 
-func renderChart(s *Stats) string {
+// renderDrops shows the drop counters of live captures. It turns red when
+// the recent drop rate is above the warning threshold.
+func renderDrops(s StatsSnapshot, recentRate, threshold float64) string {
+	if s.KernelReceived == 0 && s.Dropped() == 0 {
+		return ""
+	}
+
+	color, icon := lipgloss.Color("10"), "📥"
+	if threshold > 0 && recentRate > threshold {
+		color, icon = lipgloss.Color("9"), "⚠️"
+	}
+	return lipgloss.NewStyle().
+		Bold(true).
+		Foreground(color).
+		Render(fmt.Sprintf("%s Received: %d | Dropped: kernel %d, interface %d, queue %d (%.2f%%, now %.2f%%)",
+			icon, s.KernelReceived, s.KernelDropped, s.InterfaceDropped, s.QueueDropped, s.DropRate(), recentRate))
+}
+
+func renderChart(s StatsSnapshot) string {
 	total := float64(s.Total)
 	if total == 0 {
 		return "No traffic yet."
@@ -48,10 +68,128 @@ func renderBar(label string, percent float64) string {
 	)
 }
 
-func renderLogs(entries []packetEntry) string {
+// renderInterfaces shows the traffic of each interface when capturing on
+// more than one.
+func renderInterfaces(ifaces []InterfaceStats) string {
+	if len(ifaces) < 2 {
+		return ""
+	}
+
+	ifaceStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(lipgloss.Color("14")).
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("14")).
+		Padding(0, 1)
+
+	content := "🔌 Interfaces:\n"
+	for _, iface := range ifaces {
+		content += fmt.Sprintf("- %s: %d pkts / %d bytes, dropped %d\n",
+			iface.Name, iface.Packets, iface.Bytes, iface.KernelDropped+iface.InterfaceDropped+iface.QueueDropped)
+	}
+	return ifaceStyle.Render(content)
+}
+
+func renderLogs(entries []PacketEntry) string {
 	logBlock := "🧾 Recent Packets\n"
 	for _, e := range entries {
-		logBlock += fmt.Sprintf("[%s] %s | %s → %s (%d bytes)\n", e.Timestamp, e.Protocol, e.Src, e.Dst, e.Length)
+		protocol := e.Protocol
+		if e.Interface != "" {
+			protocol = e.Interface + " " + protocol
+		}
+		logBlock += fmt.Sprintf("[%s] %s | %s → %s (%d bytes)\n", e.Timestamp, protocol, e.Src, e.Dst, e.Length)
+	}
+	return logBlock
+}
+
+func renderFlows(flowList []Flow) string {
+	if len(flowList) == 0 {
+		return ""
+	}
+
+	flowStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(lipgloss.Color("13")).
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("13")).
+		Padding(0, 1)
+
+	content := fmt.Sprintf("🔗 Top Flows (%d active):\n", len(flowList))
+	for i, f := range flowList {
+		if i >= 5 {
+			break
+		}
+		content += fmt.Sprintf("- %s [%s] %d pkts / %d bytes",
+			f.Key, f.State, f.Packets(), f.Bytes())
+		if f.Key.Interface != "" {
+			content += " on " + f.Key.Interface
+		}
+		content += "\n"
+	}
+
+	return flowStyle.Render(content)
+}
+
+// renderTabs shows the tabs of the UI, highlighting the current one.
+func renderTabs(current int) string {
+	active := lipgloss.NewStyle().Bold(true).Reverse(true).Padding(0, 1)
+	inactive := lipgloss.NewStyle().Foreground(lipgloss.Color("8")).Padding(0, 1)
+
+	tabs := make([]string, len(tabNames))
+	for i, name := range tabNames {
+		style := inactive
+		if i == current {
+			style = active
+		}
+		tabs[i] = style.Render(fmt.Sprintf("%d %s", i+1, name))
+	}
+	return lipgloss.JoinHorizontal(lipgloss.Top, tabs...) + "  (tab to switch)"
+}
+
+// renderResolvers shows the query counts, NXDOMAIN rate, latency and top
+// names of each resolver.
+func renderResolvers(resolvers []ResolverStats) string {
+	if len(resolvers) == 0 {
+		return "No DNS traffic yet."
+	}
+
+	resolverStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(lipgloss.Color("12")).
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("12")).
+		Padding(0, 1)
+
+	content := "🌐 DNS Resolvers:\n"
+	for i, r := range resolvers {
+		if i >= 5 {
+			break
+		}
+		content += fmt.Sprintf("- %s: %d queries, %d unanswered, NXDOMAIN %.1f%%, p50 %s, p99 %s\n",
+			r.Resolver, r.Queries, r.Unanswered, r.NXDomainRate,
+			r.LatencyP50.Round(time.Microsecond), r.LatencyP99.Round(time.Microsecond))
+		for _, name := range r.TopNames {
+			content += fmt.Sprintf("    %d × %s\n", name.Count, name.Name)
+		}
+	}
+
+	return resolverStyle.Render(content)
+}
+
+// renderDNSLog lists DNS transactions, newest first.
+func renderDNSLog(txs []DNSTransaction) string {
+	logBlock := "🧾 DNS Log\n"
+	for i := len(txs) - 1; i >= 0; i-- {
+		tx := txs[i]
+		result := "no response"
+		if tx.Answered {
+			result = fmt.Sprintf("%s in %s", tx.RCode, tx.Latency.Round(time.Microsecond))
+			if len(tx.Answers) > 0 {
+				result += " → " + strings.Join(tx.Answers, ", ")
+			}
+		}
+		logBlock += fmt.Sprintf("[%s] %s → %s | %s %s | %s\n",
+			tx.Timestamp.Format("15:04:05"), tx.Client, tx.Resolver, tx.QueryType, tx.Name, result)
 	}
 	return logBlock
 }
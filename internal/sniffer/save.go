@@ -6,79 +6,280 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
 )
 
+// Save file formats.
+const (
+	SaveFormatPcap   = "pcap"
+	SaveFormatPcapng = "pcapng"
+)
+
+// pcap file and record header sizes, used to track the file size.
+const (
+	pcapFileHeaderLen   = 24
+	pcapRecordHeaderLen = 16
+)
+
+// Rotation controls when a PacketSaver starts a new file, like tcpdump's
+// -C, -G and -W options. The zero value writes a single file.
+type Rotation struct {
+	// MaxSize starts a new file before one would grow beyond this many
+	// bytes.
+	MaxSize int64
+	// Interval starts a new file once the current one spans this long,
+	// measured by packet timestamps.
+	Interval time.Duration
+	// MaxFiles keeps only this many of the most recent files, deleting
+	// older ones.
+	MaxFiles int
+}
+
+func (r Rotation) enabled() bool {
+	return r.MaxSize > 0 || r.Interval > 0
+}
+
+// SaveOptions describes the files written by a PacketSaver.
+type SaveOptions struct {
+	SnapLen    int
+	MaxPackets int
+	Rotation   Rotation
+
+	// Format is SaveFormatPcap or SaveFormatPcapng. When empty, names
+	// ending in .pcapng get pcapng and everything else pcap.
+	Format   string
+	LinkType layers.LinkType
+	// Nanoseconds writes pcap files with nanosecond timestamps. pcapng
+	// files always have them.
+	Nanoseconds bool
+
+	// Interfaces are the interfaces packets come from, indexed by their
+	// InterfaceIndex. pcapng files describe each of them with its own
+	// link type; without them, they describe a single interface named
+	// Interface, of LinkType. pcap files need them all to have LinkType.
+	Interfaces []CaptureInterface
+
+	// Interface, Description and Filter describe the capture in pcapng
+	// files.
+	Interface   string
+	Description string
+	Filter      string
+}
+
 type PacketSaver struct {
-	handle     *pcap.Handle
-	dumper     *pcapgo.Writer
-	file       *os.File
-	filename   string
-	count      int
-	maxPackets int
-	mu         sync.Mutex
+	out      *saveFile
+	pattern  string
+	filename string
+	base     string
+	seq      int
+	opts     SaveOptions
+	files    []string
+	count    int
+	mu       sync.Mutex
 }
 
 func NewPacketSaver(filename string, snapLen int, maxPackets int) (*PacketSaver, error) {
-	dir := filepath.Dir(filename)
-	if dir != "." {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create directory for pcap file: %w", err)
+	return NewRotatingPacketSaver(filename, snapLen, maxPackets, Rotation{})
+}
+
+// NewRotatingPacketSaver saves Ethernet packets to rotating pcap files.
+// See NewPacketSaverWithOptions.
+func NewRotatingPacketSaver(pattern string, snapLen int, maxPackets int, rotation Rotation) (*PacketSaver, error) {
+	return NewPacketSaverWithOptions(pattern, SaveOptions{
+		SnapLen:    snapLen,
+		MaxPackets: maxPackets,
+		Rotation:   rotation,
+		LinkType:   layers.LinkTypeEthernet,
+	})
+}
+
+// NewPacketSaverWithOptions saves packets to files named by pattern,
+// which may contain strftime-style directives (%Y, %m, %d, %H, %M, %S,
+// %j, %s) that are filled in from the first packet of each file. When a
+// new file would get the same name as the previous one a sequence number
+// is added before the extension.
+func NewPacketSaverWithOptions(pattern string, opts SaveOptions) (*PacketSaver, error) {
+	if opts.Format == "" {
+		opts.Format = SaveFormatPcap
+		if strings.EqualFold(filepath.Ext(pattern), ".pcapng") {
+			opts.Format = SaveFormatPcapng
 		}
 	}
+	if opts.Format != SaveFormatPcap && opts.Format != SaveFormatPcapng {
+		return nil, fmt.Errorf("unsupported save format %q", opts.Format)
+	}
+	if err := checkLinkTypes(opts.Format, opts.Interfaces); err != nil {
+		return nil, err
+	}
 
-	f, err := os.Create(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create pcap file: %w", err)
+	ps := &PacketSaver{
+		pattern: pattern,
+		opts:    opts,
 	}
 
-	w := pcapgo.NewWriter(f)
-	err = w.WriteFileHeader(uint32(snapLen), layers.LinkTypeEthernet)
+	if !opts.Rotation.enabled() && !strings.Contains(pattern, "%") {
+		// Create the file up front so that a bad path is reported
+		// before the capture starts.
+		if err := ps.rotate(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return ps, nil
+}
+
+// newPacketSaver creates the packet saver described by cfg for packets
+// from src.
+func newPacketSaver(cfg Config, src PacketSource) (*PacketSaver, error) {
+	opts := SaveOptions{
+		SnapLen:    snapLenOf(src),
+		MaxPackets: cfg.MaxPackets,
+		Rotation: Rotation{
+			MaxSize:  cfg.RotateSize,
+			Interval: cfg.RotateInterval,
+			MaxFiles: cfg.RotateFiles,
+		},
+		Format:      cfg.SaveFormat,
+		LinkType:    src.LinkType(),
+		Nanoseconds: cfg.TimestampPrecision == TimestampNano,
+		Interfaces:  interfacesOf(src),
+		Filter:      cfg.Filter,
+	}
+	if len(opts.Interfaces) == 0 && cfg.ReadFile == "" && len(cfg.Interfaces) == 1 {
+		opts.Interface = cfg.Interfaces[0]
+		opts.Description = interfaceDescription(opts.Interface)
+	}
+
+	return NewPacketSaverWithOptions(cfg.SaveFile, opts)
+}
+
+// checkLinkTypes reports an error when interfaces of different link
+// types are to be saved in format, which only pcapng files can hold.
+func checkLinkTypes(format string, ifaces []CaptureInterface) error {
+	if format == SaveFormatPcapng {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.LinkType != ifaces[0].LinkType {
+			return fmt.Errorf("cannot save %s (%s) and %s (%s) to one %s file: their link types differ",
+				ifaces[0].Name, ifaces[0].LinkType, iface.Name, iface.LinkType, format)
+		}
+	}
+	return nil
+}
+
+// rotate opens the next file for a packet captured at ts and closes the
+// current one. If the next file cannot be created the current one is
+// kept, so that no packets are lost.
+func (ps *PacketSaver) rotate(ts time.Time) error {
+	filename := expandFilename(ps.pattern, ts)
+	seq := 0
+	if filename == ps.base {
+		seq = ps.seq + 1
+	}
+	name := filename
+	if seq > 0 {
+		ext := filepath.Ext(filename)
+		name = strings.TrimSuffix(filename, ext) + "." + strconv.Itoa(seq) + ext
+	}
+
+	next, err := createSaveFile(name, ts, ps.opts)
 	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+		return err
 	}
 
-	return &PacketSaver{
-		file:       f,
-		dumper:     w,
-		filename:   filename,
-		maxPackets: maxPackets,
-	}, nil
+	if ps.out != nil {
+		if err := ps.out.close(); err != nil {
+			log.Printf("error closing %s: %v", ps.out.name, err)
+		}
+	}
+	ps.out = next
+	ps.filename = name
+	ps.base, ps.seq = filename, seq
+	ps.files = append(ps.files, name)
+
+	if ps.opts.Rotation.MaxFiles > 0 {
+		for len(ps.files) > ps.opts.Rotation.MaxFiles {
+			if err := os.Remove(ps.files[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("error removing old capture file: %v", err)
+			}
+			ps.files = ps.files[1:]
+		}
+	}
+
+	return nil
+}
+
+// needsRotation reports whether a record of recordLen bytes captured at
+// ts belongs in a new file. A file always receives at least one packet.
+func (ps *PacketSaver) needsRotation(ts time.Time, recordLen int64) bool {
+	if ps.out == nil {
+		return true
+	}
+	if ps.out.packets == 0 {
+		return false
+	}
+
+	rotation := ps.opts.Rotation
+	if rotation.MaxSize > 0 && ps.out.size+recordLen > rotation.MaxSize {
+		return true
+	}
+	if rotation.Interval > 0 && ts.Sub(ps.out.opened) >= rotation.Interval {
+		return true
+	}
+	return false
 }
 
 func (ps *PacketSaver) SavePacket(packet gopacket.Packet) error {
+	return ps.SaveAnnotatedPacket(packet)
+}
+
+// SaveAnnotatedPacket saves a packet with comments. Comments are stored
+// in pcapng files and dropped from pcap files.
+func (ps *PacketSaver) SaveAnnotatedPacket(packet gopacket.Packet, comments ...string) error {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	if ps.file == nil || ps.dumper == nil {
+	if ps.pattern == "" {
 		return errors.New("packet saver is not initialized or already closed")
 	}
 
-	if ps.maxPackets > 0 && ps.count >= ps.maxPackets {
+	if ps.opts.MaxPackets > 0 && ps.count >= ps.opts.MaxPackets {
 		return nil
 	}
 
-	err := ps.dumper.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
-	if err != nil {
-		return fmt.Errorf("failed to write packet to pcap file: %w", err)
+	ci := packet.Metadata().CaptureInfo
+	data := packet.Data()
+	recordLen := recordSize(ps.opts.Format, len(data), comments)
+
+	if ps.needsRotation(ci.Timestamp, recordLen) {
+		if err := ps.rotate(ci.Timestamp); err != nil {
+			if ps.out == nil {
+				return err
+			}
+			log.Printf("error rotating capture file: %v", err)
+		}
 	}
 
+	if err := ps.out.write(ci, data, comments); err != nil {
+		return fmt.Errorf("failed to write packet to pcap file: %w", err)
+	}
+	ps.out.size += recordLen
 	ps.count++
 
-	shouldClose := ps.maxPackets > 0 && ps.count >= ps.maxPackets
+	shouldClose := ps.opts.MaxPackets > 0 && ps.count >= ps.opts.MaxPackets
 	if shouldClose {
-		if ps.file != nil {
-			_ = ps.file.Close()
-			ps.file = nil
-			ps.dumper = nil
+		if err := ps.out.close(); err != nil {
+			log.Printf("error closing %s: %v", ps.filename, err)
 		}
-		log.Printf("Reached max packet count (%d). Saved tp %s", ps.maxPackets, ps.filename)
+		ps.out = nil
+		log.Printf("Reached max packet count (%d). Saved to %s", ps.opts.MaxPackets, ps.filename)
 	}
 
 	return nil
@@ -88,21 +289,90 @@ func (ps *PacketSaver) Close() error {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	if ps.file == nil {
+	ps.pattern = ""
+	if ps.out == nil {
 		return nil
-
 	}
 
-	err := ps.file.Close()
-	ps.file = nil
-	ps.dumper = nil
+	err := ps.out.close()
+	ps.out = nil
 
 	return err
 }
 
+// GetStats returns the number of packets saved and the file currently
+// being written.
 func (ps *PacketSaver) GetStats() (int, string) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
 	return ps.count, ps.filename
 }
+
+// Files returns the capture files written so far that have not been
+// removed by rotation, oldest first.
+func (ps *PacketSaver) Files() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return append([]string(nil), ps.files...)
+}
+
+// SavedPackets returns the number of packets written by the running
+// session, and false when it is not saving packets.
+func SavedPackets() (int, bool) {
+	saver := current.Load().saver
+	if saver == nil {
+		return 0, false
+	}
+
+	count, _ := saver.GetStats()
+	return count, true
+}
+
+// expandFilename fills in the strftime-style directives of pattern.
+// Unknown directives are kept as they are.
+func expandFilename(pattern string, t time.Time) string {
+	if !strings.Contains(pattern, "%") {
+		return pattern
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+
+		i++
+		switch pattern[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(pattern[i])
+		}
+	}
+	return b.String()
+}
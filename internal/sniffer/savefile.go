@@ -0,0 +1,218 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapng block and option codes used for commented packets.
+const (
+	ngBlockEnhancedPacket = 0x00000006
+	ngOptEndOfOpt         = 0
+	ngOptComment          = 1
+	ngEPBHeaderLen        = 28
+)
+
+// saveFile is one open file of a PacketSaver.
+type saveFile struct {
+	name     string
+	file     *os.File
+	dumper   *pcapgo.Writer
+	ngDumper *pcapgo.NgWriter
+	opened   time.Time
+	size     int64
+	packets  int
+	// interfaces is the number of interfaces a pcapng file describes.
+	interfaces int
+}
+
+func createSaveFile(name string, ts time.Time, opts SaveOptions) (*saveFile, error) {
+	dir := filepath.Dir(name)
+	if dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory for pcap file: %w", err)
+		}
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap file: %w", err)
+	}
+
+	sf := &saveFile{name: name, file: f, opened: ts}
+
+	if opts.Format == SaveFormatPcapng {
+		counter := &countingWriter{w: f}
+		ifaces := ngInterfaces(opts)
+		sf.ngDumper, err = pcapgo.NewNgWriterInterface(counter, ifaces[0], pcapgo.NgWriterOptions{
+			SectionInfo: pcapgo.NgSectionInfo{
+				Hardware:    runtime.GOARCH,
+				OS:          runtime.GOOS,
+				Application: "sniff-n-fetch",
+			},
+		})
+		for _, iface := range ifaces[1:] {
+			if err != nil {
+				break
+			}
+			_, err = sf.ngDumper.AddInterface(iface)
+		}
+		if err == nil {
+			err = sf.ngDumper.Flush()
+		}
+		sf.size = counter.n
+		sf.interfaces = len(ifaces)
+	} else {
+		if opts.Nanoseconds {
+			sf.dumper = pcapgo.NewWriterNanos(f)
+		} else {
+			sf.dumper = pcapgo.NewWriter(f)
+		}
+		err = sf.dumper.WriteFileHeader(uint32(opts.SnapLen), opts.LinkType)
+		sf.size = pcapFileHeaderLen
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+
+	return sf, nil
+}
+
+// ngInterfaces returns the interface descriptions of a pcapng file.
+func ngInterfaces(opts SaveOptions) []pcapgo.NgInterface {
+	iface := pcapgo.NgInterface{
+		Name:                opts.Interface,
+		Description:         opts.Description,
+		Filter:              opts.Filter,
+		OS:                  runtime.GOOS,
+		LinkType:            opts.LinkType,
+		SnapLength:          uint32(opts.SnapLen),
+		TimestampResolution: 9,
+	}
+	if len(opts.Interfaces) == 0 {
+		return []pcapgo.NgInterface{iface}
+	}
+
+	ifaces := make([]pcapgo.NgInterface, len(opts.Interfaces))
+	for i, captured := range opts.Interfaces {
+		iface.Name, iface.LinkType = captured.Name, captured.LinkType
+		iface.Description = interfaceDescription(captured.Name)
+		ifaces[i] = iface
+	}
+	return ifaces
+}
+
+func (sf *saveFile) write(ci gopacket.CaptureInfo, data []byte, comments []string) error {
+	if sf.packets == 0 && sf.opened.IsZero() {
+		sf.opened = ci.Timestamp
+	}
+	sf.packets++
+
+	// Packets from interfaces the file does not describe, such as those
+	// read from another pcapng file, go to the first one.
+	if ci.InterfaceIndex < 0 || ci.InterfaceIndex >= sf.interfaces {
+		ci.InterfaceIndex = 0
+	}
+
+	switch {
+	case sf.dumper != nil:
+		return sf.dumper.WritePacket(ci, data)
+	case len(comments) == 0:
+		return sf.ngDumper.WritePacket(ci, data)
+	}
+
+	// NgWriter cannot attach options to packets, so commented packets
+	// are encoded here, after flushing what NgWriter has buffered.
+	if err := sf.ngDumper.Flush(); err != nil {
+		return err
+	}
+	_, err := sf.file.Write(encodeCommentedPacket(ci, data, comments))
+	return err
+}
+
+func (sf *saveFile) close() error {
+	var err error
+	if sf.ngDumper != nil {
+		err = sf.ngDumper.Flush()
+	}
+	if cerr := sf.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recordSize returns how many bytes a packet takes in a file of the
+// given format.
+func recordSize(format string, dataLen int, comments []string) int64 {
+	if format != SaveFormatPcapng {
+		return int64(pcapRecordHeaderLen + dataLen)
+	}
+
+	size := ngEPBHeaderLen + pad4(dataLen) + 4
+	if len(comments) > 0 {
+		for _, comment := range comments {
+			size += 4 + pad4(len(comment))
+		}
+		size += 4
+	}
+	return int64(size)
+}
+
+// encodeCommentedPacket builds a little-endian pcapng Enhanced Packet
+// Block for the interface of ci with one opt_comment option per comment.
+func encodeCommentedPacket(ci gopacket.CaptureInfo, data []byte, comments []string) []byte {
+	length := recordSize(SaveFormatPcapng, len(data), comments)
+	ts := uint64(ci.Timestamp.UnixNano())
+
+	b := make([]byte, 0, length)
+	b = binary.LittleEndian.AppendUint32(b, ngBlockEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ci.InterfaceIndex))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ci.Length))
+	b = appendPadded(b, data)
+
+	for _, comment := range comments {
+		b = binary.LittleEndian.AppendUint16(b, ngOptComment)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(comment)))
+		b = appendPadded(b, []byte(comment))
+	}
+	b = binary.LittleEndian.AppendUint16(b, ngOptEndOfOpt)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+
+	return binary.LittleEndian.AppendUint32(b, uint32(length))
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	return append(b, make([]byte, pad4(len(data))-len(data))...)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,44 @@
+package sniffer
+
+import "sync/atomic"
+
+// session holds the state of one capture. Run and the UI build a session
+// before they start and publish it once it is complete, so the package
+// accessors served by the API never see one half set up.
+type session struct {
+	stats    *Stats
+	flows    *FlowTable
+	dnsLog   *DNSLog
+	detector *AnomalyDetector
+	// saver and recorder are nil unless the capture saves packets.
+	saver    *PacketSaver
+	recorder *TriggerRecorder
+}
+
+// current is the running session, or the last one to run.
+var current atomic.Pointer[session]
+
+func init() {
+	current.Store(&session{
+		stats:    &Stats{},
+		flows:    NewFlowTable(DefaultFlowIdleTimeout, DefaultFlowActiveTimeout),
+		dnsLog:   NewDNSLog(),
+		detector: NewAnomalyDetector(),
+	})
+}
+
+// newSession builds the state of a capture with the flow timeouts and
+// detectors of cfg.
+func newSession(cfg Config) (*session, error) {
+	detector, err := newAnomalyDetector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		stats:    &Stats{},
+		flows:    newFlowTable(cfg),
+		dnsLog:   NewDNSLog(),
+		detector: detector,
+	}, nil
+}
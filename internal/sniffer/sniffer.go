@@ -3,149 +3,322 @@ package sniffer
 import (
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
-func Start(interfaceName, filter, saveFile string, maxPackets int) {
+// Config holds the options for a sniffing session.
+type Config struct {
+	// Interfaces are the interfaces to capture on. AnyInterface stands
+	// for every interface that is up and matches InterfaceInclude but
+	// not InterfaceExclude.
+	Interfaces       []string
+	InterfaceInclude []string
+	InterfaceExclude []string
+
+	Filter     string
+	SaveFile   string
+	MaxPackets int
+
+	// SnapLen, Promiscuous, ReadTimeout, BufferSize, ImmediateMode and
+	// TimestampSource configure the live capture handle; see
+	// CaptureOptions. TimestampPrecision is TimestampMicro or
+	// TimestampNano and sets the precision of saved pcap files.
+	SnapLen            int
+	Promiscuous        bool
+	ReadTimeout        time.Duration
+	BufferSize         int
+	ImmediateMode      bool
+	TimestampSource    string
+	TimestampPrecision string
+
+	// RotateSize, RotateInterval and RotateFiles rotate SaveFile like
+	// tcpdump -C, -G and -W. SaveFile may then contain strftime-style
+	// directives.
+	RotateSize     int64
+	RotateInterval time.Duration
+	RotateFiles    int
+	// SaveFormat is SaveFormatPcap or SaveFormatPcapng; empty chooses
+	// by the SaveFile extension.
+	SaveFormat string
+
+	// TriggerDir, when set, saves the packets around every alert to a
+	// file in this directory: TriggerBefore of history, kept in at most
+	// TriggerBuffer bytes, and TriggerAfter of what follows.
+	TriggerDir    string
+	TriggerBefore time.Duration
+	TriggerAfter  time.Duration
+	TriggerBuffer int64
+
+	// ReadFile, when set, reads packets from a pcap or pcapng file
+	// instead of capturing live on Interfaces.
+	ReadFile string
+	// Realtime replays packets read from ReadFile at their original
+	// timing instead of as fast as possible.
+	Realtime bool
+
+	// ShowFlows prints the flow table along with the periodic stats.
+	ShowFlows         bool
+	FlowIdleTimeout   time.Duration
+	FlowActiveTimeout time.Duration
+
+	// ExportCollector is the host:port of a NetFlow/IPFIX collector that
+	// receives expired flows, in the ExportFormat format.
+	ExportCollector string
+	ExportFormat    string
+
+	// Detectors lists the anomaly detectors to run; nil enables all of
+	// them. DetectorOptions configures them by detector name.
+	Detectors       []string
+	DetectorOptions map[string]DetectorOptions
+
+	// Output is the console format, OutputText or OutputJSON.
+	Output string
+	// Workers is the number of goroutines that process packets, one per
+	// CPU when zero. QueueSize is the number of packets each of them can
+	// have waiting; live captures drop packets beyond that.
+	Workers   int
+	QueueSize int
+	// DropWarnThreshold is the share of packets, in percent, that may be
+	// lost before a warning is printed; zero disables the warning.
+	DropWarnThreshold float64
+
+	// ReverseDNS looks up the PTR record of addresses that were not
+	// named by a DNS response in the capture. It is off by default, as
+	// the lookups reveal the addresses being investigated to the
+	// resolver.
+	ReverseDNS bool
+	// DNSServer is the host:port of the DNS server asked for PTR
+	// records, the system resolver when empty; port 53 is assumed when
+	// none is given. DNSTCP queries it over TCP. DNSTimeout bounds each
+	// lookup and DNSRateLimit, when positive, the lookups per second.
+	DNSServer    string
+	DNSTCP       bool
+	DNSTimeout   time.Duration
+	DNSRateLimit float64
+
+	// Quiet suppresses the per-packet and periodic console output, for
+	// headless sessions that are queried over the API instead.
+	Quiet bool
+}
+
+func Start(cfg Config) {
 	// Initialize GeoIP
 	if err := InitGeoIP(); err != nil {
 		log.Printf("warning: GeoIP initialization failed: %v", err)
 	}
 	defer CloseGeoIP()
 
-	handle, err := pcap.OpenLive(interfaceName, 1600, true, pcap.BlockForever)
+	out, err := newConsole(cfg)
 	if err != nil {
-		log.Fatalf("error opening device: %v", err)
+		log.Fatal(err)
 	}
-	defer handle.Close()
 
-	if filter != "" {
-		if err := handle.SetBPFFilter(filter); err != nil {
-			log.Fatalf("failed to apply filter: %v", err)
-		}
-		fmt.Println("applied BPF filter:", filter)
+	src, err := OpenSource(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+
+	if cfg.Filter != "" {
+		out.statusf("applied BPF filter: %s\n", cfg.Filter)
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	if cfg.ReadFile != "" {
+		out.statusf("reading packets from %s\n", cfg.ReadFile)
+	} else {
+		out.statusf("starting packet capture...\n")
+	}
+
+	if err := run(src, cfg, out, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Run feeds every packet from src through the processing pipeline and
+// returns once the source is exhausted.
+func Run(src PacketSource, cfg Config) error {
+	out, err := newConsole(cfg)
+	if err != nil {
+		return err
+	}
+	return run(src, cfg, out, nil)
+}
 
-	fmt.Println("starting packet capture...")
-	stats = &Stats{}
+// run is Run writing to out, with a stop channel; closing stop ends the
+// session before the source is exhausted.
+func run(src PacketSource, cfg Config, out *console, stop <-chan struct{}) error {
+	passiveDNS.reset()
+	configureReverseDNS(cfg)
 
-	var saver *PacketSaver
-	if saveFile != "" {
-		saver, err = NewPacketSaver(saveFile, 65536, maxPackets)
+	s, err := newSession(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.SaveFile != "" {
+		saver, err := newPacketSaver(cfg, src)
 		if err != nil {
-			log.Fatalf("failed to create packet saver: %v", err)
+			return fmt.Errorf("failed to create packet saver: %w", err)
 		}
 		defer saver.Close()
+		s.saver = saver
 
-		fmt.Printf("Saving packets to %s (max packets: %d)\n",
-			saveFile,
-			maxPackets,
+		out.statusf("Saving packets to %s (max packets: %d)\n",
+			cfg.SaveFile,
+			cfg.MaxPackets,
 		)
 	}
 
+	recorder, err := newTriggerRecorder(cfg, src)
+	if err != nil {
+		return fmt.Errorf("failed to create trigger recorder: %w", err)
+	}
+	defer recorder.Close()
+	s.recorder = recorder
+
+	current.Store(s)
+
+	clock := time.Now
+	if cfg.ReadFile != "" {
+		clock = s.flows.LastPacketTime
+	}
+	exporter, err := newExporter(cfg, clock)
+	if err != nil {
+		return err
+	}
+	if exporter != nil {
+		defer exporter.Close()
+
+		out.statusf("Exporting flows to %s (%s)\n", cfg.ExportCollector, exporter.format)
+	}
+
+	// done stops the background loops, and loops waits for those that
+	// hand over flows and DNS transactions to finish.
+	done := make(chan struct{})
+	var loops sync.WaitGroup
+
+	expired := func(flowList []Flow) {
+		for _, alert := range s.detector.HandleFlows(flowList) {
+			out.alert(alert)
+		}
+		exporter.exportFlows(flowList)
+	}
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		s.flows.expireLoop(done, cfg.ReadFile != "", expired)
+	}()
+
+	go func() {
+		defer loops.Done()
+		s.dnsLog.expireLoop(done, clock, func(txs []DNSTransaction) {
+			logDNS(out, txs...)
+		})
+	}()
+
+	go monitorDrops(s.stats, src, cfg.DropWarnThreshold, done, logDrops)
+
 	// Start stats display in a goroutine
 	go func() {
+		if cfg.Quiet {
+			return
+		}
+
 		prevBytes := 0
 		interval := 5 * time.Second
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
 		for {
-			time.Sleep(interval)
-			prevBytes = stats.PrintRateAndPieChart(prevBytes, interval)
-
-			if saver != nil {
-				count, _ := saver.GetStats()
-				fmt.Printf("Saved packets: %d\n", count)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
 			}
+			prevBytes = out.stats(s, prevBytes, interval, cfg.ShowFlows)
 		}
 	}()
 
-	for packet := range packetSource.Packets() {
-		processPacket(packet)
-
-		if saver != nil {
-			if err := saver.SavePacket(packet); err != nil {
-				log.Printf("error saving packet: %v", err)
-			}
-		}
+	handle := func(packet gopacket.Packet, info *PacketInfo, w *pipelineWorker) []AnomalyAlert {
+		return processPacket(s, info, w, out)
 	}
-}
+	pipe := newPipeline(cfg, src, s, handle)
 
-func extractPacketInfo(packet gopacket.Packet, shortTimestamp bool) (string, string, string, string, int) {
-	networkLayer := packet.NetworkLayer()
-	transportLayer := packet.TransportLayer()
+	packets := src.Packets()
+	for {
+		var packet gopacket.Packet
+		ok := true
 
-	var timestamp string
-	if shortTimestamp {
-		timestamp = packet.Metadata().Timestamp.Format("15:04:05")
-	} else {
-		timestamp = packet.Metadata().Timestamp.Format(time.RFC3339)
-	}
+		select {
+		case <-stop:
+			ok = false
+		case packet, ok = <-packets:
+		}
+		if !ok {
+			break
+		}
 
-	length := packet.Metadata().Length
+		pipe.dispatch(packet)
+	}
+	pipe.close()
 
-	var protocol, src, dst string
-	var dstPort int
+	// Stop the loops before the final hand-over, so that no flow or
+	// query is handed over twice.
+	close(done)
+	loops.Wait()
 
-	if networkLayer == nil {
-		protocol = "Other"
-		src = "unknown"
-		dst = "unknown"
+	// Flows still open at the end are handed over as if they expired;
+	// they stay in the table unless they were exported.
+	if exporter != nil {
+		expired(s.flows.Flush())
 	} else {
-		src = networkLayer.NetworkFlow().Src().String()
-		dst = networkLayer.NetworkFlow().Dst().String()
-
-		if transportLayer == nil {
-			protocol = "Other"
-		} else {
-			protocol = transportLayer.LayerType().String()
-
-			if tcpLayer, ok := transportLayer.(*layers.TCP); ok {
-				dstPort = int(tcpLayer.DstPort)
-			} else if udpLayer, ok := transportLayer.(*layers.UDP); ok {
-				dstPort = int(udpLayer.DstPort)
-			}
-
-			detector.Track(src, dstPort)
+		for _, alert := range s.detector.HandleFlows(s.flows.Snapshot()) {
+			out.alert(alert)
 		}
 	}
 
-	return timestamp, protocol, src, dst, length
-}
+	// Queries still waiting at the end will not be answered.
+	logDNS(out, s.dnsLog.Flush()...)
 
-func processPacket(packet gopacket.Packet) {
-	timestamp, protocol, src, dst, length := extractPacketInfo(packet, false)
+	// The drop counters were last polled up to a second ago.
+	pollCaptureStats(s.stats, src)
+	out.summary(s, cfg.ShowFlows)
 
-	stats.Lock()
-	stats.Total++
-	stats.Bytes += length
+	return nil
+}
 
-	switch protocol {
-	case "TCP":
-		stats.TCP++
-	case "UDP":
-		stats.UDP++
-	case "ICMPv4", "ICMPv6":
-		stats.ICMP++
-	default:
-		stats.Other++
+// processPacket runs a decoded packet through the pipeline of s on
+// worker w and returns the alerts it triggered.
+func processPacket(s *session, info *PacketInfo, w *pipelineWorker, out *console) []AnomalyAlert {
+	w.flows.update(*info)
+	alerts := s.detector.HandlePacket(info)
+	if tx, ok := s.dnsLog.Observe(info); ok {
+		logDNS(out, tx)
 	}
-	stats.Unlock()
 
-	entry := packetEntry{
-		Timestamp: timestamp,
-		Protocol:  protocol,
-		Src:       src,
-		Dst:       dst,
-		Length:    length,
+	entry := PacketEntry{
+		Timestamp: info.Timestamp.Format(time.RFC3339),
+		Protocol:  info.Protocol,
+		Src:       info.Src,
+		Dst:       info.Dst,
+		SrcPort:   info.SrcPort,
+		DstPort:   info.DstPort,
+		Length:    info.Length,
+		Interface: info.Interface,
 	}
 
-	stats.AddPacket(entry)
+	w.shard.addRecent(info.Timestamp, entry)
+	publishPacket(entry)
+
+	// Alerts are written here rather than through a subscription, so
+	// that none are lost and each follows the packet that raised it.
+	out.packet(*info)
+	for _, alert := range alerts {
+		out.alert(alert)
+	}
 
-	fmt.Printf("[%s] %s | %s -> %s | LEN: %d\n", timestamp, protocol, src, dst, length)
+	return alerts
 }
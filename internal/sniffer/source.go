@@ -0,0 +1,595 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// PacketSource delivers decoded packets to the processing pipeline.
+// The channel returned by Packets is closed when the source is exhausted.
+type PacketSource interface {
+	Packets() <-chan gopacket.Packet
+	LinkType() layers.LinkType
+	Close() error
+}
+
+// CaptureStatsSource is implemented by sources that can report how many
+// packets the kernel received and dropped.
+type CaptureStatsSource interface {
+	CaptureStats() (*pcap.Stats, error)
+}
+
+// CaptureInterface is an interface a source captures on.
+type CaptureInterface struct {
+	Name     string
+	LinkType layers.LinkType
+}
+
+// InterfaceSource is implemented by sources that capture on network
+// interfaces. The CaptureInfo.InterfaceIndex of their packets is an
+// index into the list returned by Interfaces.
+type InterfaceSource interface {
+	Interfaces() []CaptureInterface
+}
+
+// interfacesOf returns the interfaces src captures on, if any.
+func interfacesOf(src PacketSource) []CaptureInterface {
+	if s, ok := src.(InterfaceSource); ok {
+		return s.Interfaces()
+	}
+	return nil
+}
+
+// interfaceNames returns the names of the interfaces src captures on.
+func interfaceNames(src PacketSource) []string {
+	var names []string
+	for _, iface := range interfacesOf(src) {
+		names = append(names, iface.Name)
+	}
+	return names
+}
+
+// interfaceStatsSource is implemented by sources that report capture
+// counters for each of their interfaces, in Interfaces order.
+type interfaceStatsSource interface {
+	interfaceCaptureStats() []pcap.Stats
+}
+
+// SnapLenSource is implemented by sources that know the snapshot length
+// their packets were captured with.
+type SnapLenSource interface {
+	SnapLen() int
+}
+
+// DefaultSnapLen is the snapshot length of live captures, and of
+// sources that do not report one.
+const DefaultSnapLen = 262144
+
+// Timestamp precisions of live captures.
+const (
+	TimestampMicro = "micro"
+	TimestampNano  = "nano"
+)
+
+// CaptureOptions configures the handle of a live capture.
+type CaptureOptions struct {
+	// SnapLen is the number of bytes kept of each packet.
+	SnapLen     int
+	Promiscuous bool
+	// Timeout is how long the kernel may buffer packets before handing
+	// them over; zero blocks until the buffer is full.
+	Timeout time.Duration
+	// BufferSize is the kernel buffer size in bytes; zero keeps the
+	// libpcap default.
+	BufferSize int
+	// Immediate delivers every packet as soon as it arrives.
+	Immediate bool
+	// TimestampSource is the libpcap name of the clock to timestamp
+	// packets with, such as "host" or "adapter"; empty keeps the default.
+	TimestampSource string
+}
+
+// captureOptions returns the capture handle settings of cfg.
+func captureOptions(cfg Config) CaptureOptions {
+	opts := CaptureOptions{
+		SnapLen:         cfg.SnapLen,
+		Promiscuous:     cfg.Promiscuous,
+		Timeout:         cfg.ReadTimeout,
+		BufferSize:      cfg.BufferSize,
+		Immediate:       cfg.ImmediateMode,
+		TimestampSource: cfg.TimestampSource,
+	}
+	if opts.SnapLen <= 0 {
+		opts.SnapLen = DefaultSnapLen
+	}
+	return opts
+}
+
+// snapLenOf returns the snapshot length of the packets from src.
+func snapLenOf(src PacketSource) int {
+	if s, ok := src.(SnapLenSource); ok && s.SnapLen() > 0 {
+		return s.SnapLen()
+	}
+	return DefaultSnapLen
+}
+
+// pcapng files start with a Section Header Block.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// OpenSource opens the packet source described by cfg: a file or stdin
+// ("-") when ReadFile is set, the live interface otherwise.
+func OpenSource(cfg Config) (PacketSource, error) {
+	switch cfg.TimestampPrecision {
+	case "", TimestampMicro, TimestampNano:
+	default:
+		return nil, fmt.Errorf("unsupported timestamp precision %q (want %s or %s)", cfg.TimestampPrecision, TimestampMicro, TimestampNano)
+	}
+
+	var src PacketSource
+	var err error
+
+	switch {
+	case cfg.ReadFile == "-":
+		src, err = NewReaderSource(os.Stdin, cfg.Filter)
+	case cfg.ReadFile != "":
+		src, err = NewFileSource(cfg.ReadFile, cfg.Filter)
+	default:
+		var names []string
+		names, err = ResolveInterfaces(cfg.Interfaces, cfg.InterfaceInclude, cfg.InterfaceExclude)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 1 {
+			src, err = NewLiveSource(names[0], cfg.Filter, captureOptions(cfg))
+		} else {
+			src, err = NewMultiSource(names, cfg.Filter, captureOptions(cfg))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ReadFile != "" && cfg.Realtime {
+		src = NewReplaySource(src)
+	}
+
+	return src, nil
+}
+
+type liveSource struct {
+	name   string
+	handle *pcap.Handle
+	source *gopacket.PacketSource
+}
+
+// NewLiveSource captures packets from a network interface through libpcap.
+func NewLiveSource(interfaceName, filter string, opts CaptureOptions) (PacketSource, error) {
+	handle, err := openHandle(interfaceName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to apply filter: %w", err)
+		}
+	}
+
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	source.DecodeOptions = sourceDecodeOptions
+
+	return &liveSource{
+		name:   interfaceName,
+		handle: handle,
+		source: source,
+	}, nil
+}
+
+// openHandle activates a capture handle on an interface with opts.
+func openHandle(interfaceName string, opts CaptureOptions) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening device: %w", err)
+	}
+	defer inactive.CleanUp()
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = pcap.BlockForever
+	}
+
+	if err := inactive.SetSnapLen(opts.SnapLen); err != nil {
+		return nil, fmt.Errorf("failed to set snapshot length: %w", err)
+	}
+	if err := inactive.SetPromisc(opts.Promiscuous); err != nil {
+		return nil, fmt.Errorf("failed to set promiscuous mode: %w", err)
+	}
+	if err := inactive.SetTimeout(timeout); err != nil {
+		return nil, fmt.Errorf("failed to set read timeout: %w", err)
+	}
+	if opts.BufferSize > 0 {
+		if err := inactive.SetBufferSize(opts.BufferSize); err != nil {
+			return nil, fmt.Errorf("failed to set buffer size: %w", err)
+		}
+	}
+	if opts.Immediate {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("failed to enable immediate mode: %w", err)
+		}
+	}
+	if opts.TimestampSource != "" {
+		source, err := pcap.TimestampSourceFromString(opts.TimestampSource)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timestamp source %q: %w", opts.TimestampSource, err)
+		}
+		if err := inactive.SetTimestampSource(source); err != nil {
+			return nil, fmt.Errorf("failed to set timestamp source %s: %w", opts.TimestampSource, err)
+		}
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("error opening device %s: %w", interfaceName, err)
+	}
+	return handle, nil
+}
+
+func (s *liveSource) Packets() <-chan gopacket.Packet {
+	return s.source.Packets()
+}
+
+func (s *liveSource) LinkType() layers.LinkType {
+	return s.handle.LinkType()
+}
+
+func (s *liveSource) SnapLen() int {
+	return s.handle.SnapLen()
+}
+
+func (s *liveSource) Interfaces() []CaptureInterface {
+	return []CaptureInterface{{Name: s.name, LinkType: s.handle.LinkType()}}
+}
+
+func (s *liveSource) CaptureStats() (*pcap.Stats, error) {
+	return s.handle.Stats()
+}
+
+func (s *liveSource) interfaceCaptureStats() []pcap.Stats {
+	cs, err := s.handle.Stats()
+	if err != nil {
+		return nil
+	}
+	return []pcap.Stats{*cs}
+}
+
+func (s *liveSource) Close() error {
+	s.handle.Close()
+	return nil
+}
+
+// multiSource merges the packets of several live sources. Each packet
+// is tagged with the index of its interface in CaptureInfo.
+type multiSource struct {
+	sources []*liveSource
+	packets chan gopacket.Packet
+}
+
+// NewMultiSource captures on several interfaces at once, opening one
+// handle per interface.
+func NewMultiSource(interfaceNames []string, filter string, opts CaptureOptions) (PacketSource, error) {
+	m := &multiSource{packets: make(chan gopacket.Packet, 1000)}
+	for _, name := range interfaceNames {
+		src, err := NewLiveSource(name, filter, opts)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.sources = append(m.sources, src.(*liveSource))
+	}
+
+	var wg sync.WaitGroup
+	for i, src := range m.sources {
+		wg.Add(1)
+		go func(index int, packets <-chan gopacket.Packet) {
+			defer wg.Done()
+			for packet := range packets {
+				packet.Metadata().InterfaceIndex = index
+				m.packets <- packet
+			}
+		}(i, src.Packets())
+	}
+	go func() {
+		wg.Wait()
+		close(m.packets)
+	}()
+
+	return m, nil
+}
+
+func (m *multiSource) Packets() <-chan gopacket.Packet {
+	return m.packets
+}
+
+// LinkType returns the link type of the first interface; the others may
+// differ, as listed by Interfaces.
+func (m *multiSource) LinkType() layers.LinkType {
+	return m.sources[0].LinkType()
+}
+
+func (m *multiSource) SnapLen() int {
+	snapLen := 0
+	for _, src := range m.sources {
+		snapLen = max(snapLen, src.SnapLen())
+	}
+	return snapLen
+}
+
+func (m *multiSource) Interfaces() []CaptureInterface {
+	var result []CaptureInterface
+	for _, src := range m.sources {
+		result = append(result, src.Interfaces()...)
+	}
+	return result
+}
+
+// CaptureStats returns the counters of all interfaces added up.
+func (m *multiSource) CaptureStats() (*pcap.Stats, error) {
+	total := &pcap.Stats{}
+	for _, src := range m.sources {
+		cs, err := src.CaptureStats()
+		if err != nil {
+			return nil, err
+		}
+		total.PacketsReceived += cs.PacketsReceived
+		total.PacketsDropped += cs.PacketsDropped
+		total.PacketsIfDropped += cs.PacketsIfDropped
+	}
+	return total, nil
+}
+
+func (m *multiSource) interfaceCaptureStats() []pcap.Stats {
+	result := make([]pcap.Stats, len(m.sources))
+	for i, src := range m.sources {
+		if cs, err := src.CaptureStats(); err == nil {
+			result[i] = *cs
+		}
+	}
+	return result
+}
+
+func (m *multiSource) Close() error {
+	for _, src := range m.sources {
+		src.Close()
+	}
+	return nil
+}
+
+type readerSource struct {
+	source   *gopacket.PacketSource
+	data     *closableDataSource
+	linkType layers.LinkType
+	snapLen  int
+	closer   io.Closer
+}
+
+// NewFileSource reads packets from a pcap or pcapng file. The format is
+// detected from the file contents.
+func NewFileSource(path, filter string) (PacketSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+
+	src, err := newReaderSource(f, filter, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// NewReaderSource reads a pcap or pcapng stream, such as stdin.
+func NewReaderSource(r io.Reader, filter string) (PacketSource, error) {
+	return newReaderSource(r, filter, nil)
+}
+
+func newReaderSource(r io.Reader, filter string, closer io.Closer) (PacketSource, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+
+	var data gopacket.PacketDataSource
+	var linkType layers.LinkType
+	var snapLen uint32
+
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcapng header: %w", err)
+		}
+		data, linkType = ng, ng.LinkType()
+		if intf, err := ng.Interface(0); err == nil {
+			snapLen = intf.SnapLength
+		}
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcap header: %w", err)
+		}
+		data, linkType, snapLen = pr, pr.LinkType(), pr.Snaplen()
+	}
+
+	if filter != "" {
+		if snapLen == 0 {
+			snapLen = 65536
+		}
+		bpf, err := pcap.NewBPF(linkType, int(snapLen), filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply filter: %w", err)
+		}
+		data = &filteredDataSource{source: data, bpf: bpf}
+	}
+
+	closable := &closableDataSource{source: data}
+	source := gopacket.NewPacketSource(closable, linkType)
+	source.DecodeOptions = sourceDecodeOptions
+
+	return &readerSource{
+		source:   source,
+		data:     closable,
+		linkType: linkType,
+		snapLen:  int(snapLen),
+		closer:   closer,
+	}, nil
+}
+
+func (s *readerSource) Packets() <-chan gopacket.Packet {
+	return s.source.Packets()
+}
+
+func (s *readerSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *readerSource) SnapLen() int {
+	return s.snapLen
+}
+
+func (s *readerSource) Close() error {
+	s.data.closed.Store(true)
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// closableDataSource reports io.EOF once its source has been closed, so
+// that the packet channel is closed instead of retrying read errors.
+type closableDataSource struct {
+	source gopacket.PacketDataSource
+	closed atomic.Bool
+}
+
+func (c *closableDataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if c.closed.Load() {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	data, ci, err := c.source.ReadPacketData()
+	if err != nil && c.closed.Load() {
+		err = io.EOF
+	}
+	return data, ci, err
+}
+
+// filteredDataSource drops packets that do not match a BPF program.
+type filteredDataSource struct {
+	source gopacket.PacketDataSource
+	bpf    *pcap.BPF
+}
+
+func (f *filteredDataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := f.source.ReadPacketData()
+		if err != nil || f.bpf.Matches(ci, data) {
+			return data, ci, err
+		}
+	}
+}
+
+type sliceSource struct {
+	packets  chan gopacket.Packet
+	linkType layers.LinkType
+}
+
+// NewSliceSource serves an in-memory list of packets, mainly for tests.
+func NewSliceSource(packets []gopacket.Packet, linkType layers.LinkType) PacketSource {
+	ch := make(chan gopacket.Packet, len(packets))
+	for _, packet := range packets {
+		ch <- packet
+	}
+	close(ch)
+
+	return &sliceSource{packets: ch, linkType: linkType}
+}
+
+func (s *sliceSource) Packets() <-chan gopacket.Packet {
+	return s.packets
+}
+
+func (s *sliceSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+type replaySource struct {
+	PacketSource
+	packets chan gopacket.Packet
+}
+
+// NewReplaySource delivers the packets of src with the same spacing as
+// their capture timestamps.
+func NewReplaySource(src PacketSource) PacketSource {
+	r := &replaySource{
+		PacketSource: src,
+		packets:      make(chan gopacket.Packet),
+	}
+
+	go func() {
+		defer close(r.packets)
+
+		var pacer replayPacer
+		for packet := range src.Packets() {
+			pacer.wait(packet.Metadata().Timestamp)
+			r.packets <- packet
+		}
+	}()
+
+	return r
+}
+
+func (r *replaySource) SnapLen() int {
+	return snapLenOf(r.PacketSource)
+}
+
+func (r *replaySource) Packets() <-chan gopacket.Packet {
+	return r.packets
+}
+
+// replayPacer delays packets so that they are delivered with the same
+// spacing as their capture timestamps.
+type replayPacer struct {
+	firstPacket time.Time
+	startedAt   time.Time
+}
+
+func (p *replayPacer) wait(ts time.Time) {
+	if p.firstPacket.IsZero() {
+		p.firstPacket = ts
+		p.startedAt = time.Now()
+		return
+	}
+
+	delay := ts.Sub(p.firstPacket) - time.Since(p.startedAt)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -2,86 +2,323 @@ package sniffer
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/gopacket/pcap"
 )
 
+// Stats counts the packets of a session. Every pipeline worker counts
+// into a shard of its own, and the shards are merged when read.
 type Stats struct {
-	Total  int
-	TCP    int
-	UDP    int
-	ICMP   int
-	Other  int
-	Bytes  int
-	recent []packetEntry
-	sync.Mutex
+	mu     sync.Mutex
+	shards []*statsShard
+	// interfaces names the interfaces of the session. capture holds the
+	// counters of their capture handles, as last polled.
+	interfaces []string
+	capture    []pcap.Stats
+}
+
+// drop counts a packet dropped from the worker queue.
+func (s *statsShard) drop(iface int) {
+	s.queueDropped.Add(1)
+	if iface >= 0 && iface < len(s.interfaces) {
+		s.interfaces[iface].queueDropped.Add(1)
+	}
+}
+
+// recentPackets is how many recent packets each shard remembers.
+const recentPackets = 10
+
+// statsShard holds the counters of one pipeline worker. Only the worker
+// updates them, apart from queueDropped, which the capture reader
+// increments when the worker's queue is full.
+type statsShard struct {
+	total        atomic.Int64
+	tcp          atomic.Int64
+	udp          atomic.Int64
+	icmp         atomic.Int64
+	other        atomic.Int64
+	bytes        atomic.Int64
+	queueDropped atomic.Int64
+	// interfaces breaks the packets down by interface index.
+	interfaces []interfaceCounters
+
+	mu     sync.Mutex
+	recent []recentPacket
+}
+
+type interfaceCounters struct {
+	packets      atomic.Int64
+	bytes        atomic.Int64
+	queueDropped atomic.Int64
+}
+
+type recentPacket struct {
+	at    time.Time
+	entry PacketEntry
+}
+
+// StatsSnapshot is a point-in-time copy of the Stats counters.
+type StatsSnapshot struct {
+	Total int `json:"total"`
+	TCP   int `json:"tcp"`
+	UDP   int `json:"udp"`
+	ICMP  int `json:"icmp"`
+	Other int `json:"other"`
+	Bytes int `json:"bytes"`
+	// QueueDropped counts packets dropped because the worker queue they
+	// were sharded to was full.
+	QueueDropped int `json:"queue_dropped"`
+	// KernelReceived, KernelDropped and InterfaceDropped are the
+	// counters of the capture handle. They stay zero when reading files.
+	KernelReceived   int `json:"kernel_received"`
+	KernelDropped    int `json:"kernel_dropped"`
+	InterfaceDropped int `json:"interface_dropped"`
+	// Interfaces breaks the counters down by interface when capturing
+	// live.
+	Interfaces []InterfaceStats `json:"interfaces,omitempty"`
+}
+
+// InterfaceStats are the counters of one capture interface.
+type InterfaceStats struct {
+	Name             string `json:"name"`
+	Packets          int    `json:"packets"`
+	Bytes            int    `json:"bytes"`
+	QueueDropped     int    `json:"queue_dropped"`
+	KernelReceived   int    `json:"kernel_received"`
+	KernelDropped    int    `json:"kernel_dropped"`
+	InterfaceDropped int    `json:"interface_dropped"`
+}
+
+// RecentPackets returns the last packets processed by the running session.
+func RecentPackets() []PacketEntry {
+	return current.Load().stats.GetRecent()
+}
+
+// CurrentStats returns a copy of the counters of the running session.
+func CurrentStats() StatsSnapshot {
+	return current.Load().stats.Snapshot()
+}
+
+// setInterfaces names the interfaces counted separately. It must be
+// called before the shards are created.
+func (s *Stats) setInterfaces(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interfaces = names
+}
+
+// newShard adds the counters of another pipeline worker.
+func (s *Stats) newShard() *statsShard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shard := &statsShard{interfaces: make([]interfaceCounters, len(s.interfaces))}
+	s.shards = append(s.shards, shard)
+	return shard
+}
+
+func (s *Stats) allShards() []*statsShard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shards
+}
+
+// Snapshot merges the counters of all workers with those of the capture
+// handle.
+func (s *Stats) Snapshot() StatsSnapshot {
+	var snapshot StatsSnapshot
+
+	s.mu.Lock()
+	shards := s.shards
+	for i, name := range s.interfaces {
+		iface := InterfaceStats{Name: name}
+		if i < len(s.capture) {
+			iface.KernelReceived = s.capture[i].PacketsReceived
+			iface.KernelDropped = s.capture[i].PacketsDropped
+			iface.InterfaceDropped = s.capture[i].PacketsIfDropped
+		}
+		snapshot.Interfaces = append(snapshot.Interfaces, iface)
+	}
+	for _, cs := range s.capture {
+		snapshot.KernelReceived += cs.PacketsReceived
+		snapshot.KernelDropped += cs.PacketsDropped
+		snapshot.InterfaceDropped += cs.PacketsIfDropped
+	}
+	s.mu.Unlock()
+
+	for _, shard := range shards {
+		for i := range shard.interfaces {
+			snapshot.Interfaces[i].Packets += int(shard.interfaces[i].packets.Load())
+			snapshot.Interfaces[i].Bytes += int(shard.interfaces[i].bytes.Load())
+			snapshot.Interfaces[i].QueueDropped += int(shard.interfaces[i].queueDropped.Load())
+		}
+		snapshot.Total += int(shard.total.Load())
+		snapshot.TCP += int(shard.tcp.Load())
+		snapshot.UDP += int(shard.udp.Load())
+		snapshot.ICMP += int(shard.icmp.Load())
+		snapshot.Other += int(shard.other.Load())
+		snapshot.Bytes += int(shard.bytes.Load())
+		snapshot.QueueDropped += int(shard.queueDropped.Load())
+	}
+	return snapshot
+}
+
+// CacheStats counts the lookups answered from a cache.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+func (c CacheStats) HitRate() float64 {
+	total := c.Hits + c.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(total)
 }
 
-var stats = &Stats{}
+type cacheCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (c *cacheCounters) hit() {
+	c.hits.Add(1)
+}
+
+func (c *cacheCounters) miss() {
+	c.misses.Add(1)
+}
 
-func (s *Stats) Update(proto string) {
-	s.Lock()
-	defer s.Unlock()
+func (c *cacheCounters) snapshot() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
 
-	s.Total++
+// count adds a decoded packet, captured on the interface with the given
+// index, to the counters.
+func (s *statsShard) count(info *PacketInfo, iface int) {
+	s.total.Add(1)
+	s.bytes.Add(int64(info.Length))
+	if iface < len(s.interfaces) {
+		s.interfaces[iface].packets.Add(1)
+		s.interfaces[iface].bytes.Add(int64(info.Length))
+	}
 
-	switch proto {
+	switch info.Protocol {
 	case "TCP":
-		s.TCP++
+		s.tcp.Add(1)
 	case "UDP":
-		s.UDP++
+		s.udp.Add(1)
 	case "ICMPv4", "ICMPv6":
-		s.ICMP++
+		s.icmp.Add(1)
 	default:
-		s.Other++
+		s.other.Add(1)
 	}
 }
 
-func (s *Stats) AddPacket(entry packetEntry) {
-	s.Lock()
-	defer s.Unlock()
+func (s *statsShard) addRecent(at time.Time, entry PacketEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(s.recent) >= 10 {
+	if len(s.recent) >= recentPackets {
 		s.recent = s.recent[1:]
 	}
-	s.recent = append(s.recent, entry)
+	s.recent = append(s.recent, recentPacket{at: at, entry: entry})
 }
 
-func (s *Stats) GetRecent() []packetEntry {
-	s.Lock()
-	defer s.Unlock()
+// GetRecent returns the last packets processed by any worker, oldest
+// first.
+func (s *Stats) GetRecent() []PacketEntry {
+	var merged []recentPacket
+	for _, shard := range s.allShards() {
+		shard.mu.Lock()
+		merged = append(merged, shard.recent...)
+		shard.mu.Unlock()
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].at.Before(merged[j].at)
+	})
+	if len(merged) > recentPackets {
+		merged = merged[len(merged)-recentPackets:]
+	}
 
-	// return a copy to avoid race conditions
-	copied := make([]packetEntry, len(s.recent))
-	copy(copied, s.recent)
-	return copied
+	entries := make([]PacketEntry, len(merged))
+	for i, p := range merged {
+		entries[i] = p.entry
+	}
+	return entries
 }
 
 func (s *Stats) PrintRateAndPieChart(prevBytes int, interval time.Duration) int {
-	s.Lock()
-	defer s.Unlock()
+	snapshot := s.Snapshot()
 
-	rate := float64(s.Bytes-prevBytes) / interval.Seconds()
-	fmt.Printf("\nStats | Total: %d | Rate: %.2f bytes/sec\n", s.Total, rate)
+	rate := float64(snapshot.Bytes-prevBytes) / interval.Seconds()
+	fmt.Printf("\nStats | Total: %d | Rate: %.2f bytes/sec\n", snapshot.Total, rate)
+	printDrops(snapshot)
+	printInterfaces(snapshot)
 
-	total := float64(s.Total)
-	if total == 0 {
-		fmt.Println("no packets yet.")
-		return s.Bytes
+	printProtocols(snapshot, "no packets yet.")
+	return snapshot.Bytes
+}
+
+func (s *Stats) PrintSummary() {
+	snapshot := s.Snapshot()
+
+	fmt.Printf("Summary | Total: %d | Bytes: %d\n", snapshot.Total, snapshot.Bytes)
+	printDrops(snapshot)
+	printInterfaces(snapshot)
+
+	printProtocols(snapshot, "no packets.")
+}
+
+// printDrops prints the drop counters of live captures, or of any
+// session that lost packets.
+func printDrops(snapshot StatsSnapshot) {
+	if snapshot.KernelReceived == 0 && snapshot.Dropped() == 0 {
+		return
 	}
+	fmt.Printf("Drops | Received: %d | Kernel: %d | Interface: %d | Queue: %d | Rate: %.2f%%\n",
+		snapshot.KernelReceived,
+		snapshot.KernelDropped,
+		snapshot.InterfaceDropped,
+		snapshot.QueueDropped,
+		snapshot.DropRate(),
+	)
+}
 
-	tcpPacket := float64(s.TCP) / total * 100
-	udpPacket := float64(s.UDP) / total * 100
-	icmpPacket := float64(s.ICMP) / total * 100
-	otherPacket := float64(s.Other) / total * 100
+// printInterfaces prints the traffic of each interface when capturing
+// on more than one.
+func printInterfaces(snapshot StatsSnapshot) {
+	if len(snapshot.Interfaces) < 2 {
+		return
+	}
+	for _, iface := range snapshot.Interfaces {
+		fmt.Printf("  %-12s Packets: %d | Bytes: %d | Dropped: %d\n",
+			iface.Name+":",
+			iface.Packets,
+			iface.Bytes,
+			iface.KernelDropped+iface.InterfaceDropped+iface.QueueDropped,
+		)
+	}
+}
 
-	printPie("TCP", tcpPacket)
-	printPie("UDP", udpPacket)
-	printPie("ICMP", icmpPacket)
-	printPie("Other", otherPacket)
+func printProtocols(snapshot StatsSnapshot, empty string) {
+	total := float64(snapshot.Total)
+	if total == 0 {
+		fmt.Println(empty)
+		return
+	}
 
-	return s.Bytes
+	printPie("TCP", float64(snapshot.TCP)/total*100)
+	printPie("UDP", float64(snapshot.UDP)/total*100)
+	printPie("ICMP", float64(snapshot.ICMP)/total*100)
+	printPie("Other", float64(snapshot.Other)/total*100)
 }
 
 func printPie(label string, percent float64) {
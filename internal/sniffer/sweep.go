@@ -0,0 +1,158 @@
+package sniffer
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// sweepDetector raises an alert when a source probes the same port on
+// more than the configured number of hosts within the window, such as
+// an SSH or SMB sweep of a subnet. Only probes count: TCP packets
+// shaped like SYN, FIN, NULL or XMAS scans and UDP packets, to hosts
+// that have not answered on the port, so that a client busy talking to
+// many servers is not taken for a sweep.
+type sweepDetector struct {
+	hosts    int
+	window   time.Duration
+	cooldown time.Duration
+	targets  *hostTable[sweepKey, *sweepActivity]
+}
+
+// sweepKey identifies a source probing one port.
+type sweepKey struct {
+	src      string
+	protocol string
+	port     int
+}
+
+type sweepActivity struct {
+	hosts recentSet[string]
+	// answered holds the hosts that replied from the port.
+	answered  map[string]bool
+	types     scanTypes
+	lastSeen  time.Time
+	lastAlert time.Time
+}
+
+func (a *sweepActivity) seen() time.Time {
+	return a.lastSeen
+}
+
+func newSweepDetector(opts DetectorOptions) (Detector, error) {
+	if err := opts.checkKeys("hosts", "window", "idle", "cooldown"); err != nil {
+		return nil, err
+	}
+
+	hosts, err := opts.Int("hosts", 20)
+	if err != nil {
+		return nil, err
+	}
+	window, err := opts.Duration("window", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	idle, err := opts.Duration("idle", defaultDetectorIdle)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := opts.Duration("cooldown", window)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sweepDetector{
+		hosts:    hosts,
+		window:   window,
+		cooldown: cooldown,
+		targets:  newHostTable[sweepKey, *sweepActivity](max(idle, window)),
+	}, nil
+}
+
+func (d *sweepDetector) Name() string {
+	return "sweep"
+}
+
+func (d *sweepDetector) HandlePacket(p *PacketInfo) []AnomalyAlert {
+	if p.Protocol != "TCP" && p.Protocol != "UDP" {
+		return nil
+	}
+	scanType := scanTypeOf(p)
+	if scanType == ScanUDP || isTCPReply(p.TCPFlags) {
+		d.answer(p)
+	}
+	if scanType == ScanTCP {
+		return nil
+	}
+
+	key := sweepKey{src: p.Src, protocol: p.Protocol, port: p.DstPort}
+	shard := d.targets.lock(key, p.Timestamp)
+	defer shard.mu.Unlock()
+
+	act, ok := shard.hosts[key]
+	if !ok {
+		act = &sweepActivity{hosts: make(recentSet[string]), answered: make(map[string]bool), types: make(scanTypes)}
+		shard.hosts[key] = act
+	}
+	act.lastSeen = p.Timestamp
+	if act.answered[p.Dst] {
+		return nil
+	}
+	act.hosts[p.Dst] = p.Timestamp
+	act.types[scanType]++
+
+	if len(act.hosts) <= d.hosts {
+		return nil
+	}
+
+	// Only hosts contacted within the window count.
+	count := act.hosts.prune(p.Timestamp, d.window)
+	if count <= d.hosts || p.Timestamp.Sub(act.lastAlert) < d.cooldown {
+		return nil
+	}
+	act.lastAlert = p.Timestamp
+
+	scanType = act.types.dominant()
+	act.types = make(scanTypes)
+
+	return []AnomalyAlert{{
+		Type:     AlertSweep,
+		Severity: SeverityMedium,
+		Message: fmt.Sprintf("%s sweep of %s port %d detected from %s (%d hosts in %s)",
+			scanType, p.Protocol, p.DstPort, LookupDomain(p.Src), count, d.window),
+		IP: p.Src,
+		Details: map[string]string{
+			"port":      strconv.Itoa(p.DstPort),
+			"protocol":  p.Protocol,
+			"hosts":     strconv.Itoa(count),
+			"scan_type": scanType,
+			"window":    d.window.String(),
+		},
+	}}
+}
+
+// answer takes the source of a reply out of the probes of the port it
+// came from.
+func (d *sweepDetector) answer(p *PacketInfo) {
+	reply := sweepKey{src: p.Dst, protocol: p.Protocol, port: p.SrcPort}
+	shard := d.targets.lock(reply, p.Timestamp)
+	defer shard.mu.Unlock()
+
+	if act, ok := shard.hosts[reply]; ok {
+		act.lastSeen = p.Timestamp
+		act.answered[p.Src] = true
+		delete(act.hosts, p.Src)
+	}
+}
+
+// isTCPReply reports whether a TCP packet with flags answers a probe: a
+// SYN-ACK from an open port or a RST from a closed one.
+func isTCPReply(flags TCPFlags) bool {
+	return flags.Has(FlagRST) || flags&(FlagSYN|FlagACK) == FlagSYN|FlagACK
+}
+
+func (d *sweepDetector) HandleFlow(f *Flow) []AnomalyAlert {
+	return nil
+}
+
+func (d *sweepDetector) concurrent() {}
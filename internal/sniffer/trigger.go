@@ -0,0 +1,231 @@
+package sniffer
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Defaults for alert-triggered captures.
+const (
+	DefaultTriggerBefore = 10 * time.Second
+	DefaultTriggerAfter  = 10 * time.Second
+	DefaultTriggerBuffer = 16 * 1000 * 1000
+)
+
+// TriggerRecorder keeps the most recent packets in memory and, when an
+// alert fires, saves them together with the packets that follow to a
+// file named after the alert.
+type TriggerRecorder struct {
+	mu        sync.Mutex
+	dir       string
+	before    time.Duration
+	after     time.Duration
+	maxBytes  int64
+	opts      SaveOptions
+	ring      []ringPacket
+	ringBytes int64
+	lastSeen  time.Time
+	active    map[triggerKey]*triggerCapture
+	// closed stops alerts raised after Close from starting captures.
+	closed bool
+}
+
+type ringPacket struct {
+	packet   gopacket.Packet
+	comments []string
+}
+
+// triggerKey identifies the capture of one alert type from one source,
+// so that repeated alerts extend a capture instead of starting another.
+type triggerKey struct {
+	alertType string
+	ip        string
+}
+
+type triggerCapture struct {
+	saver    *PacketSaver
+	filename string
+	until    time.Time
+}
+
+// NewTriggerRecorder saves captures to dir holding up to before of
+// history, limited to maxBytes of packet data, and after of packets
+// following the alert. opts sets the file format and link type.
+func NewTriggerRecorder(dir string, before, after time.Duration, maxBytes int64, opts SaveOptions) *TriggerRecorder {
+	if opts.SnapLen == 0 {
+		opts.SnapLen = DefaultSnapLen
+	}
+	opts.MaxPackets = 0
+	opts.Rotation = Rotation{}
+
+	return &TriggerRecorder{
+		dir:      dir,
+		before:   before,
+		after:    after,
+		maxBytes: maxBytes,
+		opts:     opts,
+		active:   make(map[triggerKey]*triggerCapture),
+	}
+}
+
+// newTriggerRecorder creates the recorder described by cfg, or returns
+// nil when alert-triggered captures are off.
+func newTriggerRecorder(cfg Config, src PacketSource) (*TriggerRecorder, error) {
+	if cfg.TriggerDir == "" {
+		return nil, nil
+	}
+	ifaces := interfacesOf(src)
+	if err := checkLinkTypes(cfg.SaveFormat, ifaces); err != nil {
+		return nil, err
+	}
+
+	before, after, maxBytes := cfg.TriggerBefore, cfg.TriggerAfter, cfg.TriggerBuffer
+	if before <= 0 {
+		before = DefaultTriggerBefore
+	}
+	if after <= 0 {
+		after = DefaultTriggerAfter
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultTriggerBuffer
+	}
+
+	recorder := NewTriggerRecorder(cfg.TriggerDir, before, after, maxBytes, SaveOptions{
+		SnapLen:     snapLenOf(src),
+		Format:      cfg.SaveFormat,
+		LinkType:    src.LinkType(),
+		Nanoseconds: cfg.TimestampPrecision == TimestampNano,
+		Interfaces:  ifaces,
+		Filter:      cfg.Filter,
+	})
+	return recorder, nil
+}
+
+// Add records a packet, with the comments to store alongside it, in the
+// ring and in every capture still running.
+func (r *TriggerRecorder) Add(packet gopacket.Packet, comments ...string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ts := packet.Metadata().Timestamp
+	if ts.After(r.lastSeen) {
+		r.lastSeen = ts
+	}
+
+	for key, capture := range r.active {
+		if ts.After(capture.until) {
+			r.finish(key, capture)
+			continue
+		}
+		if err := capture.saver.SaveAnnotatedPacket(packet, comments...); err != nil {
+			log.Printf("error saving triggered packet: %v", err)
+		}
+	}
+
+	r.ring = append(r.ring, ringPacket{packet: packet, comments: comments})
+	r.ringBytes += int64(len(packet.Data()))
+
+	drop := 0
+	for drop < len(r.ring)-1 {
+		oldest := r.ring[drop].packet
+		if r.ringBytes <= r.maxBytes && r.lastSeen.Sub(oldest.Metadata().Timestamp) <= r.before {
+			break
+		}
+		r.ringBytes -= int64(len(oldest.Data()))
+		r.ring[drop] = ringPacket{}
+		drop++
+	}
+	r.ring = r.ring[drop:]
+}
+
+// Trigger starts a capture for alert, beginning with the buffered
+// packets. A capture already running for the same alert type and source
+// is extended instead.
+func (r *TriggerRecorder) Trigger(alert AnomalyAlert) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	key := triggerKey{alertType: alert.Type, ip: alert.IP}
+	until := r.lastSeen.Add(r.after)
+	if capture, ok := r.active[key]; ok {
+		capture.until = until
+		return
+	}
+
+	filename := filepath.Join(r.dir, triggerFilename(alert, r.lastSeen, r.opts.Format))
+	saver, err := NewPacketSaverWithOptions(filename, r.opts)
+	if err != nil {
+		log.Printf("error starting triggered capture: %v", err)
+		return
+	}
+
+	for _, p := range r.ring {
+		if err := saver.SaveAnnotatedPacket(p.packet, p.comments...); err != nil {
+			log.Printf("error saving triggered packet: %v", err)
+		}
+	}
+
+	r.active[key] = &triggerCapture{saver: saver, filename: filename, until: until}
+}
+
+// Close finishes every running capture.
+func (r *TriggerRecorder) Close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, capture := range r.active {
+		r.finish(key, capture)
+	}
+	r.closed = true
+}
+
+func (r *TriggerRecorder) finish(key triggerKey, capture *triggerCapture) {
+	delete(r.active, key)
+
+	count, _ := capture.saver.GetStats()
+	if err := capture.saver.Close(); err != nil {
+		log.Printf("error closing triggered capture: %v", err)
+		return
+	}
+	log.Printf("Saved %d packets around %s alert from %s to %s", count, key.alertType, key.ip, capture.filename)
+}
+
+// triggerFilename names the capture of an alert after its time, type and
+// source address.
+func triggerFilename(alert AnomalyAlert, ts time.Time, format string) string {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	ext := ".pcap"
+	if format == SaveFormatPcapng {
+		ext = ".pcapng"
+	}
+
+	ip := strings.NewReplacer(":", "-", "/", "-").Replace(alert.IP)
+	if ip == "" {
+		ip = "unknown"
+	}
+	return fmt.Sprintf("%s-%s-%s%s", ts.Format("20060102-150405"), alert.Type, ip, ext)
+}
@@ -3,28 +3,29 @@ package sniffer
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 )
 
-var packetSaver *PacketSaver
-
-type packetEntry struct {
-	Timestamp string
-	Protocol  string
-	Src       string
-	Dst       string
-	Length    int
+type PacketEntry struct {
+	Timestamp string `json:"timestamp"`
+	Protocol  string `json:"protocol"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	SrcPort   int    `json:"src_port,omitempty"`
+	DstPort   int    `json:"dst_port,omitempty"`
+	Length    int    `json:"length"`
+	Interface string `json:"interface,omitempty"`
 }
 
 type model struct {
 	width         int
 	height        int
-	stats         *Stats
 	prevBytes     int
 	bytesRate     float64
 	lastUpdate    time.Time
@@ -33,106 +34,155 @@ type model struct {
 	ipCountries   map[string]CountryInfo
 	savedPackets  int
 	saveFile      string
-	quitting      bool
+	// prevStats is the snapshot of the last update, and dropRate the
+	// share of packets lost since the one before.
+	prevStats StatsSnapshot
+	dropRate  float64
+	dropWarn  float64
+	// tab is the view shown, tabOverview or tabDNS.
+	tab      int
+	quitting bool
 }
 
+const (
+	tabOverview = iota
+	tabDNS
+)
+
+var tabNames = []string{"Overview", "DNS"}
+
 type updateMsg struct{}
 
-func StartUI(interfaceName, filter, saveFile string, maxPackets int) {
+func StartUI(cfg Config) {
 	// Initialize GeoIP
 	if err := InitGeoIP(); err != nil {
 		log.Printf("warning: GeoIP initialization failed: %v", err)
 	}
 	defer CloseGeoIP()
 
-	stats = &Stats{
-		recent: make([]packetEntry, 0, 10),
+	s, err := newSession(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	m := model{
-		stats:       stats,
 		prevBytes:   0,
 		bytesRate:   0,
 		lastUpdate:  time.Now(),
 		ipDomains:   make(map[string]string),
 		ipCountries: make(map[string]CountryInfo),
+		dropWarn:    cfg.DropWarnThreshold,
 	}
 
 	p := tea.NewProgram(m, tea.WithAltScreen())
 
-	go startSniffing(interfaceName, filter, saveFile, maxPackets)
+	go startSniffing(cfg, s)
 
 	if err := p.Start(); err != nil {
 		fmt.Println("error starting UI:", err)
 	}
 }
 
-func startSniffing(interfaceName, filter, saveFile string, maxPackets int) {
-	handle, err := pcap.OpenLive(interfaceName, 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("error opening device: %v", err)
-	}
-	defer handle.Close()
+// startSniffing captures into s, which the model shows once it is
+// published.
+func startSniffing(cfg Config, s *session) {
+	configureReverseDNS(cfg)
 
-	if filter != "" {
-		if err := handle.SetBPFFilter(filter); err != nil {
-			log.Fatalf("failed to apply filter: %v", err)
-		}
+	src, err := OpenSource(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer src.Close()
 
-	if saveFile != "" {
-		packetSaver, err = NewPacketSaver(saveFile, 65536, maxPackets)
+	if cfg.SaveFile != "" {
+		s.saver, err = newPacketSaver(cfg, src)
 		if err != nil {
 			log.Fatalf("failed to create packet saver: %v", err)
 		}
-		defer packetSaver.Close()
+		defer s.saver.Close()
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	s.recorder, err = newTriggerRecorder(cfg, src)
+	if err != nil {
+		log.Fatalf("failed to create trigger recorder: %v", err)
+	}
+	defer s.recorder.Close()
 
-	for packet := range packetSource.Packets() {
-		processPacketForUI(packet)
+	current.Store(s)
 
-		if packetSaver != nil {
-			if err := packetSaver.SavePacket(packet); err != nil {
-				log.Printf("error saving packet: %v", err)
-			}
-		}
+	// done stops the background loops, and loops waits for those that
+	// hand over flows and DNS transactions to finish.
+	done := make(chan struct{})
+	var loops sync.WaitGroup
+
+	clock := time.Now
+	if cfg.ReadFile != "" {
+		clock = s.flows.LastPacketTime
+	}
+	exporter, err := newExporter(cfg, clock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if exporter != nil {
+		defer exporter.Close()
 	}
-}
 
-func processPacketForUI(packet gopacket.Packet) {
-	timestamp, protocol, src, dst, length := extractPacketInfo(packet, true)
+	go monitorDrops(s.stats, src, cfg.DropWarnThreshold, done, nil)
 
-	stats.Lock()
-	defer stats.Unlock()
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		s.flows.expireLoop(done, cfg.ReadFile != "", func(flowList []Flow) {
+			s.detector.HandleFlows(flowList)
+			exporter.exportFlows(flowList)
+		})
+	}()
 
-	stats.Total++
-	stats.Bytes += length
+	go func() {
+		defer loops.Done()
+		s.dnsLog.expireLoop(done, clock, func(txs []DNSTransaction) {
+			logDNS(nil, txs...)
+		})
+	}()
 
-	switch protocol {
-	case "TCP":
-		stats.TCP++
-	case "UDP":
-		stats.UDP++
-	case "ICMPv4", "ICMPv6":
-		stats.ICMP++
-	default:
-		stats.Other++
+	handle := func(packet gopacket.Packet, info *PacketInfo, w *pipelineWorker) []AnomalyAlert {
+		return processPacketForUI(s, info, w)
+	}
+	pipe := newPipeline(cfg, src, s, handle)
+	for packet := range src.Packets() {
+		pipe.dispatch(packet)
 	}
+	pipe.close()
 
-	entry := packetEntry{
-		Timestamp: timestamp,
-		Protocol:  protocol,
-		Src:       src,
-		Dst:       dst,
-		Length:    length,
+	// Stop the loops before the final flush, so that no query is logged
+	// twice.
+	close(done)
+	loops.Wait()
+
+	logDNS(nil, s.dnsLog.Flush()...)
+}
+
+func processPacketForUI(s *session, info *PacketInfo, w *pipelineWorker) []AnomalyAlert {
+	w.flows.update(*info)
+	alerts := s.detector.HandlePacket(info)
+	if tx, ok := s.dnsLog.Observe(info); ok {
+		logDNS(nil, tx)
 	}
 
-	if len(stats.recent) >= 10 {
-		stats.recent = stats.recent[1:]
+	entry := PacketEntry{
+		Timestamp: info.Timestamp.Format("15:04:05"),
+		Protocol:  info.Protocol,
+		Src:       info.Src,
+		Dst:       info.Dst,
+		SrcPort:   info.SrcPort,
+		DstPort:   info.DstPort,
+		Length:    info.Length,
+		Interface: info.Interface,
 	}
-	stats.recent = append(stats.recent, entry)
+	w.shard.addRecent(info.Timestamp, entry)
+	publishPacket(entry)
+
+	return alerts
 }
 
 func (m model) Init() tea.Cmd {
@@ -153,30 +203,36 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "q", "ctrl+c":
 			m.quitting = true
 			return m, tea.Quit
+		case "tab":
+			m.tab = (m.tab + 1) % len(tabNames)
+		case "1":
+			m.tab = tabOverview
+		case "2":
+			m.tab = tabDNS
 		}
 
 	case updateMsg:
+		s := current.Load()
 		now := time.Now()
 		duration := now.Sub(m.lastUpdate).Seconds()
 
-		stats.Lock()
-		currentBytes := stats.Bytes
-		stats.Unlock()
+		snapshot := s.stats.Snapshot()
+		currentBytes := snapshot.Bytes
 
 		if duration > 0 {
 			m.bytesRate = float64(currentBytes-m.prevBytes) / duration
 		}
+		m.dropRate = snapshot.since(m.prevStats).DropRate()
+		m.prevStats = snapshot
 
 		m.anomalyAlerts = GetActiveAlerts()
 
-		stats.Lock()
-		for _, packet := range stats.recent {
+		for _, packet := range s.stats.GetRecent() {
 			if packet.Src != "" && packet.Src != "unknown" {
 				if _, exists := m.ipDomains[packet.Src]; !exists {
-					domain := LookupDomain(packet.Src)
-					if domain != "unknown" && domain != "local" {
-						m.ipDomains[packet.Src] = domain
-					} else {
+					// Unknown addresses are looked up again, as a DNS
+					// response may name them later.
+					if domain := LookupDomain(packet.Src); !strings.HasPrefix(domain, "unknown") {
 						m.ipDomains[packet.Src] = domain
 					}
 				}
@@ -194,10 +250,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}
 			}
 		}
-		stats.Unlock()
 
-		if packetSaver != nil {
-			m.savedPackets, m.saveFile = packetSaver.GetStats()
+		if s.saver != nil {
+			m.savedPackets, m.saveFile = s.saver.GetStats()
 		}
 
 		m.prevBytes = currentBytes
@@ -216,19 +271,18 @@ func (m model) View() string {
 		return "Goodbye!\n"
 	}
 
-	stats.Lock()
-	total := stats.Total
-	recentPackets := make([]packetEntry, len(stats.recent))
-	copy(recentPackets, stats.recent)
-	statsCopy := &Stats{
-		Total: stats.Total,
-		TCP:   stats.TCP,
-		UDP:   stats.UDP,
-		ICMP:  stats.ICMP,
-		Other: stats.Other,
-		Bytes: stats.Bytes,
+	s := current.Load()
+	if m.tab == tabDNS {
+		return lipgloss.JoinVertical(
+			lipgloss.Left,
+			renderTabs(m.tab),
+			renderResolvers(s.dnsLog.Resolvers(3)),
+			renderDNSLog(s.dnsLog.Transactions(15)),
+		)
 	}
-	stats.Unlock()
+
+	snapshot := s.stats.Snapshot()
+	recentPackets := s.stats.GetRecent()
 
 	alertsView := ""
 	if len(m.anomalyAlerts) > 0 {
@@ -262,15 +316,20 @@ func (m model) View() string {
 
 	domainInfoView := renderDomainInfo(m.ipDomains)
 	countryInfoView := renderCountries(m.ipCountries)
+	flowsView := renderFlows(s.flows.Snapshot())
 
 	return lipgloss.JoinVertical(
 		lipgloss.Left,
-		renderStats(total, m.bytesRate),
-		renderChart(statsCopy),
+		renderTabs(m.tab),
+		renderStats(snapshot.Total, m.bytesRate),
+		renderDrops(snapshot, m.dropRate, m.dropWarn),
+		renderChart(snapshot),
+		renderInterfaces(snapshot.Interfaces),
 		saveView,
 		alertsView,
 		countryInfoView,
 		domainInfoView,
+		flowsView,
 		renderLogs(recentPackets),
 	)
 }
@@ -0,0 +1,149 @@
+package sniffer
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// windowBuckets is the number of buckets a sliding window is split into.
+// Counts are exact to within one bucket width.
+const windowBuckets = 10
+
+// slidingCounter counts events over a sliding time window. Events are
+// summed into fixed buckets so memory does not grow with the event rate.
+// Time comes from the events themselves, so offline captures are
+// measured at their original pace.
+type slidingCounter struct {
+	width   time.Duration
+	buckets [windowBuckets]int
+	head    int64
+	total   int
+}
+
+func newSlidingCounter(window time.Duration) *slidingCounter {
+	width := window / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &slidingCounter{width: width}
+}
+
+// add records n events at ts.
+func (c *slidingCounter) add(ts time.Time, n int) {
+	idx := c.advance(ts)
+	c.buckets[idx%windowBuckets] += n
+	c.total += n
+}
+
+// count returns the number of events in the window ending at ts.
+func (c *slidingCounter) count(ts time.Time) int {
+	c.advance(ts)
+	return c.total
+}
+
+// advance moves the window forward to ts, dropping expired buckets, and
+// returns the bucket index that ts falls into. Late events are counted
+// in the newest bucket.
+func (c *slidingCounter) advance(ts time.Time) int64 {
+	idx := ts.UnixNano() / int64(c.width)
+	if idx <= c.head {
+		return c.head
+	}
+
+	if idx-c.head >= windowBuckets {
+		c.buckets = [windowBuckets]int{}
+		c.total = 0
+	} else {
+		for i := c.head + 1; i <= idx; i++ {
+			c.total -= c.buckets[i%windowBuckets]
+			c.buckets[i%windowBuckets] = 0
+		}
+	}
+	c.head = idx
+	return idx
+}
+
+// hostSweeper decides when per-host detector state is due for cleanup.
+type hostSweeper struct {
+	idle      time.Duration
+	lastSweep time.Time
+}
+
+// due reports whether hosts idle for longer than s.idle should be
+// removed now.
+func (s *hostSweeper) due(now time.Time) bool {
+	interval := s.idle / 3
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	if now.Sub(s.lastSweep) < interval {
+		return false
+	}
+	s.lastSweep = now
+	return true
+}
+
+// expired reports whether a host last seen at lastSeen is idle.
+func (s *hostSweeper) expired(now, lastSeen time.Time) bool {
+	return now.Sub(lastSeen) > s.idle
+}
+
+// hostShards is the number of shards a hostTable is split into, so that
+// pipeline workers handling different hosts seldom wait for each other.
+const hostShards = 64
+
+// hostTable holds the per-host state of a detector in shards, each with
+// its own lock and cleanup schedule, so that the detector can be called
+// from every worker at once.
+type hostTable[K comparable, V interface{ seen() time.Time }] struct {
+	seed   maphash.Seed
+	shards [hostShards]hostShard[K, V]
+}
+
+type hostShard[K comparable, V interface{ seen() time.Time }] struct {
+	mu      sync.Mutex
+	hosts   map[K]V
+	sweeper hostSweeper
+}
+
+func newHostTable[K comparable, V interface{ seen() time.Time }](idle time.Duration) *hostTable[K, V] {
+	t := &hostTable[K, V]{seed: maphash.MakeSeed()}
+	for i := range t.shards {
+		t.shards[i].hosts = make(map[K]V)
+		t.shards[i].sweeper = hostSweeper{idle: idle}
+	}
+	return t
+}
+
+// lock locks and returns the shard holding key, first removing the
+// hosts of the shard idle as of now when a cleanup is due. The caller
+// unlocks it.
+func (t *hostTable[K, V]) lock(key K, now time.Time) *hostShard[K, V] {
+	s := &t.shards[maphash.Comparable(t.seed, key)%hostShards]
+	s.mu.Lock()
+
+	if s.sweeper.due(now) {
+		for k, v := range s.hosts {
+			if s.sweeper.expired(now, v.seen()) {
+				delete(s.hosts, k)
+			}
+		}
+	}
+	return s
+}
+
+// recentSet remembers when each key was last seen so that the number of
+// distinct keys within a window can be counted.
+type recentSet[K comparable] map[K]time.Time
+
+// prune removes keys not seen within window of now and returns how many
+// remain.
+func (s recentSet[K]) prune(now time.Time, window time.Duration) int {
+	for key, seen := range s {
+		if now.Sub(seen) > window {
+			delete(s, key)
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,288 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zczqas/sniff-n-fetch/internal/server"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// writeCapture writes count UDP packets from 10.0.0.1:5000 to
+// 10.0.0.2:53 to a pcap file, followed by the DNS messages given, 20ms
+// apart. Queries go the same way and responses come back.
+func writeCapture(t *testing.T, count int, messages ...*layers.DNS) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create capture file: %v", err)
+	}
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("Failed to write pcap header: %v", err)
+	}
+
+	start := time.Now()
+	write := func(i int, dns *layers.DNS) {
+		ipLayer := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    []byte{10, 0, 0, 1},
+			DstIP:    []byte{10, 0, 0, 2},
+		}
+		udpLayer := &layers.UDP{SrcPort: 5000, DstPort: 53}
+		if dns != nil && dns.QR {
+			ipLayer.SrcIP, ipLayer.DstIP = ipLayer.DstIP, ipLayer.SrcIP
+			udpLayer.SrcPort, udpLayer.DstPort = udpLayer.DstPort, udpLayer.SrcPort
+		}
+		udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+		packetLayers := []gopacket.SerializableLayer{
+			&layers.Ethernet{
+				SrcMAC:       []byte{0, 1, 2, 3, 4, 5},
+				DstMAC:       []byte{6, 7, 8, 9, 10, 11},
+				EthernetType: layers.EthernetTypeIPv4,
+			},
+			ipLayer,
+			udpLayer,
+		}
+		if dns != nil {
+			packetLayers = append(packetLayers, dns)
+		}
+
+		buffer := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, opts, packetLayers...); err != nil {
+			t.Fatalf("Failed to serialize packet: %v", err)
+		}
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * 20 * time.Millisecond),
+			CaptureLength: len(buffer.Bytes()),
+			Length:        len(buffer.Bytes()),
+		}
+		if err := w.WritePacket(ci, buffer.Bytes()); err != nil {
+			t.Fatalf("Failed to write packet: %v", err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		write(i, nil)
+	}
+	for i, dns := range messages {
+		write(count+i, dns)
+	}
+
+	return path
+}
+
+// dnsMessage returns a query for example.com, or its response with one
+// address when response is set.
+func dnsMessage(response bool) *layers.DNS {
+	dns := &layers.DNS{
+		ID:        7,
+		QR:        response,
+		RD:        true,
+		RA:        response,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+	if response {
+		dns.Answers = []layers.DNSResourceRecord{{
+			Name:  []byte("example.com"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   300,
+			IP:    []byte{93, 184, 216, 34},
+		}}
+	}
+	return dns
+}
+
+func getJSON(t *testing.T, srv http.Handler, path string, v any) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	if v != nil {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: invalid JSON: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAPI(t *testing.T) {
+	capture := sniffer.NewCapture(sniffer.Config{
+		ReadFile: writeCapture(t, 5, dnsMessage(false), dnsMessage(true)),
+		Quiet:    true,
+	})
+	srv := server.New(capture)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/capture/start", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start returned %d: %s", rec.Code, rec.Body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for capture.Status().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("capture did not finish reading the file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var stats sniffer.StatsSnapshot
+	if code := getJSON(t, srv, "/api/stats", &stats); code != http.StatusOK {
+		t.Fatalf("GET /api/stats returned %d", code)
+	}
+	if stats.Total != 7 || stats.UDP != 7 {
+		t.Errorf("stats = %+v, want 7 UDP packets", stats)
+	}
+
+	var packets []sniffer.PacketEntry
+	getJSON(t, srv, "/api/packets", &packets)
+	if len(packets) != 7 || packets[0].Src != "10.0.0.1" {
+		t.Errorf("packets = %+v, want 7 packets starting from 10.0.0.1", packets)
+	}
+
+	var flows []sniffer.Flow
+	getJSON(t, srv, "/api/flows", &flows)
+	if len(flows) != 1 || flows[0].SrcPackets != 6 || flows[0].DstPackets != 1 {
+		t.Errorf("flows = %+v, want one flow with 6 packets out and 1 back", flows)
+	}
+
+	var transactions []sniffer.DNSTransaction
+	if code := getJSON(t, srv, "/api/dns", &transactions); code != http.StatusOK {
+		t.Errorf("GET /api/dns returned %d", code)
+	}
+	if len(transactions) != 1 {
+		t.Fatalf("transactions = %+v, want 1", transactions)
+	}
+	tx := transactions[0]
+	if tx.Client != "10.0.0.1" || tx.Resolver != "10.0.0.2" || tx.Name != "example.com" || tx.QueryType != "A" {
+		t.Errorf("transaction = %+v, want an A query for example.com from 10.0.0.1 to 10.0.0.2", tx)
+	}
+	if !tx.Answered || tx.RCode != "NOERROR" || tx.Latency != 20*time.Millisecond {
+		t.Errorf("transaction = %+v, want a NOERROR answer after 20ms", tx)
+	}
+	if len(tx.Answers) != 1 || tx.Answers[0] != "A 93.184.216.34" {
+		t.Errorf("answers = %v, want [A 93.184.216.34]", tx.Answers)
+	}
+
+	var resolvers []sniffer.ResolverStats
+	if code := getJSON(t, srv, "/api/dns/resolvers", &resolvers); code != http.StatusOK {
+		t.Errorf("GET /api/dns/resolvers returned %d", code)
+	}
+	if len(resolvers) != 1 {
+		t.Fatalf("resolvers = %+v, want 1", resolvers)
+	}
+	rs := resolvers[0]
+	if rs.Resolver != "10.0.0.2" || rs.Queries != 1 || rs.Answered != 1 || rs.Unanswered != 0 || rs.NXDomain != 0 {
+		t.Errorf("resolver = %+v, want 1 answered query to 10.0.0.2", rs)
+	}
+	if rs.LatencyP50 != 20*time.Millisecond {
+		t.Errorf("resolver p50 latency = %s, want 20ms", rs.LatencyP50)
+	}
+	if len(rs.TopNames) != 1 || rs.TopNames[0] != (sniffer.NameCount{Name: "example.com", Count: 1}) {
+		t.Errorf("resolver top names = %+v, want example.com once", rs.TopNames)
+	}
+
+	var alerts []sniffer.AnomalyAlert
+	if code := getJSON(t, srv, "/api/alerts", &alerts); code != http.StatusOK {
+		t.Errorf("GET /api/alerts returned %d", code)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/capture/stop", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("stopping a finished capture returned %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	capture := sniffer.NewCapture(sniffer.Config{
+		ReadFile: writeCapture(t, 4),
+		Quiet:    true,
+	})
+	if err := capture.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for capture.Status().Running {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	server.New(capture).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics returned %d", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE sniffer_packets_total counter",
+		`sniffer_packets_total{interface="` + capture.Status().Source + `",protocol="udp"} 4`,
+		"sniffer_capture_running{",
+		"sniffer_dns_cache_hit_ratio ",
+		"sniffer_geoip_cache_hits_total ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+// interfaceSource captures on the interfaces given, like a live capture.
+type interfaceSource struct {
+	sniffer.PacketSource
+	interfaces []sniffer.CaptureInterface
+}
+
+func (s *interfaceSource) Interfaces() []sniffer.CaptureInterface {
+	return s.interfaces
+}
+
+func TestMetricsInterfaces(t *testing.T) {
+	file, err := sniffer.NewFileSource(writeCapture(t, 3), "")
+	if err != nil {
+		t.Fatalf("NewFileSource failed: %v", err)
+	}
+	src := &interfaceSource{
+		PacketSource: file,
+		interfaces:   []sniffer.CaptureInterface{{Name: "eth0", LinkType: layers.LinkTypeEthernet}},
+	}
+	if err := sniffer.Run(src, sniffer.Config{Quiet: true}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.New(sniffer.NewCapture(sniffer.Config{})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	// A single interface is broken down too, under its own name.
+	body := rec.Body.String()
+	for _, want := range []string{
+		`sniffer_interface_packets_total{interface="eth0"} 3`,
+		`sniffer_interface_bytes_total{interface="eth0"} `,
+		`sniffer_queue_dropped_packets_total{interface="eth0"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
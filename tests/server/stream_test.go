@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zczqas/sniff-n-fetch/internal/server"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func TestStream(t *testing.T) {
+	capture := sniffer.NewCapture(sniffer.Config{
+		ReadFile: writeCapture(t, 3),
+		Quiet:    true,
+	})
+	ts := httptest.NewServer(server.New(capture))
+	defer ts.Close()
+
+	filter := url.QueryEscape("type == packet and (proto == udp && dport == 53) and not host == 192.0.2.1")
+	resp, err := http.Get(ts.URL + "/api/stream?filter=" + filter)
+	if err != nil {
+		t.Fatalf("GET /api/stream failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	if err := capture.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	events := make(chan sniffer.Event)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var ev sniffer.Event
+			if err := json.Unmarshal([]byte(data), &ev); err == nil {
+				events <- ev
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-events:
+			if ev.Type != sniffer.EventPacket || ev.Packet == nil || ev.Packet.DstPort != 53 {
+				t.Errorf("event %d = %+v, want a packet to port 53", i, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d events, want 3", i)
+		}
+	}
+}
+
+func TestStreamInvalidFilter(t *testing.T) {
+	srv := server.New(sniffer.NewCapture(sniffer.Config{}))
+
+	for _, filter := range []string{"port ==", "bogus == 1", "port == http", "(proto == tcp", "src & dst"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/stream?filter="+url.QueryEscape(filter), nil)
+		srv.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("filter %q returned %d, want %d", filter, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package sniffer_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+var (
+	testSrcMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	testDstMAC = net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb}
+)
+
+// rawPacket serializes layers into a packet that has not been decoded,
+// as delivered by the packet sources.
+func rawPacket(t testing.TB, stack ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+
+	for _, l := range stack {
+		switch l := l.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(networkLayerOf(stack))
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(networkLayerOf(stack))
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, stack...); err != nil {
+		t.Fatalf("Failed to serialize packet: %v", err)
+	}
+
+	data := buffer.Bytes()
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	return packet
+}
+
+// networkLayerOf returns the innermost IP layer of a stack.
+func networkLayerOf(stack []gopacket.SerializableLayer) gopacket.NetworkLayer {
+	var network gopacket.NetworkLayer
+	for _, l := range stack {
+		if n, ok := l.(gopacket.NetworkLayer); ok {
+			network = n
+		}
+	}
+	return network
+}
+
+func ethernet(etherType layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: etherType}
+}
+
+func ipv4(protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 2},
+	}
+}
+
+func TestPacketDecoder(t *testing.T) {
+	dnsQuery := &layers.DNS{
+		ID:        1,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		packet   func(t *testing.T) gopacket.Packet
+		want     sniffer.PacketInfo
+		wantDNS  bool
+	}{
+		{
+			name:     "TCP",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				payload := gopacket.Payload("GET / HTTP/1.1\r\n\r\n")
+				return rawPacket(t, ethernet(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolTCP),
+					&layers.TCP{SrcPort: 40000, DstPort: 80, PSH: true, ACK: true}, payload)
+			},
+			want: sniffer.PacketInfo{Protocol: "TCP", Src: "10.0.0.1", Dst: "10.0.0.2", SrcPort: 40000, DstPort: 80,
+				TCPFlags: sniffer.FlagPSH | sniffer.FlagACK},
+		},
+		{
+			name:     "DNS",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ethernet(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 5353, DstPort: 53}, dnsQuery)
+			},
+			want:    sniffer.PacketInfo{Protocol: "UDP", Src: "10.0.0.1", Dst: "10.0.0.2", SrcPort: 5353, DstPort: 53},
+			wantDNS: true,
+		},
+		{
+			name:     "ICMP",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ethernet(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolICMPv4),
+					&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)})
+			},
+			want: sniffer.PacketInfo{Protocol: "ICMPv4", Src: "10.0.0.1", Dst: "10.0.0.2"},
+		},
+		{
+			name:     "VLAN",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ethernet(layers.EthernetTypeDot1Q),
+					&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+					ipv4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 1000, DstPort: 2000})
+			},
+			want: sniffer.PacketInfo{Protocol: "UDP", Src: "10.0.0.1", Dst: "10.0.0.2", SrcPort: 1000, DstPort: 2000},
+		},
+		{
+			name:     "IPv6",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ethernet(layers.EthernetTypeIPv6),
+					&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+						SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")},
+					&layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true})
+			},
+			want: sniffer.PacketInfo{Protocol: "TCP", Src: "2001:db8::1", Dst: "2001:db8::2", SrcPort: 40000, DstPort: 443,
+				TCPFlags: sniffer.FlagSYN},
+		},
+		{
+			name:     "ARP",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ethernet(layers.EthernetTypeARP), &layers.ARP{
+					AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+					HwAddressSize: 6, ProtAddressSize: 4, Operation: layers.ARPRequest,
+					SourceHwAddress: testSrcMAC, SourceProtAddress: net.IP{10, 0, 0, 1},
+					DstHwAddress: make(net.HardwareAddr, 6), DstProtAddress: net.IP{10, 0, 0, 2},
+				})
+			},
+			want: sniffer.PacketInfo{Protocol: "ARP", Src: "unknown", Dst: "unknown"},
+		},
+		{
+			name:     "raw IP link",
+			linkType: layers.LinkTypeRaw,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ipv4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 1000, DstPort: 2000})
+			},
+			want: sniffer.PacketInfo{Protocol: "UDP", Src: "10.0.0.1", Dst: "10.0.0.2", SrcPort: 1000, DstPort: 2000},
+		},
+		{
+			// GRE has no fast path, so the packet is decoded generically.
+			name:     "fallback",
+			linkType: layers.LinkTypeEthernet,
+			packet: func(t *testing.T) gopacket.Packet {
+				return rawPacket(t, ethernet(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolGRE),
+					&layers.GRE{Protocol: layers.EthernetTypeIPv4}, ipv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 1000, DstPort: 2000})
+			},
+			want: sniffer.PacketInfo{Protocol: "UDP", Src: "10.0.0.1", Dst: "10.0.0.2", SrcPort: 1000, DstPort: 2000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := tt.packet(t)
+			got := sniffer.NewPacketDecoder(tt.linkType).Decode(packet)
+
+			if (got.DNS != nil) != tt.wantDNS {
+				t.Errorf("DNS = %v, want DNS layer %v", got.DNS, tt.wantDNS)
+			}
+			if got.Length != packet.Metadata().Length {
+				t.Errorf("Length = %d, want %d", got.Length, packet.Metadata().Length)
+			}
+
+			got.DNS, got.Timestamp, got.Length = nil, time.Time{}, 0
+			if got != tt.want {
+				t.Errorf("Decode = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func benchmarkPacket(b *testing.B) []byte {
+	return rawPacket(b, ethernet(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolTCP),
+		&layers.TCP{SrcPort: 40000, DstPort: 443, ACK: true},
+		gopacket.Payload(make([]byte, 1200))).Data()
+}
+
+func BenchmarkDecodeFastPath(b *testing.B) {
+	data := benchmarkPacket(b)
+	decoder := sniffer.NewPacketDecoder(layers.LinkTypeEthernet)
+	b.ReportAllocs()
+
+	for b.Loop() {
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		decoder.Decode(packet)
+	}
+}
+
+// BenchmarkDecodeGeneric measures the decoding used before the fast
+// path: a fully decoded packet read through its generic layers.
+func BenchmarkDecodeGeneric(b *testing.B) {
+	data := benchmarkPacket(b)
+	b.ReportAllocs()
+
+	for b.Loop() {
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		network, transport := packet.NetworkLayer(), packet.TransportLayer()
+		_ = network.NetworkFlow().Src().String()
+		_ = network.NetworkFlow().Dst().String()
+		_ = transport.LayerType().String()
+	}
+}
@@ -0,0 +1,448 @@
+package sniffer_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// runDetectors runs packets through the pipeline with only the given
+// detector enabled and returns the alerts it raised.
+func runDetectors(t *testing.T, name string, opts sniffer.DetectorOptions, packets []gopacket.Packet) []*sniffer.AnomalyAlert {
+	t.Helper()
+
+	sub := sniffer.Subscribe(len(packets), func(ev sniffer.Event) bool { return ev.Type == sniffer.EventAlert })
+	defer sniffer.Unsubscribe(sub)
+
+	cfg := sniffer.Config{
+		Quiet:           true,
+		Detectors:       []string{name},
+		DetectorOptions: map[string]sniffer.DetectorOptions{name: opts},
+	}
+	src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, cfg); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	var alerts []*sniffer.AnomalyAlert
+	for len(sub.Events()) > 0 {
+		alerts = append(alerts, (<-sub.Events()).Alert)
+	}
+	return alerts
+}
+
+// probes builds count TCP packets from 10.9.9.9, sent interval apart.
+// probe returns the destination host and port of packet i.
+func probes(t *testing.T, count int, interval time.Duration, flags layers.TCP, probe func(i int) (string, int)) []gopacket.Packet {
+	start := time.Now()
+	packets := make([]gopacket.Packet, count)
+	for i := range packets {
+		dst, port := probe(i)
+		tcp := flags
+		tcp.SrcPort, tcp.DstPort = 40000, layers.TCPPort(port)
+
+		packets[i] = buildPacket(t, "10.9.9.9", dst, &tcp)
+		packets[i].Metadata().Timestamp = start.Add(time.Duration(i) * interval)
+	}
+	return packets
+}
+
+func TestPortScanDetector(t *testing.T) {
+	opts := sniffer.DetectorOptions{"ports": "10", "window": "30s"}
+	distinct := func(i int) (string, int) { return "10.0.0.1", i + 1 }
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		want     int
+	}{
+		{name: "fast scan", interval: 10 * time.Millisecond, want: 1},
+		{name: "slow scan", interval: 5 * time.Second, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts := runDetectors(t, "portscan", opts, probes(t, 20, tt.interval, layers.TCP{SYN: true}, distinct))
+			if len(alerts) != tt.want {
+				t.Fatalf("got %d alerts, want %d", len(alerts), tt.want)
+			}
+			for _, alert := range alerts {
+				if alert.Type != sniffer.AlertPortScan || alert.Detector != "portscan" || alert.IP != "10.9.9.9" {
+					t.Errorf("alert = %+v, want a port scan from 10.9.9.9", alert)
+				}
+				if got := alert.Details["ports"]; got != "11" {
+					t.Errorf("ports = %q, want 11", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFloodDetector(t *testing.T) {
+	opts := sniffer.DetectorOptions{"rate": "100", "window": "1s"}
+	samePort := func(int) (string, int) { return "10.0.0.1", 80 }
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		want     int
+	}{
+		{name: "burst", interval: time.Millisecond, want: 1},
+		// Many packets in total, but never a high rate.
+		{name: "steady", interval: 50 * time.Millisecond, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts := runDetectors(t, "flood", opts, probes(t, 500, tt.interval, layers.TCP{SYN: true}, samePort))
+			if len(alerts) != tt.want {
+				t.Fatalf("got %d alerts, want %d", len(alerts), tt.want)
+			}
+			for _, alert := range alerts {
+				if alert.Type != sniffer.AlertFlood || alert.IP != "10.9.9.9" {
+					t.Errorf("alert = %+v, want a flood from 10.9.9.9", alert)
+				}
+			}
+		})
+	}
+}
+
+func TestSweepDetector(t *testing.T) {
+	opts := sniffer.DetectorOptions{"hosts": "10"}
+	subnet := func(i int) (string, int) { return fmt.Sprintf("10.0.1.%d", i+1), 22 }
+	sweep := func(flags layers.TCP) func(t *testing.T) []gopacket.Packet {
+		return func(t *testing.T) []gopacket.Packet {
+			return probes(t, 20, 10*time.Millisecond, flags, subnet)
+		}
+	}
+
+	// exchange builds a conversation of 10.9.9.9 with each of 20 hosts
+	// on port, 10ms apart, made of a packet out and, when back is set,
+	// one in return.
+	exchange := func(port int, out, back func(port int) gopacket.SerializableLayer) func(t *testing.T) []gopacket.Packet {
+		return func(t *testing.T) []gopacket.Packet {
+			start := time.Now()
+			var packets []gopacket.Packet
+			for i := range 20 {
+				host := fmt.Sprintf("10.0.1.%d", i+1)
+				at := start.Add(time.Duration(i) * 10 * time.Millisecond)
+
+				packet := buildPacket(t, "10.9.9.9", host, out(port))
+				packet.Metadata().Timestamp = at
+				packets = append(packets, packet)
+				if back != nil {
+					packet = buildPacket(t, host, "10.9.9.9", back(port))
+					packet.Metadata().Timestamp = at.Add(time.Millisecond)
+					packets = append(packets, packet)
+				}
+			}
+			return packets
+		}
+	}
+	data := func(port int) gopacket.SerializableLayer {
+		return &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), ACK: true, PSH: true}
+	}
+	dataBack := func(port int) gopacket.SerializableLayer {
+		return &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: 40000, ACK: true, PSH: true}
+	}
+	syn := func(port int) gopacket.SerializableLayer {
+		return &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true}
+	}
+	synAck := func(port int) gopacket.SerializableLayer {
+		return &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: 40000, SYN: true, ACK: true}
+	}
+	rst := func(port int) gopacket.SerializableLayer {
+		return &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: 40000, RST: true, ACK: true}
+	}
+	udp := func(port int) gopacket.SerializableLayer {
+		return &layers.UDP{SrcPort: 40000, DstPort: layers.UDPPort(port)}
+	}
+	udpBack := func(port int) gopacket.SerializableLayer {
+		return &layers.UDP{SrcPort: layers.UDPPort(port), DstPort: 40000}
+	}
+
+	tests := []struct {
+		name     string
+		packets  func(t *testing.T) []gopacket.Packet
+		scanType string
+		port     string
+	}{
+		{name: "SYN", packets: sweep(layers.TCP{SYN: true}), scanType: sniffer.ScanSYN, port: "22"},
+		{name: "FIN", packets: sweep(layers.TCP{FIN: true}), scanType: sniffer.ScanFIN, port: "22"},
+		{name: "NULL", packets: sweep(layers.TCP{}), scanType: sniffer.ScanNULL, port: "22"},
+		{name: "XMAS", packets: sweep(layers.TCP{FIN: true, PSH: true, URG: true}), scanType: sniffer.ScanXMAS, port: "22"},
+		{name: "UDP", packets: exchange(161, udp, nil), scanType: sniffer.ScanUDP, port: "161"},
+		// A proxy with established connections to many web servers.
+		{name: "established connections", packets: exchange(443, data, dataBack)},
+		// A client opening connections to many web servers.
+		{name: "accepted connections", packets: exchange(443, syn, synAck)},
+		{name: "refused connections", packets: exchange(443, syn, rst)},
+		// A client asking many DNS servers, each of which answers.
+		{name: "answered UDP", packets: exchange(53, udp, udpBack)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts := runDetectors(t, "sweep", opts, tt.packets(t))
+
+			want := 0
+			if tt.scanType != "" {
+				want = 1
+			}
+			if len(alerts) != want {
+				t.Fatalf("got %d alerts (%+v), want %d", len(alerts), alerts, want)
+			}
+
+			for _, alert := range alerts {
+				if alert.Type != sniffer.AlertSweep || alert.IP != "10.9.9.9" {
+					t.Errorf("alert = %+v, want a host sweep from 10.9.9.9", alert)
+				}
+				if got := alert.Details["port"]; got != tt.port {
+					t.Errorf("port = %q, want %q", got, tt.port)
+				}
+				if got := alert.Details["scan_type"]; got != tt.scanType {
+					t.Errorf("scan_type = %q, want %q", got, tt.scanType)
+				}
+			}
+		})
+	}
+}
+
+// dnsQueries builds count DNS packets from the client 10.0.0.1, sent
+// 10ms apart. message returns the DNS message of packet i.
+func dnsQueries(t *testing.T, count int, message func(i int) *layers.DNS) []gopacket.Packet {
+	start := time.Now()
+	packets := make([]gopacket.Packet, count)
+	for i := range packets {
+		packets[i] = dnsPacket(t, start.Add(time.Duration(i)*10*time.Millisecond), message(i))
+	}
+	return packets
+}
+
+func TestDNSTunnelDetector(t *testing.T) {
+	query := func(name string, qtype layers.DNSType) *layers.DNS {
+		q := dnsQuery(1, name)
+		q.Questions[0].Type = qtype
+		return q
+	}
+	nxdomain := func(name string) *layers.DNS {
+		return dnsResponse(layers.DNSResponseCodeNXDomain, name)
+	}
+
+	tests := []struct {
+		name       string
+		opts       sniffer.DetectorOptions
+		packets    func(t *testing.T) []gopacket.Packet
+		wantType   string
+		wantReason string
+		wantDomain string
+	}{
+		{
+			name: "long label",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 3, func(i int) *layers.DNS {
+					return query(strings.Repeat("a", 60)+".t.example.com", layers.DNSTypeA)
+				})
+			},
+			wantType:   sniffer.AlertDNSTunnel,
+			wantReason: sniffer.DNSReasonLongLabel,
+			wantDomain: "example.com",
+		},
+		{
+			name: "high entropy",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 1, func(i int) *layers.DNS {
+					return query("abcdefghijklmnop.qrstuvwxyz234567.tunnel.co.uk", layers.DNSTypeA)
+				})
+			},
+			wantType:   sniffer.AlertDNSTunnel,
+			wantReason: sniffer.DNSReasonEntropy,
+			wantDomain: "tunnel.co.uk",
+		},
+		{
+			name: "hex tunnel",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 1, func(i int) *layers.DNS {
+					return query("9e4d0b27c1f8a356.e2b70c9a4f16d83b.dnscat.example.com", layers.DNSTypeTXT)
+				})
+			},
+			wantType:   sniffer.AlertDNSTunnel,
+			wantReason: sniffer.DNSReasonEntropy,
+			wantDomain: "example.com",
+		},
+		{
+			name: "ip6.arpa lookup",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 1, func(i int) *layers.DNS {
+					return query("b.6.f.9.2.c.e.4.7.1.d.0.3.a.8.5.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", layers.DNSTypePTR)
+				})
+			},
+		},
+		{
+			name: "many names",
+			opts: sniffer.DetectorOptions{"names": "20"},
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 30, func(i int) *layers.DNS {
+					return query(fmt.Sprintf("n%d.example.com", i), layers.DNSTypeA)
+				})
+			},
+			wantType:   sniffer.AlertDNSTunnel,
+			wantReason: sniffer.DNSReasonVolume,
+			wantDomain: "example.com",
+		},
+		{
+			name: "txt records",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 40, func(i int) *layers.DNS {
+					return query("c2.example.com", layers.DNSTypeTXT)
+				})
+			},
+			wantType:   sniffer.AlertDNSTunnel,
+			wantReason: sniffer.DNSReasonTXT,
+			wantDomain: "example.com",
+		},
+		{
+			name: "generated domains",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 15, func(i int) *layers.DNS {
+					return nxdomain(fmt.Sprintf("xkqzvtrpw%d.com", i))
+				})
+			},
+			wantType:   sniffer.AlertDGA,
+			wantReason: sniffer.DNSReasonNXDomain,
+			wantDomain: "xkqzvtrpw10.com",
+		},
+		{
+			name: "typos",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 15, func(i int) *layers.DNS {
+					return nxdomain(fmt.Sprintf("typo-example%d.com", i))
+				})
+			},
+		},
+		{
+			name: "ordinary lookups",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return dnsQueries(t, 50, func(i int) *layers.DNS {
+					return query("www.example.com", layers.DNSTypeA)
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts := runDetectors(t, "dns", tt.opts, tt.packets(t))
+
+			want := 0
+			if tt.wantType != "" {
+				want = 1
+			}
+			if len(alerts) != want {
+				t.Fatalf("got %d alerts (%+v), want %d", len(alerts), alerts, want)
+			}
+			for _, alert := range alerts {
+				if alert.Type != tt.wantType || alert.Detector != "dns" || alert.IP != "10.0.0.1" {
+					t.Errorf("alert = %+v, want a %s alert for 10.0.0.1", alert, tt.wantType)
+				}
+				if alert.Details["reason"] != tt.wantReason || alert.Details["domain"] != tt.wantDomain {
+					t.Errorf("details = %v, want reason %s and domain %s", alert.Details, tt.wantReason, tt.wantDomain)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectorWorkers(t *testing.T) {
+	// Each scanner sweeps port 22 of 25 hosts and scans 12 ports of the
+	// first. Its packets belong to different flows, so they are spread
+	// over the workers, which share its detector state.
+	const scanners = 40
+	start := time.Now()
+	var packets []gopacket.Packet
+	for i := range scanners {
+		src := fmt.Sprintf("10.9.0.%d", i+1)
+		for host := 1; host <= 25; host++ {
+			packets = append(packets, buildPacket(t, src, fmt.Sprintf("10.0.0.%d", host),
+				&layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true}))
+		}
+		for port := 1; port <= 12; port++ {
+			packets = append(packets, buildPacket(t, src, "10.0.0.1",
+				&layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true}))
+		}
+	}
+	for i, p := range packets {
+		p.Metadata().Timestamp = start.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	for _, workers := range []int{1, 8} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			sub := sniffer.Subscribe(len(packets), func(ev sniffer.Event) bool { return ev.Type == sniffer.EventAlert })
+			defer sniffer.Unsubscribe(sub)
+
+			cfg := sniffer.Config{
+				Workers: workers,
+				Quiet:   true,
+				DetectorOptions: map[string]sniffer.DetectorOptions{
+					"portscan": {"ports": "10"},
+				},
+			}
+			if err := sniffer.Run(sniffer.NewSliceSource(packets, layers.LinkTypeEthernet), cfg); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			counts := map[string]int{}
+			for len(sub.Events()) > 0 {
+				counts[(<-sub.Events()).Alert.Type]++
+			}
+			want := map[string]int{sniffer.AlertPortScan: scanners, sniffer.AlertSweep: scanners}
+			if fmt.Sprint(counts) != fmt.Sprint(want) {
+				t.Errorf("alerts = %v, want %v", counts, want)
+			}
+		})
+	}
+}
+
+func TestNewDetectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		opts    map[string]sniffer.DetectorOptions
+		want    int
+		wantErr bool
+	}{
+		{name: "all", names: nil, want: len(sniffer.DetectorNames())},
+		{name: "none", names: []string{"none"}, want: 0},
+		{name: "one", names: []string{"flood"}, want: 1},
+		{name: "unknown detector", names: []string{"nope"}, wantErr: true},
+		{
+			name:    "unknown option",
+			names:   []string{"flood"},
+			opts:    map[string]sniffer.DetectorOptions{"flood": {"bogus": "1"}},
+			wantErr: true,
+		},
+		{
+			name:    "bad value",
+			names:   []string{"flood"},
+			opts:    map[string]sniffer.DetectorOptions{"flood": {"packets": "-1"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detectors, err := sniffer.NewDetectors(tt.names, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewDetectors error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(detectors) != tt.want {
+				t.Errorf("got %d detectors, want %d", len(detectors), tt.want)
+			}
+		})
+	}
+}
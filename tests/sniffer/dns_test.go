@@ -1,12 +1,134 @@
 package sniffer_test
 
 import (
+	"context"
+	"encoding/binary"
+	"io"
 	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
 )
 
+// stubDNSServer answers PTR queries from a map on 127.0.0.1, over both
+// UDP and TCP on the same port, and counts the queries of each.
+type stubDNSServer struct {
+	addr    string
+	ptr     map[string]string
+	udp     atomic.Int64
+	tcp     atomic.Int64
+	packets net.PacketConn
+	stream  net.Listener
+}
+
+func newStubDNSServer(t *testing.T, ptr map[string]string) *stubDNSServer {
+	t.Helper()
+
+	stream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen on tcp: %v", err)
+	}
+	packets, err := net.ListenPacket("udp", stream.Addr().String())
+	if err != nil {
+		stream.Close()
+		t.Fatalf("failed to listen on udp: %v", err)
+	}
+
+	s := &stubDNSServer{addr: stream.Addr().String(), ptr: ptr, packets: packets, stream: stream}
+	t.Cleanup(func() {
+		packets.Close()
+		stream.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *stubDNSServer) serveUDP() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := s.packets.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.udp.Add(1)
+		if reply := s.answer(buf[:n]); reply != nil {
+			s.packets.WriteTo(reply, addr)
+		}
+	}
+}
+
+func (s *stubDNSServer) serveTCP() {
+	for {
+		conn, err := s.stream.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var length uint16
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+				query := make([]byte, length)
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				s.tcp.Add(1)
+
+				reply := s.answer(query)
+				if reply == nil {
+					return
+				}
+				conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reply))))
+				conn.Write(reply)
+			}
+		}()
+	}
+}
+
+// answer returns the response to a query, NXDOMAIN for names not in the
+// map.
+func (s *stubDNSServer) answer(query []byte) []byte {
+	var dns layers.DNS
+	if err := dns.DecodeFromBytes(query, gopacket.NilDecodeFeedback); err != nil || len(dns.Questions) != 1 {
+		return nil
+	}
+
+	reply := &layers.DNS{
+		ID:           dns.ID,
+		QR:           true,
+		OpCode:       dns.OpCode,
+		RD:           dns.RD,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeNXDomain,
+		Questions:    dns.Questions,
+	}
+	question := dns.Questions[0]
+	if target, ok := s.ptr[strings.ToLower(string(question.Name))]; ok && question.Type == layers.DNSTypePTR {
+		reply.ResponseCode = layers.DNSResponseCodeNoErr
+		reply.Answers = []layers.DNSResourceRecord{{
+			Name:  question.Name,
+			Type:  layers.DNSTypePTR,
+			Class: layers.DNSClassIN,
+			TTL:   300,
+			PTR:   []byte(target),
+		}}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, reply); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
 func TestLookupDomain(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -106,3 +228,90 @@ func TestIsPrivateIP(t *testing.T) {
 		})
 	}
 }
+
+func TestReverseResolver(t *testing.T) {
+	server := newStubDNSServer(t, map[string]string{
+		"34.216.184.93.in-addr.arpa": "example.com.",
+	})
+
+	tests := []struct {
+		name    string
+		server  string
+		useTCP  bool
+		ip      string
+		want    string
+		wantErr bool
+		// errAddr is the server address the error should name, for
+		// servers nothing listens on.
+		errAddr string
+	}{
+		{name: "udp", server: server.addr, ip: "93.184.216.34", want: "example.com"},
+		{name: "tcp", server: server.addr, useTCP: true, ip: "93.184.216.34", want: "example.com"},
+		{name: "nxdomain", server: server.addr, ip: "198.51.100.1", wantErr: true},
+		{name: "ipv6 without port", server: "[::1]", useTCP: true, ip: "93.184.216.34", wantErr: true, errAddr: "[::1]:53"},
+		{name: "bare ipv6", server: "::1", useTCP: true, ip: "93.184.216.34", wantErr: true, errAddr: "[::1]:53"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			udp, tcp := server.udp.Load(), server.tcp.Load()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			name, err := sniffer.NewReverseResolver(tt.server, tt.useTCP)(ctx, tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve(%s) error = %v, wantErr %v", tt.ip, err, tt.wantErr)
+			}
+			if name != tt.want {
+				t.Errorf("resolve(%s) = %q, want %q", tt.ip, name, tt.want)
+			}
+			if tt.errAddr != "" && !strings.Contains(err.Error(), tt.errAddr) {
+				t.Errorf("resolve(%s) error = %v, want a query to %s", tt.ip, err, tt.errAddr)
+			}
+
+			if !tt.useTCP || tt.server != server.addr {
+				return
+			}
+			if server.udp.Load() != udp {
+				t.Errorf("query sent over udp, want tcp only")
+			}
+			if server.tcp.Load() == tcp {
+				t.Errorf("no query received over tcp")
+			}
+		})
+	}
+}
+
+func TestRunReverseDNS(t *testing.T) {
+	server := newStubDNSServer(t, map[string]string{
+		"34.216.184.93.in-addr.arpa": "example.com.",
+	})
+	t.Cleanup(func() {
+		sniffer.Run(sniffer.NewSliceSource(nil, layers.LinkTypeEthernet), sniffer.Config{Quiet: true})
+	})
+
+	cfg := sniffer.Config{Workers: 1, Quiet: true, ReverseDNS: true, DNSServer: server.addr}
+	if err := sniffer.Run(sniffer.NewSliceSource(nil, layers.LinkTypeEthernet), cfg); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// The first lookups only queue the addresses.
+	sniffer.LookupDomain("93.184.216.34")
+	sniffer.LookupDomain("198.51.100.1")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sniffer.ResolvedDomains()["93.184.216.34"] == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("93.184.216.34 was not resolved through %s", server.addr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	got := sniffer.ResolvedDomains()
+	if got["93.184.216.34"] != "example.com" {
+		t.Errorf("ResolvedDomains()[93.184.216.34] = %q, want example.com", got["93.184.216.34"])
+	}
+	if name, ok := got["198.51.100.1"]; ok {
+		t.Errorf("ResolvedDomains()[198.51.100.1] = %q, want none", name)
+	}
+}
@@ -0,0 +1,160 @@
+package sniffer_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// dnsInfo returns a decoded DNS message between a client and a resolver.
+func dnsInfo(at time.Time, client, resolver string, clientPort int, response bool, dns *layers.DNS) *sniffer.PacketInfo {
+	info := &sniffer.PacketInfo{
+		Timestamp: at,
+		Protocol:  "UDP",
+		Src:       client,
+		Dst:       resolver,
+		SrcPort:   clientPort,
+		DstPort:   53,
+		DNS:       dns,
+	}
+	if response {
+		info.Src, info.Dst = resolver, client
+		info.SrcPort, info.DstPort = 53, clientPort
+	}
+	return info
+}
+
+func dnsQuery(id uint16, name string) *layers.DNS {
+	return &layers.DNS{
+		ID:        id,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+}
+
+func TestDNSLog(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	answer := dnsResponse(layers.DNSResponseCodeNoErr, "www.example.com",
+		cnameRecord("www.example.com", "edge.cdn.net", 60),
+		addressRecord("edge.cdn.net", "203.0.113.7", 60))
+	answer.ID = 7
+
+	log := sniffer.NewDNSLog()
+	if _, ok := log.Observe(dnsInfo(start, "10.0.0.1", "8.8.8.8", 40000, false, dnsQuery(7, "www.example.com"))); ok {
+		t.Fatal("a query completed a transaction")
+	}
+	log.Observe(dnsInfo(start, "10.0.0.1", "8.8.8.8", 40001, false, dnsQuery(8, "lost.example.com")))
+
+	// Responses with another ID or client port belong to other queries.
+	mismatched := *answer
+	mismatched.ID = 9
+	if _, ok := log.Observe(dnsInfo(start, "10.0.0.1", "8.8.8.8", 40000, true, &mismatched)); ok {
+		t.Error("a response with another ID was matched")
+	}
+	if _, ok := log.Observe(dnsInfo(start, "10.0.0.1", "8.8.8.8", 40002, true, answer)); ok {
+		t.Error("a response to another port was matched")
+	}
+
+	tx, ok := log.Observe(dnsInfo(start.Add(12*time.Millisecond), "10.0.0.1", "8.8.8.8", 40000, true, answer))
+	if !ok {
+		t.Fatal("the response was not matched to its query")
+	}
+	want := sniffer.DNSTransaction{
+		Timestamp:    start,
+		Client:       "10.0.0.1",
+		ClientPort:   40000,
+		Resolver:     "8.8.8.8",
+		ResolverPort: 53,
+		Protocol:     "UDP",
+		ID:           7,
+		Name:         "www.example.com",
+		QueryType:    "A",
+		Answered:     true,
+		RCode:        "NOERROR",
+		Answers:      []string{"CNAME edge.cdn.net", "A 203.0.113.7"},
+		Latency:      12 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(tx, want) {
+		t.Errorf("transaction = %+v, want %+v", tx, want)
+	}
+
+	if expired := log.Expire(start.Add(time.Second)); len(expired) != 0 {
+		t.Errorf("Expire before the timeout = %+v, want none", expired)
+	}
+	expired := log.Expire(start.Add(sniffer.DNSQueryTimeout + time.Second))
+	if len(expired) != 1 || expired[0].Name != "lost.example.com" || expired[0].Answered {
+		t.Errorf("Expire = %+v, want the unanswered query for lost.example.com", expired)
+	}
+
+	if got := log.Transactions(0); len(got) != 2 || got[0].Name != "www.example.com" || got[1].Name != "lost.example.com" {
+		t.Errorf("Transactions = %+v, want the answered and the unanswered query", got)
+	}
+}
+
+func TestDNSResolverStats(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	log := sniffer.NewDNSLog()
+
+	// 100 queries to 8.8.8.8 answered in 1ms to 100ms; every tenth name
+	// does not exist.
+	for i := 1; i <= 100; i++ {
+		name := "a.example.com"
+		rcode := layers.DNSResponseCodeNoErr
+		if i%10 == 0 {
+			name, rcode = "nx.example.com", layers.DNSResponseCodeNXDomain
+		}
+		at := start.Add(time.Duration(i) * time.Second)
+		log.Observe(dnsInfo(at, "10.0.0.1", "8.8.8.8", 40000, false, dnsQuery(uint16(i), name)))
+
+		response := dnsResponse(rcode, name)
+		response.ID = uint16(i)
+		log.Observe(dnsInfo(at.Add(time.Duration(i)*time.Millisecond), "10.0.0.1", "8.8.8.8", 40000, true, response))
+	}
+	log.Observe(dnsInfo(start, "10.0.0.1", "1.1.1.1", 40000, false, dnsQuery(1, "b.example.com")))
+	log.Flush()
+
+	got := log.Resolvers(1)
+	want := []sniffer.ResolverStats{
+		{
+			Resolver:     "8.8.8.8",
+			Queries:      100,
+			Answered:     100,
+			NXDomain:     10,
+			NXDomainRate: 10,
+			LatencyP50:   50 * time.Millisecond,
+			LatencyP99:   99 * time.Millisecond,
+			TopNames:     []sniffer.NameCount{{Name: "a.example.com", Count: 90}},
+		},
+		{
+			Resolver:   "1.1.1.1",
+			Queries:    1,
+			Unanswered: 1,
+			TopNames:   []sniffer.NameCount{{Name: "b.example.com", Count: 1}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolvers = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunDNSLog(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	response := dnsResponse(layers.DNSResponseCodeNXDomain, "example.com")
+	response.ID = 3
+	packets := []gopacket.Packet{dnsPacket(t, start, dnsQuery(3, "example.com")), dnsPacket(t, start.Add(5*time.Millisecond), response)}
+
+	src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, sniffer.Config{Quiet: true}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := sniffer.DNSTransactions(0)
+	if len(got) != 1 || got[0].RCode != "NXDOMAIN" || got[0].Latency != 5*time.Millisecond {
+		t.Errorf("DNSTransactions = %+v, want one NXDOMAIN answered in 5ms", got)
+	}
+}
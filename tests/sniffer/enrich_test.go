@@ -0,0 +1,212 @@
+package sniffer_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// stubResolver answers lookups from a map and counts them. While gate is
+// set, lookups wait for it to be closed.
+type stubResolver struct {
+	mu    sync.Mutex
+	names map[string]string
+	calls map[string]int
+	gate  chan struct{}
+}
+
+func (r *stubResolver) resolve(ctx context.Context, ip string) (string, error) {
+	r.mu.Lock()
+	r.calls[ip]++
+	gate := r.gate
+	r.mu.Unlock()
+
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	if name, ok := r.names[ip]; ok {
+		return name, nil
+	}
+	return "", errors.New("no such host")
+}
+
+func (r *stubResolver) callsFor(ip string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[ip]
+}
+
+// waitLookup polls e until ip has a cached result.
+func waitLookup(t *testing.T, e *sniffer.Enricher, ip string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if name, found := e.Lookup(ip); found {
+			return name
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no result for %s", ip)
+	return ""
+}
+
+func TestEnricher(t *testing.T) {
+	r := &stubResolver{
+		names: map[string]string{"192.0.2.1": "one.example.com"},
+		calls: make(map[string]int),
+		gate:  make(chan struct{}),
+	}
+	e := sniffer.NewEnricher(sniffer.EnricherOptions{Workers: 1, QueueSize: 1, Resolve: r.resolve})
+	defer e.Close()
+
+	// A slow lookup never blocks the caller.
+	start := time.Now()
+	if _, found := e.Lookup("192.0.2.1"); found {
+		t.Fatal("Lookup found a result before resolving")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Lookup took %s, want no wait", elapsed)
+	}
+
+	// Wait for the worker to pick up the first address, then fill the
+	// queue; the request beyond it is dropped.
+	for r.callsFor("192.0.2.1") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	e.Lookup("192.0.2.2")
+	e.Lookup("192.0.2.3")
+	if got := e.Stats().Dropped; got != 1 {
+		t.Errorf("Dropped = %d, want 1", got)
+	}
+	close(r.gate)
+
+	if name := waitLookup(t, e, "192.0.2.1"); name != "one.example.com" {
+		t.Errorf("name = %q, want one.example.com", name)
+	}
+
+	// Failed lookups are cached too, so they are not repeated.
+	if name := waitLookup(t, e, "192.0.2.2"); name != "" {
+		t.Errorf("name of an unknown address = %q, want none", name)
+	}
+	for range 10 {
+		e.Lookup("192.0.2.2")
+	}
+	if got := r.callsFor("192.0.2.2"); got != 1 {
+		t.Errorf("unknown address looked up %d times, want 1", got)
+	}
+
+	if names := e.Names(); len(names) != 1 || names["192.0.2.1"] != "one.example.com" {
+		t.Errorf("Names = %v, want only one.example.com", names)
+	}
+}
+
+func TestEnricherCache(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      sniffer.EnricherOptions
+		ips       []string
+		wait      time.Duration
+		wantCalls int
+	}{
+		{
+			name:      "cached",
+			opts:      sniffer.EnricherOptions{CacheSize: 2},
+			ips:       []string{"192.0.2.1", "192.0.2.2"},
+			wantCalls: 1,
+		},
+		{
+			name:      "evicted",
+			opts:      sniffer.EnricherOptions{CacheSize: 1},
+			ips:       []string{"192.0.2.1", "192.0.2.2"},
+			wantCalls: 2,
+		},
+		{
+			name:      "expired",
+			opts:      sniffer.EnricherOptions{TTL: 10 * time.Millisecond},
+			ips:       []string{"192.0.2.1"},
+			wait:      50 * time.Millisecond,
+			wantCalls: 2,
+		},
+		{
+			name:      "negative expired",
+			opts:      sniffer.EnricherOptions{NegativeTTL: 10 * time.Millisecond},
+			ips:       []string{"192.0.2.9"},
+			wait:      50 * time.Millisecond,
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &stubResolver{
+				names: map[string]string{"192.0.2.1": "one.example.com", "192.0.2.2": "two.example.com"},
+				calls: make(map[string]int),
+			}
+			tt.opts.Resolve = r.resolve
+			e := sniffer.NewEnricher(tt.opts)
+			defer e.Close()
+
+			for _, ip := range tt.ips {
+				waitLookup(t, e, ip)
+			}
+			time.Sleep(tt.wait)
+			waitLookup(t, e, tt.ips[0])
+
+			if got := r.callsFor(tt.ips[0]); got != tt.wantCalls {
+				t.Errorf("%s looked up %d times, want %d", tt.ips[0], got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestEnricherClose(t *testing.T) {
+	r := &stubResolver{calls: make(map[string]int), gate: make(chan struct{})}
+	e := sniffer.NewEnricher(sniffer.EnricherOptions{Workers: 2, Timeout: time.Hour, Resolve: r.resolve})
+
+	e.Lookup("192.0.2.1")
+	for r.callsFor("192.0.2.1") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close cancels the lookup in progress instead of waiting for it.
+	done := make(chan struct{})
+	go func() {
+		e.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not cancel the lookup in progress")
+	}
+}
+
+func TestEnricherRateLimit(t *testing.T) {
+	r := &stubResolver{calls: make(map[string]int)}
+	e := sniffer.NewEnricher(sniffer.EnricherOptions{Workers: 4, RateLimit: 20, Resolve: r.resolve})
+	defer e.Close()
+
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"}
+	start := time.Now()
+	for _, ip := range ips {
+		e.Lookup(ip)
+	}
+	for _, ip := range ips {
+		waitLookup(t, e, ip)
+	}
+
+	// At 20 per second, five lookups span at least four intervals.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("%d lookups took %s, want at least 200ms", len(ips), elapsed)
+	}
+}
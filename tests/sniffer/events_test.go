@@ -0,0 +1,38 @@
+package sniffer_test
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func TestSubscriptionDropsWhenFull(t *testing.T) {
+	udpOnly := func(ev sniffer.Event) bool {
+		return ev.Packet != nil && ev.Packet.Protocol == "UDP"
+	}
+
+	all := sniffer.Subscribe(1, nil)
+	defer sniffer.Unsubscribe(all)
+	udp := sniffer.Subscribe(10, udpOnly)
+	defer sniffer.Unsubscribe(udp)
+
+	src := sniffer.NewSliceSource(testPackets(t), layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, sniffer.Config{Quiet: true}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if got := len(all.Events()); got != 1 {
+		t.Errorf("buffered %d events, want 1", got)
+	}
+	if got := all.Dropped(); got != 2 {
+		t.Errorf("dropped %d events, want 2", got)
+	}
+
+	if got := len(udp.Events()); got != 1 {
+		t.Errorf("filtered subscriber got %d events, want 1", got)
+	}
+	if got := udp.Dropped(); got != 0 {
+		t.Errorf("filtered subscriber dropped %d events, want 0", got)
+	}
+}
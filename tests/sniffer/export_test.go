@@ -0,0 +1,172 @@
+package sniffer_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func TestFlowExporter(t *testing.T) {
+	now := time.Now()
+	flowList := []sniffer.Flow{
+		{
+			Key: sniffer.FlowKey{
+				SrcIP:    "10.0.0.1",
+				DstIP:    "10.0.0.2",
+				SrcPort:  40000,
+				DstPort:  443,
+				Protocol: "TCP",
+			},
+			SrcPackets: 10,
+			SrcBytes:   1000,
+			DstPackets: 8,
+			DstBytes:   6000,
+			FirstSeen:  now.Add(-time.Second),
+			LastSeen:   now,
+		},
+	}
+
+	tests := []struct {
+		name        string
+		format      string
+		version     uint16
+		headerLen   int
+		templateSet uint16
+	}{
+		{
+			name:        "IPFIX",
+			format:      sniffer.ExportIPFIX,
+			version:     10,
+			headerLen:   16,
+			templateSet: 2,
+		},
+		{
+			name:        "NetFlow v9",
+			format:      sniffer.ExportNetFlowV9,
+			version:     9,
+			headerLen:   20,
+			templateSet: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer listener.Close()
+
+			exporter, err := sniffer.NewFlowExporter(listener.LocalAddr().String(), tt.format)
+			if err != nil {
+				t.Fatalf("NewFlowExporter failed: %v", err)
+			}
+			defer exporter.Close()
+
+			if err := exporter.Export(flowList); err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+
+			buf := make([]byte, 65535)
+			listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("Failed to receive export packet: %v", err)
+			}
+			msg := buf[:n]
+
+			if version := binary.BigEndian.Uint16(msg[0:2]); version != tt.version {
+				t.Fatalf("version = %d, want %d", version, tt.version)
+			}
+
+			var setIDs []uint16
+			for off := tt.headerLen; off+4 <= len(msg); {
+				setID := binary.BigEndian.Uint16(msg[off : off+2])
+				setLen := int(binary.BigEndian.Uint16(msg[off+2 : off+4]))
+				if setLen < 4 || off+setLen > len(msg) {
+					t.Fatalf("invalid set length %d at offset %d", setLen, off)
+				}
+				setIDs = append(setIDs, setID)
+				off += setLen
+			}
+
+			if len(setIDs) != 2 || setIDs[0] != tt.templateSet || setIDs[1] != 256 {
+				t.Errorf("sets = %v, want [%d 256]", setIDs, tt.templateSet)
+			}
+
+			if tt.format == sniffer.ExportNetFlowV9 {
+				// One template record plus one record per direction.
+				if count := binary.BigEndian.Uint16(msg[2:4]); count != 3 {
+					t.Errorf("record count = %d, want 3", count)
+				}
+			} else if length := int(binary.BigEndian.Uint16(msg[2:4])); length != n {
+				t.Errorf("message length = %d, want %d", length, n)
+			}
+		})
+	}
+}
+
+func TestFlowExporterUptime(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	exporter, err := sniffer.NewFlowExporter(listener.LocalAddr().String(), sniffer.ExportNetFlowV9)
+	if err != nil {
+		t.Fatalf("NewFlowExporter failed: %v", err)
+	}
+	defer exporter.Close()
+
+	// A flow from before the exporter started, as read from a file.
+	start := time.Now().Add(-time.Hour)
+	flow := sniffer.Flow{
+		Key: sniffer.FlowKey{
+			SrcIP:    "10.0.0.1",
+			DstIP:    "10.0.0.2",
+			SrcPort:  40000,
+			DstPort:  53,
+			Protocol: "UDP",
+		},
+		SrcPackets: 1,
+		SrcBytes:   60,
+		FirstSeen:  start,
+		LastSeen:   start.Add(time.Second),
+	}
+	if err := exporter.Export([]sniffer.Flow{flow}); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	buf := make([]byte, 65535)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to receive export packet: %v", err)
+	}
+	msg := buf[:n]
+
+	// Skip the template flowset to the data record, whose switched times
+	// follow the addresses, ports, protocol, flags and counters.
+	off := 20 + int(binary.BigEndian.Uint16(msg[22:24]))
+	record := msg[off+4:]
+	first := binary.BigEndian.Uint32(record[30:34])
+	last := binary.BigEndian.Uint32(record[34:38])
+	uptime := binary.BigEndian.Uint32(msg[4:8])
+
+	if last-first != 1000 {
+		t.Errorf("LastSwitched - FirstSwitched = %d ms, want 1000", last-first)
+	}
+	if uptime < last || uptime-last < uint32(time.Hour.Milliseconds())-1000 {
+		t.Errorf("uptime = %d ms, LastSwitched = %d ms, want the flow to end about an hour ago", uptime, last)
+	}
+}
+
+func TestFlowExporterInvalidFormat(t *testing.T) {
+	if _, err := sniffer.NewFlowExporter("127.0.0.1:2055", "sflow"); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,53 @@
+package sniffer_test
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func TestFlowTracking(t *testing.T) {
+	client, server := "10.0.0.1", "10.0.0.2"
+
+	packets := []gopacket.Packet{
+		buildPacket(t, client, server, &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true}),
+		buildPacket(t, server, client, &layers.TCP{SrcPort: 22, DstPort: 40000, SYN: true, ACK: true}),
+		buildPacket(t, client, server, &layers.TCP{SrcPort: 40000, DstPort: 22, ACK: true}),
+		buildPacket(t, client, server, &layers.UDP{SrcPort: 5000, DstPort: 53}),
+	}
+
+	src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, sniffer.Config{}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	flowList := sniffer.ActiveFlows()
+	if len(flowList) != 2 {
+		t.Fatalf("got %d flows, want 2", len(flowList))
+	}
+
+	var tcpFlow *sniffer.Flow
+	for i := range flowList {
+		if flowList[i].Key.Protocol == "TCP" {
+			tcpFlow = &flowList[i]
+		}
+	}
+	if tcpFlow == nil {
+		t.Fatal("no TCP flow tracked")
+	}
+
+	if tcpFlow.Key.SrcIP != client || tcpFlow.Key.DstPort != 22 {
+		t.Errorf("flow key = %v, want it oriented from the client", tcpFlow.Key)
+	}
+	if tcpFlow.SrcPackets != 2 || tcpFlow.DstPackets != 1 {
+		t.Errorf("packets = %d/%d, want 2/1", tcpFlow.SrcPackets, tcpFlow.DstPackets)
+	}
+	if tcpFlow.State != sniffer.FlowEstablished {
+		t.Errorf("state = %s, want %s", tcpFlow.State, sniffer.FlowEstablished)
+	}
+	if !tcpFlow.TCPFlags.Has(sniffer.FlagSYN) || !tcpFlow.TCPFlags.Has(sniffer.FlagACK) {
+		t.Errorf("flags = %s, want SYN and ACK", tcpFlow.TCPFlags)
+	}
+}
@@ -0,0 +1,137 @@
+package sniffer_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func TestResolveInterfaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		exclude []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "single", names: []string{"eth0"}, want: []string{"eth0"}},
+		{name: "several", names: []string{"eth0", "br0", "eth0"}, want: []string{"eth0", "br0"}},
+		{name: "none", names: nil, wantErr: true},
+		{name: "bad pattern", names: []string{"eth0"}, exclude: []string{"[eth"}, wantErr: true},
+		{name: "index out of range", names: []string{"9999"}, wantErr: true},
+		{name: "negative index", names: []string{"-1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sniffer.ResolveInterfaces(tt.names, nil, tt.exclude)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveInterfaces error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveInterfaces = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// interfaceSource delivers packets tagged with the index of the
+// interface they were captured on, like a multi-interface capture.
+type interfaceSource struct {
+	sniffer.PacketSource
+	interfaces []sniffer.CaptureInterface
+}
+
+func (s *interfaceSource) Interfaces() []sniffer.CaptureInterface {
+	return s.interfaces
+}
+
+func TestPerInterfaceStats(t *testing.T) {
+	packets := testPackets(t)
+	// The first two packets come from eth0, the last from br0.
+	packets[2].Metadata().InterfaceIndex = 1
+
+	src := &interfaceSource{
+		PacketSource: sniffer.NewSliceSource(packets, layers.LinkTypeEthernet),
+		interfaces: []sniffer.CaptureInterface{
+			{Name: "eth0", LinkType: layers.LinkTypeEthernet},
+			{Name: "br0", LinkType: layers.LinkTypeEthernet},
+		},
+	}
+	if err := sniffer.Run(src, sniffer.Config{Workers: 2, Quiet: true}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := sniffer.CurrentStats().Interfaces
+	want := []struct {
+		name    string
+		packets []gopacket.Packet
+	}{
+		{"eth0", packets[:2]},
+		{"br0", packets[2:]},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d interfaces, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		bytes := 0
+		for _, p := range w.packets {
+			bytes += p.Metadata().Length
+		}
+		if got[i].Name != w.name || got[i].Packets != len(w.packets) || got[i].Bytes != bytes {
+			t.Errorf("interface %d = %+v, want %s with %d packets and %d bytes", i, got[i], w.name, len(w.packets), bytes)
+		}
+	}
+
+	for _, flow := range sniffer.ActiveFlows() {
+		want := "eth0"
+		if flow.Key.Protocol == "UDP" {
+			want = "br0"
+		}
+		if flow.Key.Interface != want {
+			t.Errorf("flow %s interface = %q, want %q", flow.Key, flow.Key.Interface, want)
+		}
+	}
+}
+
+func TestFlowsPerInterface(t *testing.T) {
+	// The same handshake seen on an uplink and on a bridge.
+	var packets []gopacket.Packet
+	for iface := range 2 {
+		syn := buildPacket(t, "10.0.0.1", "93.184.216.34", &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true})
+		synAck := buildPacket(t, "93.184.216.34", "10.0.0.1", &layers.TCP{SrcPort: 443, DstPort: 40000, SYN: true, ACK: true})
+		syn.Metadata().InterfaceIndex = iface
+		synAck.Metadata().InterfaceIndex = iface
+		packets = append(packets, syn, synAck)
+	}
+
+	src := &interfaceSource{
+		PacketSource: sniffer.NewSliceSource(packets, layers.LinkTypeEthernet),
+		interfaces: []sniffer.CaptureInterface{
+			{Name: "eth0", LinkType: layers.LinkTypeEthernet},
+			{Name: "br0", LinkType: layers.LinkTypeEthernet},
+		},
+	}
+	if err := sniffer.Run(src, sniffer.Config{Workers: 4, Quiet: true}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	flows := sniffer.ActiveFlows()
+	if len(flows) != 2 {
+		t.Fatalf("got %d flows (%+v), want one per interface", len(flows), flows)
+	}
+	seen := make(map[string]bool)
+	for _, flow := range flows {
+		seen[flow.Key.Interface] = true
+		if flow.SrcPackets != 1 || flow.DstPackets != 1 || flow.State != sniffer.FlowSynReceived {
+			t.Errorf("flow %s on %s = %+v, want one packet each way in state %s",
+				flow.Key, flow.Key.Interface, flow, sniffer.FlowSynReceived)
+		}
+	}
+	if !seen["eth0"] || !seen["br0"] {
+		t.Errorf("flows are on %v, want eth0 and br0", seen)
+	}
+}
@@ -0,0 +1,157 @@
+package sniffer_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// runJSON runs packets through a session with JSON output and returns
+// the records written to stdout.
+func runJSON(t *testing.T, packets []gopacket.Packet, cfg sniffer.Config) []map[string]any {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	lines := make(chan []map[string]any)
+	go func() {
+		var records []map[string]any
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var record map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Errorf("invalid JSON line %q: %v", scanner.Text(), err)
+				continue
+			}
+			records = append(records, record)
+		}
+		io.Copy(io.Discard, r)
+		lines <- records
+	}()
+
+	cfg.Output = sniffer.OutputJSON
+	err = sniffer.Run(sniffer.NewSliceSource(packets, layers.LinkTypeEthernet), cfg)
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return <-lines
+}
+
+func TestJSONOutput(t *testing.T) {
+	var packets []gopacket.Packet
+	for port := 1; port <= 12; port++ {
+		packets = append(packets, buildPacket(t, "10.9.9.9", "10.0.0.1",
+			&layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true}))
+	}
+
+	records := runJSON(t, packets, sniffer.Config{
+		Workers:   1,
+		Detectors: []string{"portscan"},
+		DetectorOptions: map[string]sniffer.DetectorOptions{
+			"portscan": {"ports": "10"},
+		},
+	})
+
+	counts := map[string]int{}
+	for i, record := range records {
+		recordType, _ := record["type"].(string)
+		counts[recordType]++
+
+		if recordType == sniffer.RecordPacket {
+			if record["src"] != "10.9.9.9" || record["protocol"] != "TCP" || record["tcp_flags"] != "SYN" {
+				t.Errorf("packet record = %v, want a SYN from 10.9.9.9", record)
+			}
+		}
+		// The scan is detected at the 11th port, and its alert follows
+		// that packet.
+		if recordType == sniffer.RecordAlert && i != 11 {
+			t.Errorf("alert is record %d, want it right after packet 11", i)
+		}
+	}
+
+	if counts[sniffer.RecordPacket] != len(packets) {
+		t.Errorf("got %d packet records, want %d", counts[sniffer.RecordPacket], len(packets))
+	}
+	if counts[sniffer.RecordAlert] != 1 {
+		t.Errorf("got %d alert records, want 1", counts[sniffer.RecordAlert])
+	}
+	if counts[sniffer.RecordSummary] != 1 {
+		t.Errorf("got %d summary records, want 1", counts[sniffer.RecordSummary])
+	}
+	if len(records) != len(packets)+counts[sniffer.RecordAlert]+1 {
+		t.Errorf("got unexpected records: %v", counts)
+	}
+}
+
+func TestJSONOutputAlerts(t *testing.T) {
+	// More scanners than an event subscription has room for.
+	const scanners = 300
+
+	var packets []gopacket.Packet
+	for i := range scanners {
+		src := fmt.Sprintf("10.9.%d.%d", i/250, i%250+1)
+		for port := 1; port <= 3; port++ {
+			packets = append(packets, buildPacket(t, src, "10.0.0.1",
+				&layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true}))
+		}
+	}
+
+	records := runJSON(t, packets, sniffer.Config{
+		Detectors: []string{"portscan"},
+		DetectorOptions: map[string]sniffer.DetectorOptions{
+			"portscan": {"ports": "2"},
+		},
+	})
+
+	alerts := 0
+	for _, record := range records {
+		if record["type"] == sniffer.RecordAlert {
+			alerts++
+		}
+	}
+	if alerts != scanners {
+		t.Errorf("got %d alert records, want %d", alerts, scanners)
+	}
+}
+
+func TestJSONOutputExport(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer listener.Close()
+
+	packets := testPackets(t)
+	records := runJSON(t, packets, sniffer.Config{
+		Workers:         1,
+		ExportCollector: listener.LocalAddr().String(),
+	})
+
+	// Status messages such as the export notice must stay off stdout.
+	if len(records) != len(packets)+1 {
+		t.Errorf("got %d records, want %d packets and a summary", len(records), len(packets))
+	}
+}
+
+func TestInvalidOutput(t *testing.T) {
+	src := sniffer.NewSliceSource(nil, layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, sniffer.Config{Output: "xml"}); err == nil {
+		t.Error("expected an error for an unsupported output format")
+	}
+}
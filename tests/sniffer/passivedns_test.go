@@ -0,0 +1,157 @@
+package sniffer_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// dnsPacket returns a DNS message between the client 10.0.0.1:40000 and
+// the resolver 8.8.8.8, captured at the given time. Queries go to the
+// resolver and responses back to the client.
+func dnsPacket(t *testing.T, at time.Time, dns *layers.DNS) gopacket.Packet {
+	t.Helper()
+
+	ip := ipv4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	ip.SrcIP, ip.DstIP = net.IP{10, 0, 0, 1}, net.IP{8, 8, 8, 8}
+	if dns.QR {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+	}
+	packet := rawPacket(t, ethernet(layers.EthernetTypeIPv4), ip, udp, dns)
+	packet.Metadata().Timestamp = at
+	return packet
+}
+
+func dnsResponse(rcode layers.DNSResponseCode, question string, answers ...layers.DNSResourceRecord) *layers.DNS {
+	return &layers.DNS{
+		ID:           1,
+		QR:           true,
+		RD:           true,
+		RA:           true,
+		ResponseCode: rcode,
+		Questions:    []layers.DNSQuestion{{Name: []byte(question), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers:      answers,
+	}
+}
+
+func cnameRecord(name, target string, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, TTL: ttl, CNAME: []byte(target)}
+}
+
+func addressRecord(name, ip string, ttl uint32) layers.DNSResourceRecord {
+	recordType := layers.DNSTypeA
+	if net.ParseIP(ip).To4() == nil {
+		recordType = layers.DNSTypeAAAA
+	}
+	return layers.DNSResourceRecord{Name: []byte(name), Type: recordType, Class: layers.DNSClassIN, TTL: ttl, IP: net.ParseIP(ip)}
+}
+
+func TestPassiveDNS(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		packets func(t *testing.T) []gopacket.Packet
+		want    map[string]string
+	}{
+		{
+			name: "address",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return []gopacket.Packet{
+					dnsPacket(t, start, dnsResponse(layers.DNSResponseCodeNoErr, "Example.com",
+						addressRecord("Example.com", "93.184.216.34", 300))),
+				}
+			},
+			want: map[string]string{"93.184.216.34": "example.com"},
+		},
+		{
+			name: "cname chain",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return []gopacket.Packet{
+					dnsPacket(t, start, dnsResponse(layers.DNSResponseCodeNoErr, "www.example.com",
+						cnameRecord("www.example.com", "www.example.com.cdn.net", 300),
+						cnameRecord("www.example.com.cdn.net", "edge1.cdn.net", 60),
+						addressRecord("edge1.cdn.net", "203.0.113.7", 20),
+						addressRecord("edge1.cdn.net", "2001:db8::7", 20))),
+				}
+			},
+			want: map[string]string{
+				"203.0.113.7": "www.example.com",
+				"2001:db8::7": "www.example.com",
+			},
+		},
+		{
+			name: "expired",
+			packets: func(t *testing.T) []gopacket.Packet {
+				later := buildPacket(t, "10.0.0.1", "93.184.216.34", &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true})
+				later.Metadata().Timestamp = start.Add(10 * time.Minute)
+				return []gopacket.Packet{
+					dnsPacket(t, start, dnsResponse(layers.DNSResponseCodeNoErr, "example.com",
+						addressRecord("example.com", "93.184.216.34", 300))),
+					later,
+				}
+			},
+			want: map[string]string{"93.184.216.34": ""},
+		},
+		{
+			name: "query",
+			packets: func(t *testing.T) []gopacket.Packet {
+				query := dnsResponse(layers.DNSResponseCodeNoErr, "example.com", addressRecord("example.com", "93.184.216.34", 300))
+				query.QR = false
+				return []gopacket.Packet{dnsPacket(t, start, query)}
+			},
+			want: map[string]string{"93.184.216.34": ""},
+		},
+		{
+			name: "error response",
+			packets: func(t *testing.T) []gopacket.Packet {
+				return []gopacket.Packet{
+					dnsPacket(t, start, dnsResponse(layers.DNSResponseCodeServFail, "example.com",
+						addressRecord("example.com", "93.184.216.34", 300))),
+				}
+			},
+			want: map[string]string{"93.184.216.34": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := sniffer.NewSliceSource(tt.packets(t), layers.LinkTypeEthernet)
+			if err := sniffer.Run(src, sniffer.Config{Workers: 1, Quiet: true}); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			got := sniffer.ResolvedDomains()
+			for ip, want := range tt.want {
+				if got[ip] != want {
+					t.Errorf("ResolvedDomains()[%s] = %q, want %q", ip, got[ip], want)
+				}
+			}
+		})
+	}
+}
+
+func TestPassiveLookupDomain(t *testing.T) {
+	packets := []gopacket.Packet{
+		dnsPacket(t, time.Now(), dnsResponse(layers.DNSResponseCodeNoErr, "example.com",
+			addressRecord("example.com", "93.184.216.34", 300),
+			addressRecord("example.com", "2001:db8::7", 300))),
+	}
+	src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, sniffer.Config{Workers: 1, Quiet: true}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, addr := range []string{"93.184.216.34", "93.184.216.34:443", "2001:db8::7", "[2001:db8::7]:443"} {
+		if got := sniffer.LookupDomain(addr); !strings.HasPrefix(got, "example.com") {
+			t.Errorf("LookupDomain(%q) = %q, want example.com", addr, got)
+		}
+	}
+}
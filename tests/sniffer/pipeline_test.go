@@ -0,0 +1,156 @@
+package sniffer_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+// handshakes builds a TCP handshake for each of n clients, interleaved
+// so that consecutive packets belong to different flows.
+func handshakes(t testing.TB, n int) []gopacket.Packet {
+	server := "10.0.0.1"
+	var syn, synAck, ack []gopacket.Packet
+	for i := 0; i < n; i++ {
+		client := fmt.Sprintf("10.1.%d.%d", i/250, i%250+1)
+		port := layers.TCPPort(40000 + i)
+		syn = append(syn, buildPacket(t, client, server, &layers.TCP{SrcPort: port, DstPort: 443, SYN: true}))
+		synAck = append(synAck, buildPacket(t, server, client, &layers.TCP{SrcPort: 443, DstPort: port, SYN: true, ACK: true}))
+		ack = append(ack, buildPacket(t, client, server, &layers.TCP{SrcPort: port, DstPort: 443, ACK: true}))
+	}
+
+	packets := append(syn, synAck...)
+	return append(packets, ack...)
+}
+
+func TestPipelineWorkers(t *testing.T) {
+	const clients = 50
+	packets := handshakes(t, clients)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+			cfg := sniffer.Config{Workers: workers, QueueSize: 4, Quiet: true, Detectors: []string{"none"}}
+			if err := sniffer.Run(src, cfg); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			got := sniffer.CurrentStats()
+			if got.Total != len(packets) || got.TCP != len(packets) {
+				t.Errorf("Total/TCP = %d/%d, want %d", got.Total, got.TCP, len(packets))
+			}
+			// Sources that are not live wait for the workers instead
+			// of dropping.
+			if got.QueueDropped != 0 {
+				t.Errorf("QueueDropped = %d, want 0", got.QueueDropped)
+			}
+			if recent := sniffer.RecentPackets(); len(recent) != 10 {
+				t.Errorf("got %d recent packets, want 10", len(recent))
+			}
+
+			// Every handshake is only seen in order if all packets of
+			// a flow went to the same worker.
+			flowList := sniffer.ActiveFlows()
+			if len(flowList) != clients {
+				t.Fatalf("got %d flows, want %d", len(flowList), clients)
+			}
+			for _, flow := range flowList {
+				if flow.State != sniffer.FlowEstablished {
+					t.Errorf("flow %s state = %s, want %s", flow.Key, flow.State, sniffer.FlowEstablished)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionAccessors(t *testing.T) {
+	packets := handshakes(t, 50)
+	save := filepath.Join(t.TempDir(), "capture.pcap")
+
+	// The API reads the session while captures start and end; run with
+	// -race to check that it never sees one half set up.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 5 {
+			src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+			cfg := sniffer.Config{Workers: 4, Quiet: true, SaveFile: save}
+			if err := sniffer.Run(src, cfg); err != nil {
+				t.Errorf("Run failed: %v", err)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			if got := sniffer.CurrentStats().Total; got != len(packets) {
+				t.Errorf("Total = %d, want %d", got, len(packets))
+			}
+			if saved, ok := sniffer.SavedPackets(); !ok || saved != len(packets) {
+				t.Errorf("SavedPackets = %d, %t, want %d, true", saved, ok, len(packets))
+			}
+			return
+		default:
+		}
+
+		sniffer.CurrentStats()
+		sniffer.RecentPackets()
+		sniffer.ActiveFlows()
+		sniffer.SavedPackets()
+		sniffer.DNSTransactions(0)
+		sniffer.DNSResolvers(0)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	packets := handshakes(b, 1000)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg := sniffer.Config{Workers: workers, Quiet: true}
+			b.ReportAllocs()
+
+			for b.Loop() {
+				src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+				if err := sniffer.Run(src, cfg); err != nil {
+					b.Fatalf("Run failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(len(packets)*b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
+
+func TestStatsDropRate(t *testing.T) {
+	tests := []struct {
+		name        string
+		snapshot    sniffer.StatsSnapshot
+		wantDropped int
+		wantRate    float64
+	}{
+		{"no packets", sniffer.StatsSnapshot{}, 0, 0},
+		{"no drops", sniffer.StatsSnapshot{Total: 100, KernelReceived: 100}, 0, 0},
+		{
+			name:        "all sources",
+			snapshot:    sniffer.StatsSnapshot{Total: 80, KernelReceived: 95, KernelDropped: 10, InterfaceDropped: 5, QueueDropped: 5},
+			wantDropped: 20,
+			wantRate:    20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.snapshot.Dropped(); got != tt.wantDropped {
+				t.Errorf("Dropped = %d, want %d", got, tt.wantDropped)
+			}
+			if got := tt.snapshot.DropRate(); got != tt.wantRate {
+				t.Errorf("DropRate = %v, want %v", got, tt.wantRate)
+			}
+		})
+	}
+}
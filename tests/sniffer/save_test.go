@@ -1,7 +1,10 @@
 package sniffer_test
 
 import (
+	"encoding/binary"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -118,3 +121,357 @@ func TestPackageSaving(t *testing.T) {
 		t.Fatalf("Failed to remove test file: %v", err)
 	}
 }
+
+func countPcapPackets(t *testing.T, path string) int {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open saved pcap file: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to create pcap reader for %s: %v", path, err)
+	}
+
+	count := 0
+	for {
+		if _, _, err := reader.ReadPacketData(); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestPacketSaverRotation(t *testing.T) {
+	packet := testPackets(t)[0]
+	recordLen := int64(16 + len(packet.Data()))
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		pattern   string
+		rotation  sniffer.Rotation
+		interval  time.Duration
+		wantFiles []string
+	}{
+		{
+			name:      "size",
+			pattern:   "capture.pcap",
+			rotation:  sniffer.Rotation{MaxSize: 24 + 3*recordLen},
+			interval:  time.Millisecond,
+			wantFiles: []string{"capture.pcap", "capture.1.pcap", "capture.2.pcap", "capture.3.pcap"},
+		},
+		{
+			name:      "size with file limit",
+			pattern:   "capture.pcap",
+			rotation:  sniffer.Rotation{MaxSize: 24 + 3*recordLen, MaxFiles: 2},
+			interval:  time.Millisecond,
+			wantFiles: []string{"capture.2.pcap", "capture.3.pcap"},
+		},
+		{
+			name:      "interval",
+			pattern:   "capture-%Y%m%d-%H%M%S.pcap",
+			rotation:  sniffer.Rotation{Interval: 5 * time.Second},
+			interval:  2 * time.Second,
+			wantFiles: []string{"capture-20240501-120000.pcap", "capture-20240501-120006.pcap", "capture-20240501-120012.pcap", "capture-20240501-120018.pcap"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			saver, err := sniffer.NewRotatingPacketSaver(filepath.Join(dir, tt.pattern), 65536, 0, tt.rotation)
+			if err != nil {
+				t.Fatalf("NewRotatingPacketSaver failed: %v", err)
+			}
+
+			const total = 10
+			for i := 0; i < total; i++ {
+				packet.Metadata().Timestamp = start.Add(time.Duration(i) * tt.interval)
+				if err := saver.SavePacket(packet); err != nil {
+					t.Fatalf("SavePacket failed: %v", err)
+				}
+			}
+			if err := saver.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			var got []string
+			for _, f := range saver.Files() {
+				got = append(got, filepath.Base(f))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Fatalf("files = %v, want %v", got, tt.wantFiles)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			if len(entries) != len(tt.wantFiles) {
+				t.Errorf("%d files on disk, want %d", len(entries), len(tt.wantFiles))
+			}
+
+			// Without a file limit every packet must be in some file.
+			if tt.rotation.MaxFiles == 0 {
+				saved := 0
+				for _, f := range saver.Files() {
+					saved += countPcapPackets(t, f)
+				}
+				if saved != total {
+					t.Errorf("saved %d packets across files, want %d", saved, total)
+				}
+			}
+		})
+	}
+}
+
+func TestPcapngAlertComments(t *testing.T) {
+	var packets []gopacket.Packet
+	for port := 1; port <= 12; port++ {
+		packets = append(packets, buildPacket(t, "10.9.9.9", "10.0.0.1",
+			&layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true}))
+	}
+
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	cfg := sniffer.Config{
+		Interfaces: []string{"eth0"},
+		Filter:     "tcp",
+		SaveFile:   path,
+		Quiet:      true,
+		Detectors:  []string{"portscan"},
+		DetectorOptions: map[string]sniffer.DetectorOptions{
+			"portscan": {"ports": "10"},
+		},
+	}
+	if err := sniffer.Run(sniffer.NewSliceSource(packets, layers.LinkTypeEthernet), cfg); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read capture: %v", err)
+	}
+	if !strings.Contains(string(data), "port_scan alert (portscan") {
+		t.Error("capture has no alert comment")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("NewNgReader failed: %v", err)
+	}
+
+	intf, err := reader.Interface(0)
+	if err != nil {
+		t.Fatalf("Interface failed: %v", err)
+	}
+	if intf.Name != "eth0" || intf.Filter != "tcp" || intf.LinkType != layers.LinkTypeEthernet || intf.OS == "" {
+		t.Errorf("interface = %+v, want eth0 with filter tcp, Ethernet link type and OS", intf)
+	}
+
+	count := 0
+	for {
+		_, ci, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if !ci.Timestamp.Equal(packets[count].Metadata().Timestamp) {
+			t.Errorf("packet %d timestamp = %v, want %v", count, ci.Timestamp, packets[count].Metadata().Timestamp)
+		}
+		count++
+	}
+	if count != len(packets) {
+		t.Errorf("read %d packets, want %d", count, len(packets))
+	}
+}
+
+func TestPcapngInterfaces(t *testing.T) {
+	var packets []gopacket.Packet
+	for port := 1; port <= 12; port++ {
+		p := buildPacket(t, "10.9.9.9", "10.0.0.1",
+			&layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true})
+		// Odd ports come from eth0, even ones from br0, including the
+		// 10th, which carries the alert comment.
+		p.Metadata().InterfaceIndex = 1 - port%2
+		packets = append(packets, p)
+	}
+
+	src := &interfaceSource{
+		PacketSource: sniffer.NewSliceSource(packets, layers.LinkTypeEthernet),
+		interfaces: []sniffer.CaptureInterface{
+			{Name: "eth0", LinkType: layers.LinkTypeEthernet},
+			{Name: "br0", LinkType: layers.LinkTypeEthernet},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	cfg := sniffer.Config{
+		Workers:   1,
+		SaveFile:  path,
+		Quiet:     true,
+		Detectors: []string{"portscan"},
+		DetectorOptions: map[string]sniffer.DetectorOptions{
+			"portscan": {"ports": "9"},
+		},
+	}
+	if err := sniffer.Run(src, cfg); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("NewNgReader failed: %v", err)
+	}
+
+	count := 0
+	for {
+		_, ci, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if want := packets[count].Metadata().InterfaceIndex; ci.InterfaceIndex != want {
+			t.Errorf("packet %d interface = %d, want %d", count, ci.InterfaceIndex, want)
+		}
+		count++
+	}
+	if count != len(packets) {
+		t.Errorf("read %d packets, want %d", count, len(packets))
+	}
+
+	if got := reader.NInterfaces(); got != 2 {
+		t.Fatalf("file describes %d interfaces, want 2", got)
+	}
+	for i, want := range src.interfaces {
+		intf, err := reader.Interface(i)
+		if err != nil {
+			t.Fatalf("Interface failed: %v", err)
+		}
+		if intf.Name != want.Name || intf.LinkType != want.LinkType {
+			t.Errorf("interface %d = %s (%s), want %s (%s)", i, intf.Name, intf.LinkType, want.Name, want.LinkType)
+		}
+	}
+}
+
+func TestSaveFileHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	input := filepath.Join(dir, "input.pcap")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatalf("Failed to create capture: %v", err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(128, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	for _, p := range testPackets(t) {
+		if err := w.WritePacket(p.Metadata().CaptureInfo, p.Data()); err != nil {
+			t.Fatalf("Failed to write packet: %v", err)
+		}
+	}
+	f.Close()
+
+	tests := []struct {
+		name      string
+		precision string
+		magic     uint32
+	}{
+		{"microseconds", sniffer.TimestampMicro, 0xa1b2c3d4},
+		{"nanoseconds", sniffer.TimestampNano, 0xa1b23c4d},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(dir, tt.name+".pcap")
+			cfg := sniffer.Config{ReadFile: input, SaveFile: output, TimestampPrecision: tt.precision, Quiet: true}
+
+			src, err := sniffer.OpenSource(cfg)
+			if err != nil {
+				t.Fatalf("OpenSource failed: %v", err)
+			}
+			defer src.Close()
+			if err := sniffer.Run(src, cfg); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read saved file: %v", err)
+			}
+			if len(data) < 24 {
+				t.Fatalf("saved file is %d bytes, want a pcap header", len(data))
+			}
+
+			// The pcap file header holds the magic number, which sets the
+			// timestamp precision, at offset 0 and the snaplen at 16.
+			if got := binary.LittleEndian.Uint32(data[0:4]); got != tt.magic {
+				t.Errorf("magic = %#x, want %#x", got, tt.magic)
+			}
+			if got := binary.LittleEndian.Uint32(data[16:20]); got != 128 {
+				t.Errorf("snaplen = %d, want 128", got)
+			}
+		})
+	}
+}
+
+func TestInvalidTimestampPrecision(t *testing.T) {
+	if _, err := sniffer.OpenSource(sniffer.Config{ReadFile: "capture.pcap", TimestampPrecision: "pico"}); err == nil {
+		t.Error("OpenSource accepted an unknown timestamp precision")
+	}
+}
+
+func TestSaveOrder(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	packets := handshakes(t, 100)
+	for i, p := range packets {
+		p.Metadata().Timestamp = start.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	// The workers handle the flows in any order, but the file keeps the
+	// order of the capture.
+	path := filepath.Join(t.TempDir(), "ordered.pcap")
+	cfg := sniffer.Config{Workers: 4, QueueSize: 4, Quiet: true, SaveFile: path, Detectors: []string{"none"}}
+	if err := sniffer.Run(sniffer.NewSliceSource(packets, layers.LinkTypeEthernet), cfg); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+
+	count := 0
+	for {
+		_, ci, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if want := start.Add(time.Duration(count) * time.Millisecond); !ci.Timestamp.Equal(want) {
+			t.Fatalf("packet %d at %s, want %s", count, ci.Timestamp, want)
+		}
+		count++
+	}
+	if count != len(packets) {
+		t.Errorf("saved %d packets, want %d", count, len(packets))
+	}
+}
@@ -0,0 +1,174 @@
+package sniffer_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func buildPacket(t testing.TB, srcIP, dstIP string, transport gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+
+	ethLayer := &layers.Ethernet{
+		SrcMAC:       []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       []byte{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	ipLayer := &layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		SrcIP:   net.ParseIP(srcIP).To4(),
+		DstIP:   net.ParseIP(dstIP).To4(),
+	}
+
+	switch l := transport.(type) {
+	case *layers.TCP:
+		ipLayer.Protocol = layers.IPProtocolTCP
+		l.SetNetworkLayerForChecksum(ipLayer)
+	case *layers.UDP:
+		ipLayer.Protocol = layers.IPProtocolUDP
+		l.SetNetworkLayerForChecksum(ipLayer)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	if err := gopacket.SerializeLayers(buffer, opts, ethLayer, ipLayer, transport); err != nil {
+		t.Fatalf("Failed to serialize packet: %v", err)
+	}
+
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(buffer.Bytes()),
+		Length:        len(buffer.Bytes()),
+	}
+
+	return packet
+}
+
+func testPackets(t *testing.T) []gopacket.Packet {
+	return []gopacket.Packet{
+		buildPacket(t, "192.168.1.1", "192.168.1.2", &layers.TCP{SrcPort: 12345, DstPort: 80, SYN: true}),
+		buildPacket(t, "192.168.1.1", "192.168.1.2", &layers.TCP{SrcPort: 12345, DstPort: 443, SYN: true}),
+		buildPacket(t, "192.168.1.1", "192.168.1.2", &layers.UDP{SrcPort: 5353, DstPort: 53}),
+	}
+}
+
+func TestRunSliceSource(t *testing.T) {
+	packets := testPackets(t)
+
+	src := sniffer.NewSliceSource(packets, layers.LinkTypeEthernet)
+	if err := sniffer.Run(src, sniffer.Config{}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := sniffer.CurrentStats()
+	if got.Total != 3 {
+		t.Errorf("Total = %d, want 3", got.Total)
+	}
+	if got.TCP != 2 {
+		t.Errorf("TCP = %d, want 2", got.TCP)
+	}
+	if got.UDP != 1 {
+		t.Errorf("UDP = %d, want 1", got.UDP)
+	}
+
+	wantBytes := 0
+	for _, p := range packets {
+		wantBytes += p.Metadata().Length
+	}
+	if got.Bytes != wantBytes {
+		t.Errorf("Bytes = %d, want %d", got.Bytes, wantBytes)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		write func(f *os.File, packets []gopacket.Packet) error
+	}{
+		{
+			name: "pcap",
+			file: "capture.pcap",
+			write: func(f *os.File, packets []gopacket.Packet) error {
+				w := pcapgo.NewWriter(f)
+				if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+					return err
+				}
+				for _, p := range packets {
+					if err := w.WritePacket(p.Metadata().CaptureInfo, p.Data()); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "pcapng",
+			file: "capture.pcapng",
+			write: func(f *os.File, packets []gopacket.Packet) error {
+				w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+				if err != nil {
+					return err
+				}
+				for _, p := range packets {
+					if err := w.WritePacket(p.Metadata().CaptureInfo, p.Data()); err != nil {
+						return err
+					}
+				}
+				return w.Flush()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets := testPackets(t)
+			path := filepath.Join(t.TempDir(), tt.file)
+
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatalf("Failed to create capture file: %v", err)
+			}
+			if err := tt.write(f, packets); err != nil {
+				t.Fatalf("Failed to write capture file: %v", err)
+			}
+			f.Close()
+
+			src, err := sniffer.NewFileSource(path, "")
+			if err != nil {
+				t.Fatalf("NewFileSource failed: %v", err)
+			}
+			defer src.Close()
+
+			if src.LinkType() != layers.LinkTypeEthernet {
+				t.Errorf("LinkType = %v, want %v", src.LinkType(), layers.LinkTypeEthernet)
+			}
+
+			count := 0
+			for packet := range src.Packets() {
+				if packet.Layer(layers.LayerTypeIPv4) == nil {
+					t.Errorf("packet %d has no IPv4 layer", count)
+				}
+				count++
+			}
+
+			if count != len(packets) {
+				t.Errorf("read %d packets, want %d", count, len(packets))
+			}
+		})
+	}
+}
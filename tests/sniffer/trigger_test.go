@@ -0,0 +1,103 @@
+package sniffer_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zczqas/sniff-n-fetch/internal/sniffer"
+)
+
+func TestTriggerRecorder(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(p gopacket.Packet, offset time.Duration) gopacket.Packet {
+		p.Metadata().Timestamp = start.Add(offset)
+		return p
+	}
+
+	// Background traffic every second for a minute, with a burst of
+	// probes at 30s that trips the port scan detector.
+	var packets []gopacket.Packet
+	for i := 0; i < 60; i++ {
+		packets = append(packets, at(buildPacket(t, "10.1.1.1", "10.0.0.1",
+			&layers.UDP{SrcPort: 5353, DstPort: 53}), time.Duration(i)*time.Second))
+		if i == 30 {
+			for port := 1; port <= 12; port++ {
+				packets = append(packets, at(buildPacket(t, "10.9.9.9", "10.0.0.1",
+					&layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(port), SYN: true}),
+					30*time.Second+time.Duration(port)*time.Millisecond))
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	cfg := sniffer.Config{
+		Quiet:         true,
+		Detectors:     []string{"portscan"},
+		TriggerDir:    dir,
+		TriggerBefore: 5 * time.Second,
+		TriggerAfter:  3 * time.Second,
+		DetectorOptions: map[string]sniffer.DetectorOptions{
+			"portscan": {"ports": "10"},
+		},
+	}
+	if err := sniffer.Run(sniffer.NewSliceSource(packets, layers.LinkTypeEthernet), cfg); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d triggered captures, want 1", len(entries))
+	}
+	name := entries[0].Name()
+	if !strings.Contains(name, "port_scan-10.9.9.9") {
+		t.Errorf("file name = %q, want it to name the alert and source", name)
+	}
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+
+	var first, last time.Time
+	probes := 0
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if first.IsZero() {
+			first = ci.Timestamp
+		}
+		last = ci.Timestamp
+
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		if packet.Layer(layers.LayerTypeTCP) != nil {
+			probes++
+		}
+	}
+
+	if want := start.Add(25 * time.Second); first.Before(want) {
+		t.Errorf("first packet at %v, want no earlier than %v", first, want)
+	}
+	if want := start.Add(33 * time.Second); last.After(want) || last.Before(want.Add(-time.Second)) {
+		t.Errorf("last packet at %v, want about %v", last, want)
+	}
+	if probes != 12 {
+		t.Errorf("capture has %d probes, want 12", probes)
+	}
+}